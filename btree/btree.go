@@ -1,8 +1,10 @@
 package btree
 
 import (
+	"bytes"
 	"errors"
-	"log"
+	"fmt"
+	"runtime"
 
 	"github.com/yuya-isaka/chibidb/disk"
 	"github.com/yuya-isaka/chibidb/page"
@@ -10,26 +12,73 @@ import (
 	"github.com/yuya-isaka/chibidb/util"
 )
 
+// 枝ノードのペアは (Key, 子ページID) で構成される
+// 先頭のペアのKeyは使用しない（負の無限大として扱う）
+// i番目の子ページには、i番目のKey以上、i+1番目のKey未満のキーが格納される
+
+// ルートページIDは木を作成してから変わらない
+// ルートの分割ではルートの内容を新しい子ページに移し、ルートの縮小では子ページの内容をルートに移す
+// メタページは木の作成時にしか書き換えないので、木の更新はすべてログに記録されたページの更新になる
+
+// 並行制御（ラッチクラビング）
+// 読み込みは共有ラッチを親から子へ手渡しで取得し、子ページのラッチを取得したら親ページのラッチを解放する
+// 書き込みは排他ラッチを取得しながら降り、子ページが分割・再調整されないことが確定したら祖先のラッチを解放する
+// ただし更新したページのラッチは、ログに記録するまで（トランザクションの終了まで）保持する
+// 兄弟ページのラッチは親ページの排他ラッチを保持している間だけ取得し、親をまたぐ葉のラッチは左から右の順に取得する
+
+var (
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrKeyExists     = errors.New("key already exists")
+	ErrValueMismatch = errors.New("value mismatch")
+
+	// 読み取り専用で開いたプールマネージャのBTreeに書き込もうとした場合のエラー（pool.ErrReadOnlyと同じ）
+	ErrReadOnly = pool.ErrReadOnly
+)
+
+// ラッチを取得できなかったため、トランザクションをやり直す必要があることを示すエラー
+var errRetry = errors.New("retry")
+
+// 複数のゴルーチンから同時に呼び出せる
 type BTree struct {
 	rootID      disk.PageID
 	poolManager *pool.PoolManager
 }
 
 func NewBTree(poolManager *pool.PoolManager) (*BTree, error) {
-	// rootID == 0
-	rootID, err := poolManager.CreatePage()
+	b := &BTree{
+		poolManager: poolManager,
+	}
+
+	// rootPageは一番最初はリーフノード
+	tx := poolManager.Begin()
+	rootPage, err := b.createWLatched(tx)
 	if err != nil {
+		tx.Abort()
+		return nil, err
+	}
+	rootPage.SetNodeType(page.LeafNodeType)
+	b.rootID = rootPage.PageID
+	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
 
-	// rootPage
-	rootPage, err := poolManager.FetchPage(rootID)
+	// メタページにルートページIDを記録
+	if err := poolManager.SetRootID(b.rootID); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// メタページに記録されたルートページIDから既存のBTreeを開く
+func OpenBTree(poolManager *pool.PoolManager) (*BTree, error) {
+	rootID, err := poolManager.RootID()
 	if err != nil {
 		return nil, err
 	}
-	// リーフノードの設定だけでいいはず
-	// rootPageは一番最初はリーフノード
-	rootPage.SetNodeType(page.LeafNodeType)
+	if rootID == disk.PageID(-1) {
+		return nil, errors.New("btree not found")
+	}
 
 	return &BTree{
 		rootID:      rootID,
@@ -38,140 +87,780 @@ func NewBTree(poolManager *pool.PoolManager) (*BTree, error) {
 }
 
 func (b *BTree) Search(key []byte) ([]byte, error) {
-	current, err := b.poolManager.FetchPage(b.rootID)
+	current, err := b.findLeaf(key)
 	if err != nil {
 		return nil, err
 	}
+	defer b.releaseR(current)
 
-	for current != nil {
-		var i uint16 = 0
-		for i < current.GetPointersNum() && util.CompareByteSlice(key, current.GetKey(i)) == util.Greater {
-			i++
-		}
+	i, found := current.SearchKey(key)
+	if !found {
+		return nil, ErrKeyNotFound
+	}
 
-		if i < current.GetPointersNum() && util.CompareByteSlice(key, current.GetKey(i)) == util.Equal {
-			if current.GetNodeType() == page.LeafNodeType {
-				return current.GetValue(i), nil
-			}
-		}
+	// ラッチを解放するとページデータは書き換わる可能性があるのでコピーして返却
+	// オーバーフローページに格納された値は、葉ページのラッチを保持したまま組み立てる
+	return b.loadValue(current.GetValue(i))
+}
 
-		if current.GetNodeType() == page.LeafNodeType {
-			return nil, errors.New("key not found")
-		}
+// キーが属する葉ページまで、共有ラッチを親から子へ手渡しで取得しながら降りて返却
+// 返却する葉ページはピンと共有ラッチを取得しているので、使用後にreleaseRで解放すること
+func (b *BTree) findLeaf(key []byte) (*page.Page, error) {
+	current, err := b.fetchRLatched(b.rootID)
+	if err != nil {
+		return nil, err
+	}
 
-		newPageId := util.BytesToPageID(current.GetValue(i))
-		current, err = b.poolManager.FetchPage(newPageId)
+	for current.GetNodeType() == page.BranchNodeType {
+		childID := util.BytesToPageID(current.GetValue(childIndex(current, key)))
+		childPage, err := b.fetchRLatched(childID)
+		// 子ページのラッチを取得してから親ページのラッチを解放
+		b.releaseR(current)
 		if err != nil {
 			return nil, err
 		}
+		current = childPage
 	}
 
-	return nil, errors.New("key not found")
+	return current, nil
 }
 
+// キーと値を挿入する関数
+// キーが既に存在する場合は値を置き換える（Putと同じ）
 func (b *BTree) Insert(key []byte, value []byte) error {
-	rootPage, err := b.poolManager.FetchPage(b.rootID)
-	if err != nil {
+	return b.Put(key, value)
+}
+
+// キーと値を書き込む関数
+// キーが既に存在する場合は値を置き換える
+// 途中でエラーが起きた場合、更新はすべて取り消される
+func (b *BTree) Put(key []byte, value []byte) error {
+	return b.run(func(tx *pool.Txn) error {
+		return b.putOp(tx, key, value, nil)
+	})
+}
+
+// キーが存在しない場合だけ、キーと値を挿入する関数
+// キーが既に存在する場合はErrKeyExistsを返却する
+func (b *BTree) InsertNew(key []byte, value []byte) error {
+	return b.run(func(tx *pool.Txn) error {
+		return b.putOp(tx, key, value, mustNotExist)
+	})
+}
+
+// キーが存在する場合だけ、値を置き換える関数
+// キーが存在しない場合はErrKeyNotFoundを返却する
+func (b *BTree) Update(key []byte, value []byte) error {
+	return b.run(func(tx *pool.Txn) error {
+		return b.putOp(tx, key, value, mustExist)
+	})
+}
+
+// キーの現在の値がoldValueと一致する場合だけ、値をnewValueに置き換える関数
+// キーが存在しない場合はErrKeyNotFound、値が一致しない場合はErrValueMismatchを返却する
+func (b *BTree) CompareAndSwap(key []byte, oldValue []byte, newValue []byte) error {
+	return b.run(func(tx *pool.Txn) error {
+		return b.putOp(tx, key, newValue, b.mustMatch(oldValue))
+	})
+}
+
+// 1つの操作をトランザクションとして実行する関数
+// 操作がエラーを返却した場合、更新はすべて取り消される
+func (b *BTree) run(op func(tx *pool.Txn) error) error {
+	if b.poolManager.ReadOnly() {
+		return ErrReadOnly
+	}
+	tx := b.poolManager.Begin()
+	if err := op(tx); err != nil {
+		tx.Abort()
 		return err
 	}
-	if rootPage.GetPointersNum() == 0 {
-		rootPage.InsertPair(0, page.NewPair(key, value))
+	return tx.Commit()
+}
+
+// 葉ノードで書き込みを続けてよいかを判定する関数
+// storedは葉ノードに格納されている現在の値（キーが存在しない場合はnil）
+// エラーを返却した場合、この操作の更新は取り消される
+type putCond func(stored []byte, found bool) error
+
+func mustNotExist(stored []byte, found bool) error {
+	if found {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+func mustExist(stored []byte, found bool) error {
+	if !found {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// 現在の値がoldValueと一致することを判定する関数を返却
+// オーバーフローページに格納された値は、葉ページのラッチを保持したまま組み立てて比較する
+func (b *BTree) mustMatch(oldValue []byte) putCond {
+	return func(stored []byte, found bool) error {
+		if !found {
+			return ErrKeyNotFound
+		}
+		current, err := b.loadValue(stored)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(current, oldValue) {
+			return ErrValueMismatch
+		}
 		return nil
 	}
+}
 
-	// freeNumがpage.MaxPairSizeの半分よりも小さくなったら分割
-	if rootPage.GetFreeNum()*2 < page.MaxPairSize {
-		// 新しいrootPageを作成
-		newRootID, err := b.poolManager.CreatePage()
+// トランザクション内でキーと値を書き込む関数
+// condがnilでない場合、葉ノードでcondがエラーを返却すると書き込まずに終了する
+// 大きな値は先にオーバーフローページに書き込み、葉ノードにはその位置を格納する
+// ラッチを取得できなかった場合は、この操作の更新を取り消してやり直す
+// 途中でエラーが起きた場合、この操作の更新だけが取り消される
+func (b *BTree) putOp(tx *pool.Txn, key []byte, value []byte, cond putCond) error {
+	stored, overflowIDs, err := b.storeValue(tx, key, value)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err := b.put(tx, key, stored, cond)
+		if errors.Is(err, errRetry) {
+			tx.Discard()
+			runtime.Gosched()
+			continue
+		}
 		if err != nil {
+			tx.Discard()
+			b.freeValue(tx, overflowIDs)
+		}
+		return err
+	}
+}
+
+func (b *BTree) put(tx *pool.Txn, key []byte, value []byte, cond putCond) error {
+	rootPage, err := b.fetchWLatched(tx, b.rootID)
+	if err != nil {
+		return err
+	}
+
+	// ルートページがいっぱいなら分割
+	if isFull(rootPage) {
+		if err := b.splitRoot(tx, rootPage); err != nil {
 			return err
 		}
-		newRootPage, err := b.poolManager.FetchPage(newRootID)
+	}
+
+	return b.insertNonFull(tx, rootPage, key, value, cond)
+}
+
+// ルートページの内容を新しい子ページに移し、その子ページを分割する関数
+// ルートページは2つの子ページを持つ枝ノードになる
+func (b *BTree) splitRoot(tx *pool.Txn, rootPage *page.Page) error {
+	childPage, err := b.createWLatched(tx)
+	if err != nil {
+		return err
+	}
+	childPage.SetNodeType(rootPage.GetNodeType())
+	if err := resetPairs(childPage, copyPairs(rootPage)); err != nil {
+		return err
+	}
+
+	// 先頭のKeyは使用しない
+	rootPage.ResetPageData()
+	rootPage.SetNodeType(page.BranchNodeType)
+	if err := rootPage.InsertPair(0, page.NewPair(nil, util.PageIDTo8Bytes(childPage.PageID))); err != nil {
+		return err
+	}
+
+	newPage, err := b.splitChild(tx, rootPage, 0, childPage)
+	if err != nil {
+		return err
+	}
+	b.releaseW(tx, newPage)
+	b.releaseW(tx, childPage)
+	return nil
+}
+
+// 分割が不要なことが保証されたページに挿入する関数
+// 子ページに降りる前に、子ページがいっぱいなら分割しておく
+// 葉ノードにキーが既に存在する場合は値を置き換え、置き換える前の値のオーバーフローページはコミット後に解放する
+// 子ページは分割されないことが確定しているので、子ページの排他ラッチを取得したら親ページのラッチを解放する
+// nodePageはピンと排他ラッチを取得済みであること
+func (b *BTree) insertNonFull(tx *pool.Txn, nodePage *page.Page, key []byte, value []byte, cond putCond) error {
+	for nodePage.GetNodeType() == page.BranchNodeType {
+		idx := childIndex(nodePage, key)
+		targetPage, err := b.fetchWLatched(tx, util.BytesToPageID(nodePage.GetValue(idx)))
 		if err != nil {
 			return err
 		}
-		newRootPage.SetNodeType(page.BranchNodeType)
-		// Keyは現時点では不明
-		// ValueはrootID
-		newRootPage.InsertPair(0, page.NewPair(nil, util.PageIDTo8Bytes(b.rootID)))
-		b.splitChild(newRootPage, 0)
-		b.rootID = newRootID
+		if isFull(targetPage) {
+			newPage, err := b.splitChild(tx, nodePage, idx, targetPage)
+			if err != nil {
+				return err
+			}
+			// 分割で作られた右側のページに入るべきか判定
+			if util.CompareByteSlice(key, nodePage.GetKey(idx+1)) != util.Less {
+				b.releaseW(tx, targetPage)
+				targetPage = newPage
+			} else {
+				b.releaseW(tx, newPage)
+			}
+		}
+		b.releaseW(tx, nodePage)
+		nodePage = targetPage
+	}
+
+	idx, found := nodePage.SearchKey(key)
+	var stored []byte
+	if found {
+		stored = nodePage.GetValue(idx)
+	}
+	if cond != nil {
+		if err := cond(stored, found); err != nil {
+			return err
+		}
 	}
 
-	b.insertNonFull(rootPage, key, value)
+	// キーと値を挿入
+	if !found {
+		return nodePage.InsertPair(idx, page.NewPair(key, value))
+	}
 
+	// 値を置き換える
+	// 分割済みなので、値の大きさが変わっても葉ページに収まる
+	freed, err := b.overflowPages(stored)
+	if err != nil {
+		return err
+	}
+	if err := nodePage.UpdatePair(idx, page.NewPair(key, value)); err != nil {
+		return err
+	}
+	b.freeValue(tx, freed)
 	return nil
 }
 
-// ここら辺バグってる
-func (b *BTree) insertNonFull(nodePage *page.Page, key []byte, value []byte) {
-	idx := nodePage.GetPointersNum() - 1
-	for idx != 0 && util.CompareByteSlice(nodePage.GetKey(idx), key) == util.Greater {
-		idx--
+// parentPageのidx番目の子ページoldPageを分割し、右半分を新しいページに移動する関数
+// parentPageとoldPageは排他ラッチを取得済みであること
+// 新しいページはピンと排他ラッチを取得した状態で返却する
+func (b *BTree) splitChild(tx *pool.Txn, parentPage *page.Page, idx uint16, oldPage *page.Page) (*page.Page, error) {
+	// 葉の場合、葉の連結リストでoldPageの次にある葉のラッチを先に取得
+	// 次の葉は親をまたぐ可能性があるので、ラッチは待たずに取得を試みる
+	var nextPage *page.Page
+	if oldPage.GetNodeType() == page.LeafNodeType && oldPage.GetNextID() != disk.PageID(-1) {
+		p, err := b.tryFetchWLatched(tx, oldPage.GetNextID())
+		if err != nil {
+			return nil, err
+		}
+		defer b.releaseW(tx, p)
+		nextPage = p
 	}
-	idx++
 
-	switch nodePage.GetNodeType() {
+	// 新しいページを作成
+	newPage, err := b.createWLatched(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := copyPairs(oldPage)
+	medianIdx := splitIndex(pairs)
+	medianKey := pairs[medianIdx].Key
+
+	var leftPairs, rightPairs []*page.Pair
+	switch oldPage.GetNodeType() {
 	case page.LeafNodeType:
-		// キーと値を挿入
-		nodePage.InsertPair(idx, page.NewPair(key, value))
-		return
+		// 葉の場合、中央のペア以降を新しいページに移動し、中央のキーを親にコピー
+		leftPairs = pairs[:medianIdx]
+		rightPairs = pairs[medianIdx:]
+
+		// 葉の連結リストのoldPageの次に、newPageを挿入
+		if nextPage != nil {
+			nextPage.SetPrevID(newPage.PageID)
+		}
+		newPage.SetPrevID(oldPage.PageID)
+		newPage.SetNextID(oldPage.GetNextID())
+		oldPage.SetNextID(newPage.PageID)
 	case page.BranchNodeType:
-		if nodePage.GetFreeNum()*2 < page.MaxPairSize {
-			b.splitChild(nodePage, idx)
-			if util.CompareByteSlice(key, nodePage.GetKey(idx)) == util.Greater {
-				idx++
-			}
+		// 枝の場合、中央のキーは親に移動し、中央の子ページは新しいページの先頭になる
+		leftPairs = pairs[:medianIdx]
+		rightPairs = append([]*page.Pair{page.NewPair(nil, pairs[medianIdx].Value)}, pairs[medianIdx+1:]...)
+	}
+
+	newPage.SetNodeType(oldPage.GetNodeType())
+	if err := resetPairs(oldPage, leftPairs); err != nil {
+		return nil, err
+	}
+	if err := resetPairs(newPage, rightPairs); err != nil {
+		return nil, err
+	}
+
+	// parentPageにnewPageを指すペアを挿入
+	if err := parentPage.InsertPair(idx+1, page.NewPair(medianKey, util.PageIDTo8Bytes(newPage.PageID))); err != nil {
+		return nil, err
+	}
+	return newPage, nil
+}
+
+// キーを削除し、使用量が少なくなったページを兄弟ページとの借用・マージで再調整する関数
+// 統合などで木から外れたページは、コミット後に空きページに戻す
+// 途中でエラーが起きた場合、更新はすべて取り消される
+func (b *BTree) Delete(key []byte) error {
+	return b.run(func(tx *pool.Txn) error {
+		return b.deleteOp(tx, key)
+	})
+}
+
+// トランザクション内でキーを削除する関数
+// ラッチを取得できなかった場合は、この操作の更新を取り消してやり直す
+// 途中でエラーが起きた場合、この操作の更新だけが取り消される
+func (b *BTree) deleteOp(tx *pool.Txn, key []byte) error {
+	for {
+		err := b.delete(tx, key)
+		if errors.Is(err, errRetry) {
+			tx.Discard()
+			runtime.Gosched()
+			continue
 		}
-		targetPageID := nodePage.GetValue(idx)
-		targetPage, err := b.poolManager.FetchPage(util.BytesToPageID(targetPageID))
 		if err != nil {
-			log.Panicf("failed to fetch page: %v", err)
-			return
+			tx.Discard()
 		}
-		b.insertNonFull(targetPage, key, value)
+		return err
 	}
 }
 
-func (b *BTree) splitChild(parentPage *page.Page, idx uint16) {
-	oldPageID := util.BytesToPageID(parentPage.GetValue(idx))
-	oldPage, err := b.poolManager.FetchPage(oldPageID)
+// 排他ラッチを取得しながら降り、子ページから1ペア削除されても再調整が不要なら祖先のラッチを解放する
+// 再調整で書き換わる可能性のある祖先ページだけ、ラッチを保持したまま葉まで降りる
+// 木から外れたページは、削除が完了したらコミット後に空きページに戻すよう登録する
+func (b *BTree) delete(tx *pool.Txn, key []byte) error {
+	rootPage, err := b.fetchWLatched(tx, b.rootID)
 	if err != nil {
-		log.Panicf("failed to fetch page: %v", err)
-		return
+		return err
 	}
 
-	// 新しいページを作成
-	newPageID, err := b.poolManager.CreatePage()
+	// 排他ラッチを保持しているページ
+	// path[i+1]はpath[i]のindexes[i]番目の子ページ
+	path := []*page.Page{rootPage}
+	indexes := []uint16{}
+
+	current := rootPage
+	for current.GetNodeType() == page.BranchNodeType {
+		idx := childIndex(current, key)
+		childPage, err := b.fetchWLatched(tx, util.BytesToPageID(current.GetValue(idx)))
+		if err != nil {
+			return err
+		}
+		if isDeleteSafe(childPage) {
+			// 子ページは再調整されないので、祖先ページが書き換わることはない
+			for _, p := range path {
+				b.releaseW(tx, p)
+			}
+			path = path[:0]
+			indexes = indexes[:0]
+		} else {
+			indexes = append(indexes, idx)
+		}
+		path = append(path, childPage)
+		current = childPage
+	}
+
+	idx, found := current.SearchKey(key)
+	if !found {
+		return ErrKeyNotFound
+	}
+	// 値のオーバーフローページも、削除が完了したら解放する
+	freed, err := b.overflowPages(current.GetValue(idx))
 	if err != nil {
-		log.Panicf("failed to create page: %v", err)
-		return
+		return err
+	}
+	if err := current.DeletePair(idx); err != nil {
+		return err
+	}
+
+	// 子ページの使用量が少なくなりすぎた場合、下から順に再調整
+	for i := len(path) - 1; i > 0; i-- {
+		if !isUnderflow(path[i]) {
+			break
+		}
+		removedID, err := b.rebalance(tx, path[i-1], indexes[i-1], path[i])
+		if err != nil {
+			return err
+		}
+		if removedID != disk.PageID(-1) {
+			freed = append(freed, removedID)
+		}
 	}
-	newPage, err := b.poolManager.FetchPage(newPageID)
+
+	// ルートが枝で子が1つだけになったら、その子の内容をルートに移す
+	if path[0] == rootPage && rootPage.GetNodeType() == page.BranchNodeType && rootPage.GetPointersNum() == 1 {
+		removedID, err := b.collapseRoot(tx, rootPage)
+		if err != nil {
+			return err
+		}
+		freed = append(freed, removedID)
+	}
+
+	b.freeValue(tx, freed)
+	return nil
+}
+
+// ルートページのただ1つの子ページの内容をルートページに移し、木を1段低くする関数
+// 木から外れた子ページのIDを返却する
+func (b *BTree) collapseRoot(tx *pool.Txn, rootPage *page.Page) (disk.PageID, error) {
+	childPage, err := b.fetchWLatched(tx, util.BytesToPageID(rootPage.GetValue(0)))
 	if err != nil {
-		log.Panicf("failed to fetch page: %v", err)
-		return
+		return disk.PageID(-1), err
 	}
 
-	// childPageの中央のペア以降をnewPageに移動
-	medianIdx := oldPage.GetPointersNum() / 2
-	for i := medianIdx + 1; i < oldPage.GetPointersNum(); i++ {
-		newPage.InsertPair(uint16(i-medianIdx-1), page.NewPair(oldPage.GetKey(i), oldPage.GetValue(i)))
+	// 子ページは同じ深さで唯一のページなので、葉の場合も前後のページはない
+	rootPage.SetNodeType(childPage.GetNodeType())
+	if err := resetPairs(rootPage, copyPairs(childPage)); err != nil {
+		return disk.PageID(-1), err
 	}
-	medianKey := oldPage.GetKey(medianIdx)
 
-	switch oldPage.GetNodeType() {
+	// 子ページは木から外れたので、無効なページにしておく
+	childPage.ResetPageData()
+	return childPage.PageID, nil
+}
+
+// parentPageのidx番目の子ページcurrentPageを、兄弟ページからの借用またはマージで再調整する関数
+// parentPageとcurrentPageは排他ラッチを取得済みであること
+// 兄弟ページのラッチは待たずに取得を試み、取得できなければerrRetryを返却する
+// 統合で木から外れたページのIDを返却する（統合しなかった場合は-1）
+func (b *BTree) rebalance(tx *pool.Txn, parentPage *page.Page, idx uint16, currentPage *page.Page) (disk.PageID, error) {
+	var leftPage, rightPage *page.Page
+	if idx > 0 {
+		p, err := b.tryFetchWLatched(tx, util.BytesToPageID(parentPage.GetValue(idx-1)))
+		if err != nil {
+			return disk.PageID(-1), err
+		}
+		defer b.releaseW(tx, p)
+		leftPage = p
+	}
+	if idx+1 < parentPage.GetPointersNum() {
+		p, err := b.tryFetchWLatched(tx, util.BytesToPageID(parentPage.GetValue(idx+1)))
+		if err != nil {
+			return disk.PageID(-1), err
+		}
+		defer b.releaseW(tx, p)
+		rightPage = p
+	}
+
+	switch {
+	case leftPage != nil && canLend(leftPage, leftPage.GetPointersNum()-1):
+		// 左の兄弟から借りる
+		return disk.PageID(-1), borrowFromLeft(parentPage, idx, leftPage, currentPage)
+	case rightPage != nil && canLend(rightPage, 0):
+		// 右の兄弟から借りる
+		return disk.PageID(-1), borrowFromRight(parentPage, idx, currentPage, rightPage)
+	case leftPage != nil:
+		// 統合
+		// 葉の場合、currentPageの次の葉はラッチ取得済みのrightPage
+		return b.merge(tx, parentPage, idx-1, leftPage, currentPage, rightPage)
+	case rightPage != nil:
+		return b.merge(tx, parentPage, idx, currentPage, rightPage, nil)
+	}
+	return disk.PageID(-1), nil
+}
+
+// 左の兄弟の最後のペアを、idx番目の子ページの先頭に移動する関数
+func borrowFromLeft(parentPage *page.Page, idx uint16, leftPage *page.Page, currentPage *page.Page) error {
+	parentPairs := copyPairs(parentPage)
+	currentPairs := copyPairs(currentPage)
+	leftPairs := copyPairs(leftPage)
+
+	moved := leftPairs[len(leftPairs)-1]
+	leftPairs = leftPairs[:len(leftPairs)-1]
+
+	switch currentPage.GetNodeType() {
+	case page.LeafNodeType:
+		currentPairs = append([]*page.Pair{moved}, currentPairs...)
+	case page.BranchNodeType:
+		// 親の区切りキーを現在の先頭の子ページに下ろし、左兄弟の最後の子ページを先頭にする
+		currentPairs[0].Key = parentPairs[idx].Key
+		currentPairs = append([]*page.Pair{page.NewPair(nil, moved.Value)}, currentPairs...)
+	}
+	parentPairs[idx].Key = moved.Key
+
+	if err := resetPairs(leftPage, leftPairs); err != nil {
+		return err
+	}
+	if err := resetPairs(currentPage, currentPairs); err != nil {
+		return err
+	}
+	return resetPairs(parentPage, parentPairs)
+}
+
+// 右の兄弟の最初のペアを、idx番目の子ページの末尾に移動する関数
+func borrowFromRight(parentPage *page.Page, idx uint16, currentPage *page.Page, rightPage *page.Page) error {
+	parentPairs := copyPairs(parentPage)
+	currentPairs := copyPairs(currentPage)
+	rightPairs := copyPairs(rightPage)
+
+	moved := rightPairs[0]
+	rightPairs = rightPairs[1:]
+
+	switch currentPage.GetNodeType() {
 	case page.LeafNodeType:
-		newPage.SetNodeType(page.LeafNodeType)
-		oldPage.DeletePair(medianIdx + 1)
+		currentPairs = append(currentPairs, moved)
+		parentPairs[idx+1].Key = rightPairs[0].Key
 	case page.BranchNodeType:
-		newPage.SetNodeType(page.BranchNodeType)
-		for i := medianIdx + 1; i < oldPage.GetPointersNum(); i++ {
-			newPage.InsertPair(uint16(i-medianIdx-1), oldPage.GetPair(i))
+		// 親の区切りキーを右兄弟の先頭の子ページと共に下ろし、右兄弟の次のキーを親に上げる
+		currentPairs = append(currentPairs, page.NewPair(parentPairs[idx+1].Key, moved.Value))
+		parentPairs[idx+1].Key = rightPairs[0].Key
+		rightPairs[0].Key = nil
+	}
+
+	if err := resetPairs(rightPage, rightPairs); err != nil {
+		return err
+	}
+	if err := resetPairs(currentPage, currentPairs); err != nil {
+		return err
+	}
+	return resetPairs(parentPage, parentPairs)
+}
+
+// idx+1番目の子ページrightPageをidx番目の子ページleftPageに統合する関数
+// 葉の場合、rightPageの次の葉のラッチを取得済みであればnextPageに渡す（nilの場合はこの関数内で取得する）
+// 統合で木から外れたrightPageのIDを返却する（統合しなかった場合は-1）
+func (b *BTree) merge(tx *pool.Txn, parentPage *page.Page, idx uint16, leftPage *page.Page, rightPage *page.Page, nextPage *page.Page) (disk.PageID, error) {
+	parentPairs := copyPairs(parentPage)
+	leftPairs := copyPairs(leftPage)
+	rightPairs := copyPairs(rightPage)
+
+	// 枝の場合、親の区切りキーを右ページの先頭の子ページと共に下ろす
+	if rightPage.GetNodeType() == page.BranchNodeType {
+		rightPairs[0].Key = parentPairs[idx+1].Key
+	}
+	mergedPairs := append(leftPairs, rightPairs...)
+
+	// 1ページに収まらない場合は統合しない
+	mergedSize := 0
+	for _, pair := range mergedPairs {
+		mergedSize += pairSize(pair)
+	}
+	if mergedSize > int(leftPage.MaxPairSize()) {
+		return disk.PageID(-1), nil
+	}
+
+	// 葉の場合、葉の連結リストから右ページを外す
+	// 次の葉は親をまたぐ可能性があるので、ラッチは待たずに取得を試みる
+	if rightPage.GetNodeType() == page.LeafNodeType {
+		nextID := rightPage.GetNextID()
+		if nextID != disk.PageID(-1) {
+			if nextPage == nil {
+				p, err := b.tryFetchWLatched(tx, nextID)
+				if err != nil {
+					return disk.PageID(-1), err
+				}
+				defer b.releaseW(tx, p)
+				nextPage = p
+			}
+			nextPage.SetPrevID(leftPage.PageID)
+		}
+		leftPage.SetNextID(nextID)
+	}
+
+	// 親ページから右ページを削除
+	parentPairs = append(parentPairs[:idx+1], parentPairs[idx+2:]...)
+
+	if err := resetPairs(leftPage, mergedPairs); err != nil {
+		return disk.PageID(-1), err
+	}
+	if err := resetPairs(parentPage, parentPairs); err != nil {
+		return disk.PageID(-1), err
+	}
+
+	// 右ページは木から外れたので、無効なページにしておく
+	// 古い位置を覚えているカーソルは、ノードの種類で無効になったことを検出できる
+	rightPage.ResetPageData()
+	return rightPage.PageID, nil
+}
+
+// ページを取得し、共有ラッチを取得
+func (b *BTree) fetchRLatched(pageID disk.PageID) (*page.Page, error) {
+	p, err := b.poolManager.FetchPage(pageID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch page %d: %w", pageID, err)
+	}
+	p.RLatch()
+	return p, nil
+}
+
+// ページを取得して排他ラッチを取得し、トランザクションに登録
+// 更新済みでラッチを保持し続けているページは、そのまま返却する
+func (b *BTree) fetchWLatched(tx *pool.Txn, pageID disk.PageID) (*page.Page, error) {
+	if p := tx.Page(pageID); p != nil {
+		return p, nil
+	}
+	p, err := b.poolManager.FetchPage(pageID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch page %d: %w", pageID, err)
+	}
+	p.WLatch()
+	tx.Track(p)
+	return p, nil
+}
+
+// ページを取得して排他ラッチの取得を試み、トランザクションに登録
+// 親から子への順序に従わずにラッチを取得する場合（兄弟ページや次の葉）に使用する
+// 更新したページのラッチはトランザクションの終了まで保持するので、待つとデッドロックする可能性がある
+// 取得できなかった場合はerrRetryを返却し、トランザクションをやり直す
+func (b *BTree) tryFetchWLatched(tx *pool.Txn, pageID disk.PageID) (*page.Page, error) {
+	if p := tx.Page(pageID); p != nil {
+		return p, nil
+	}
+	p, err := b.poolManager.FetchPage(pageID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch page %d: %w", pageID, err)
+	}
+	if !p.TryWLatch() {
+		b.poolManager.UnpinPage(p.PageID, false)
+		return nil, errRetry
+	}
+	tx.Track(p)
+	return p, nil
+}
+
+// 新しいページを作成して排他ラッチを取得し、トランザクションに登録
+func (b *BTree) createWLatched(tx *pool.Txn) (*page.Page, error) {
+	pageID, err := b.poolManager.CreatePage()
+	if err != nil {
+		return nil, fmt.Errorf("create page: %w", err)
+	}
+	p, err := b.poolManager.FetchPage(pageID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch page %d: %w", pageID, err)
+	}
+	p.WLatch()
+	tx.TrackNew(p)
+	return p, nil
+}
+
+// 共有ラッチとピンを解放
+func (b *BTree) releaseR(p *page.Page) {
+	p.RUnlatch()
+	b.poolManager.UnpinPage(p.PageID, false)
+}
+
+// 排他ラッチとピンを解放
+// 更新したページは、トランザクションの終了時に解放される
+func (b *BTree) releaseW(tx *pool.Txn, p *page.Page) {
+	tx.Release(p)
+}
+
+// ===================================================================================================
+
+// ページに空きが少なく、分割が必要かどうかを判定
+// 空き容量（コンパクションで回収できる領域を含む）がp.MaxPairSizeの半分よりも小さくなったら分割
+func isFull(p *page.Page) bool {
+	return p.GetTotalFreeNum()*2 < p.MaxPairSize()
+}
+
+// ページの使用量が少なく、再調整が必要かどうかを判定
+// 使用量がp.MaxPairSizeの4分の1よりも小さくなったら再調整
+func isUnderflow(p *page.Page) bool {
+	return usedSize(p)*4 < int(p.MaxPairSize())
+}
+
+// 任意の1ペアが削除されても、使用量が少なくなりすぎないかを判定
+// 子ページの再調整では親ページのペアが1つ削除されるか、区切りキーが1つ置き換わるだけなので、枝ノードにも使える
+func isDeleteSafe(p *page.Page) bool {
+	maxSize := 0
+	for i := uint16(0); i < p.GetPointersNum(); i++ {
+		maxSize = max(maxSize, pairSize(p.GetPair(i)))
+	}
+	return (usedSize(p)-maxSize)*4 >= int(p.MaxPairSize())
+}
+
+// idx番目のペアを兄弟ページに貸しても、使用量が少なくなりすぎないかを判定
+func canLend(p *page.Page, idx uint16) bool {
+	if p.GetPointersNum() < 2 {
+		return false
+	}
+	return (usedSize(p)-pairSize(p.GetPair(idx)))*4 >= int(p.MaxPairSize())
+}
+
+// ページ内の有効なペアが使用しているバイト数（論理削除されたデータは含まない）
+func usedSize(p *page.Page) int {
+	size := 0
+	for i := uint16(0); i < p.GetPointersNum(); i++ {
+		size += pairSize(p.GetPair(i))
+	}
+	return size
+}
+
+// ペアをページに格納するのに必要なバイト数（キー長の2バイトとスロットポインタの4バイトを含む）
+func pairSize(pair *page.Pair) int {
+	return len(pair.Key) + len(pair.Value) + 2 + 4
+}
+
+// 枝ノードでキーが属する子ページのインデックスを返却
+func childIndex(branchPage *page.Page, key []byte) uint16 {
+	idx, found := branchPage.SearchKey(key)
+	if found {
+		return idx
+	}
+	// 先頭のKeyは負の無限大として扱うため、idxが0になることはない
+	if idx == 0 {
+		return 0
+	}
+	return idx - 1
+}
+
+// 分割後の左右のページの使用量がなるべく均等になる、分割位置のインデックスを返却
+// ペアの大きさが不揃いでも、分割後のどちらのページにもインラインの最大のペアを挿入できる
+// 返却するインデックスは1以上len(pairs)-1以下（左右のページが空にならない）
+func splitIndex(pairs []*page.Pair) int {
+	total := 0
+	for _, pair := range pairs {
+		total += pairSize(pair)
+	}
+
+	// 左のページの使用量が半分以上になる最初の位置と、その1つ前の位置のうち、大きい方のページが小さくなる方を選ぶ
+	left := 0
+	for i, pair := range pairs[:len(pairs)-1] {
+		prev := left
+		left += pairSize(pair)
+		if left*2 >= total {
+			if i > 0 && total-prev < left {
+				return i
+			}
+			return i + 1
 		}
-		oldPage.DeletePair(medianIdx + 1)
 	}
+	return len(pairs) - 1
+}
 
-	// parentPageにnewPageの最初のキーを挿入
-	parentPage.InsertPair(idx, page.NewPair(medianKey, util.PageIDTo8Bytes(newPageID)))
+// ページ内の全ペアをコピーして返却
+// GetPairはページデータを直接参照しているので、ページを書き換える前にコピーが必要
+func copyPairs(p *page.Page) []*page.Pair {
+	pairs := make([]*page.Pair, 0, p.GetPointersNum())
+	for i := uint16(0); i < p.GetPointersNum(); i++ {
+		pair := p.GetPair(i)
+		pairs = append(pairs, page.NewPair(append([]byte(nil), pair.Key...), append([]byte(nil), pair.Value...)))
+	}
+	return pairs
+}
+
+// ページのヘッダを保持したまま、ペアを入れ替える関数
+// 論理削除されたデータも消えるので、空き領域が回復する
+func resetPairs(p *page.Page, pairs []*page.Pair) error {
+	nodeType := p.GetNodeType()
+	prevID := p.GetPrevID()
+	nextID := p.GetNextID()
+
+	p.ResetPageData()
+	p.SetNodeType(nodeType)
+	p.SetPrevID(prevID)
+	p.SetNextID(nextID)
+
+	for i, pair := range pairs {
+		if err := p.InsertPair(uint16(i), pair); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,10 +1,18 @@
 package btree
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
+	"sync"
 	"testing"
 
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/page"
 	"github.com/yuya-isaka/chibidb/pool"
+	"github.com/yuya-isaka/chibidb/util"
 )
 
 func TestBTreeInsertAndSearch(t *testing.T) {
@@ -43,3 +51,976 @@ func TestBTreeInsertAndSearch(t *testing.T) {
 		}
 	}
 }
+
+func TestBTreeSplit(t *testing.T) {
+	poolManager, err := pool.NewPoolManager(t.TempDir()+"/dbfile", 100)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+	defer poolManager.Close()
+
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+
+	// ルートの分割が複数回起きる量をランダムな順序で挿入
+	n := 2000
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Insert(key, []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatalf("Failed to insert key %s: %v", key, err)
+		}
+	}
+
+	rootPage, err := poolManager.FetchPage(btree.rootID)
+	if err != nil {
+		t.Fatalf("Failed to fetch root page: %v", err)
+	}
+	if rootPage.GetNodeType() != page.BranchNodeType {
+		t.Fatalf("Expected root page to be a branch")
+	}
+	poolManager.UnpinPage(btree.rootID, false)
+	if got := len(checkTree(t, btree)); got != n {
+		t.Errorf("Expected %d keys, got %d", n, got)
+	}
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		got, err := btree.Search(key)
+		if err != nil {
+			t.Fatalf("Failed to search key %s: %v", key, err)
+		}
+		if string(got) != fmt.Sprintf("value%05d", i) {
+			t.Errorf("Expected value%05d, got %s", i, got)
+		}
+	}
+
+	if _, err := btree.Search([]byte("nonexistent")); err == nil {
+		t.Errorf("Expected error for nonexistent key, got none")
+	}
+}
+
+func TestBTreeReopen(t *testing.T) {
+	testFile := t.TempDir() + "/dbfile"
+	poolManager, err := pool.NewPoolManager(testFile, 100)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+
+	// BTreeが存在しないファイルは開けない
+	if _, err := OpenBTree(poolManager); err == nil {
+		t.Fatalf("Expected error for empty file, got none")
+	}
+
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+
+	// ルートが分割される量を挿入
+	n := 1000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Insert(key, []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatalf("Failed to insert key %s: %v", key, err)
+		}
+	}
+	rootID := btree.rootID
+	if err := poolManager.Close(); err != nil {
+		t.Fatalf("Failed to close pool manager: %v", err)
+	}
+
+	// 再オープン
+	poolManager, err = pool.NewPoolManager(testFile, 100)
+	if err != nil {
+		t.Fatalf("Failed to reopen pool manager: %v", err)
+	}
+	defer poolManager.Close()
+
+	btree, err = OpenBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to open BTree: %v", err)
+	}
+	if btree.rootID != rootID {
+		t.Errorf("Expected root ID %d, got %d", rootID, btree.rootID)
+	}
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		got, err := btree.Search(key)
+		if err != nil {
+			t.Fatalf("Failed to search key %s: %v", key, err)
+		}
+		if string(got) != fmt.Sprintf("value%05d", i) {
+			t.Errorf("Expected value%05d, got %s", i, got)
+		}
+	}
+}
+
+// 木の構造（キーの順序、区切りキーの範囲、葉の深さ、葉の連結リスト）を検証し、葉のキーを順に返却
+func checkTree(t *testing.T, btree *BTree) [][]byte {
+	t.Helper()
+
+	var keys [][]byte
+	var leaves []disk.PageID
+	leafDepth := -1
+	var walk func(pageID disk.PageID, low, high []byte, depth int)
+	walk = func(pageID disk.PageID, low, high []byte, depth int) {
+		// ページの内容をコピーしてからピンを解放し、子ページをたどる
+		nodePage, err := btree.poolManager.FetchPage(pageID)
+		if err != nil {
+			t.Fatalf("Failed to fetch page %d: %v", pageID, err)
+		}
+		nodeType := nodePage.GetNodeType()
+		prevID := nodePage.GetPrevID()
+		pairs := copyPairs(nodePage)
+		btree.poolManager.UnpinPage(pageID, false)
+
+		for i, pair := range pairs {
+			if nodeType == page.BranchNodeType && i == 0 {
+				continue
+			}
+			if low != nil && util.CompareByteSlice(pair.Key, low) == util.Less {
+				t.Fatalf("Key %s in page %d is less than lower bound %s", pair.Key, pageID, low)
+			}
+			if high != nil && util.CompareByteSlice(pair.Key, high) != util.Less {
+				t.Fatalf("Key %s in page %d is not less than upper bound %s", pair.Key, pageID, high)
+			}
+		}
+
+		switch nodeType {
+		case page.LeafNodeType:
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if leafDepth != depth {
+				t.Fatalf("Leaf %d has depth %d, expected %d", pageID, depth, leafDepth)
+			}
+			// 葉の連結リストが木の順序と一致しているか
+			expectedPrevID := disk.PageID(-1)
+			if len(leaves) > 0 {
+				expectedPrevID = leaves[len(leaves)-1]
+			}
+			if prevID != expectedPrevID {
+				t.Fatalf("Leaf %d has prev %d, expected %d", pageID, prevID, expectedPrevID)
+			}
+			leaves = append(leaves, pageID)
+			for _, pair := range pairs {
+				if len(keys) > 0 && util.CompareByteSlice(keys[len(keys)-1], pair.Key) != util.Less {
+					t.Fatalf("Keys are out of order or duplicated: %s >= %s", keys[len(keys)-1], pair.Key)
+				}
+				keys = append(keys, pair.Key)
+			}
+		case page.BranchNodeType:
+			for i, pair := range pairs {
+				childLow, childHigh := low, high
+				if i > 0 {
+					childLow = pair.Key
+				}
+				if i+1 < len(pairs) {
+					childHigh = pairs[i+1].Key
+				}
+				walk(util.BytesToPageID(pair.Value), childLow, childHigh, depth+1)
+			}
+		default:
+			t.Fatalf("Page %d has invalid node type %q", pageID, nodeType)
+		}
+	}
+	walk(btree.rootID, nil, nil, 0)
+
+	for i, leafID := range leaves {
+		expectedNextID := disk.PageID(-1)
+		if i+1 < len(leaves) {
+			expectedNextID = leaves[i+1]
+		}
+		leafPage, err := btree.poolManager.FetchPage(leafID)
+		if err != nil {
+			t.Fatalf("Failed to fetch page %d: %v", leafID, err)
+		}
+		nextID := leafPage.GetNextID()
+		btree.poolManager.UnpinPage(leafID, false)
+		if nextID != expectedNextID {
+			t.Fatalf("Leaf %d has next %d, expected %d", leafID, nextID, expectedNextID)
+		}
+	}
+
+	return keys
+}
+
+func TestBTreeDelete(t *testing.T) {
+	poolManager, err := pool.NewPoolManager(t.TempDir()+"/dbfile", 100)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+	defer poolManager.Close()
+
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+
+	n := 2000
+	rng := rand.New(rand.NewSource(2))
+	for _, i := range rng.Perm(n) {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Insert(key, []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatalf("Failed to insert key %s: %v", key, err)
+		}
+	}
+
+	// 存在しないキーの削除
+	if err := btree.Delete([]byte("nonexistent")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// 半分のキーをランダムな順序で削除
+	deleted := make(map[int]bool)
+	for _, i := range rng.Perm(n)[:n/2] {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Delete(key); err != nil {
+			t.Fatalf("Failed to delete key %s: %v", key, err)
+		}
+		deleted[i] = true
+	}
+
+	if got := len(checkTree(t, btree)); got != n/2 {
+		t.Errorf("Expected %d keys, got %d", n/2, got)
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		got, err := btree.Search(key)
+		if deleted[i] {
+			if err != ErrKeyNotFound {
+				t.Errorf("Key %s was not deleted properly, got %s, %v", key, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Failed to search key %s: %v", key, err)
+		}
+		if string(got) != fmt.Sprintf("value%05d", i) {
+			t.Errorf("Expected value%05d, got %s", i, got)
+		}
+	}
+
+	// 残りのキーもすべて削除すると、ルートは空の葉に戻る
+	for i := 0; i < n; i++ {
+		if deleted[i] {
+			continue
+		}
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Delete(key); err != nil {
+			t.Fatalf("Failed to delete key %s: %v", key, err)
+		}
+	}
+
+	if got := len(checkTree(t, btree)); got != 0 {
+		t.Errorf("Expected empty tree, got %d keys", got)
+	}
+	rootPage, err := poolManager.FetchPage(btree.rootID)
+	if err != nil {
+		t.Fatalf("Failed to fetch root page: %v", err)
+	}
+	if rootPage.GetNodeType() != page.LeafNodeType {
+		t.Errorf("Expected root page to be a leaf after deleting all keys")
+	}
+	poolManager.UnpinPage(btree.rootID, false)
+	rootID, err := poolManager.RootID()
+	if err != nil {
+		t.Fatalf("Failed to read root ID: %v", err)
+	}
+	if rootID != btree.rootID {
+		t.Errorf("Expected meta root ID %d, got %d", btree.rootID, rootID)
+	}
+
+	// 空になった木に再び挿入できる
+	if err := btree.Insert([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to insert key: %v", err)
+	}
+	if got, err := btree.Search([]byte("key")); err != nil || string(got) != "value" {
+		t.Errorf("Expected value, got %s, %v", got, err)
+	}
+}
+
+func TestBTreePut(t *testing.T) {
+	poolManager, err := pool.NewPoolManager(t.TempDir()+"/dbfile", 100)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+	defer poolManager.Close()
+
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+	expect := func(key string, value string) {
+		t.Helper()
+		if got, err := btree.Search([]byte(key)); err != nil || string(got) != value {
+			t.Errorf("Expected %s for key %s, got %s, %v", value, key, got, err)
+		}
+	}
+
+	// 同じキーを挿入すると値が置き換わり、重複しない
+	if err := btree.Insert([]byte("key"), []byte("first")); err != nil {
+		t.Fatalf("Failed to insert key: %v", err)
+	}
+	if err := btree.Insert([]byte("key"), []byte("second")); err != nil {
+		t.Fatalf("Failed to insert key: %v", err)
+	}
+	if err := btree.Put([]byte("key"), []byte("third")); err != nil {
+		t.Fatalf("Failed to put key: %v", err)
+	}
+	expect("key", "third")
+	if got := len(checkTree(t, btree)); got != 1 {
+		t.Errorf("Expected 1 key, got %d", got)
+	}
+
+	// 条件を満たさない書き込みはエラーになり、値は変わらない
+	if err := btree.InsertNew([]byte("key"), []byte("new")); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	if err := btree.Update([]byte("missing"), []byte("new")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if err := btree.CompareAndSwap([]byte("key"), []byte("second"), []byte("new")); !errors.Is(err, ErrValueMismatch) {
+		t.Errorf("Expected ErrValueMismatch, got %v", err)
+	}
+	if err := btree.CompareAndSwap([]byte("missing"), nil, []byte("new")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	expect("key", "third")
+	if _, err := btree.Search([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// 条件を満たす書き込み
+	if err := btree.InsertNew([]byte("other"), []byte("value")); err != nil {
+		t.Fatalf("Failed to insert new key: %v", err)
+	}
+	if err := btree.Update([]byte("other"), []byte("updated")); err != nil {
+		t.Fatalf("Failed to update key: %v", err)
+	}
+	if err := btree.CompareAndSwap([]byte("key"), []byte("third"), []byte("swapped")); err != nil {
+		t.Fatalf("Failed to compare and swap: %v", err)
+	}
+	expect("other", "updated")
+	expect("key", "swapped")
+
+	// 値の大きさが変わる置き換えを繰り返しても、分割されて木の構造が保たれる
+	n := 1000
+	rng := rand.New(rand.NewSource(3))
+	sizes := []int{1, 100, 900, 3000, 10}
+	for _, size := range sizes {
+		for _, i := range rng.Perm(n) {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			value := bytes.Repeat([]byte{byte(i)}, size)
+			if err := btree.Put(key, value); err != nil {
+				t.Fatalf("Failed to put key %s: %v", key, err)
+			}
+		}
+		if got := len(checkTree(t, btree)); got != n+2 {
+			t.Errorf("Expected %d keys, got %d", n+2, got)
+		}
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			got, err := btree.Search(key)
+			if err != nil || !bytes.Equal(got, bytes.Repeat([]byte{byte(i)}, size)) {
+				t.Fatalf("Unexpected value for key %s (size %d): %v", key, size, err)
+			}
+		}
+	}
+}
+
+func TestBTreePageSize(t *testing.T) {
+	valueOf := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, i%50*100)
+	}
+
+	for _, pageSize := range []int{8192, 16384, 32768} {
+		t.Run(fmt.Sprintf("%d", pageSize), func(t *testing.T) {
+			testFile := t.TempDir() + "/dbfile"
+			poolManager, err := pool.NewPoolManager(testFile, 20, pool.WithPageSize(pageSize))
+			if err != nil {
+				t.Fatalf("Failed to create pool manager: %v", err)
+			}
+			btree, err := NewBTree(poolManager)
+			if err != nil {
+				t.Fatalf("Failed to create BTree: %v", err)
+			}
+
+			// ページサイズに応じて、大きな値はオーバーフローページに格納される
+			n := 2000
+			rng := rand.New(rand.NewSource(5))
+			for _, i := range rng.Perm(n) {
+				key := []byte(fmt.Sprintf("key%05d", i))
+				if err := btree.Insert(key, valueOf(i)); err != nil {
+					t.Fatalf("Failed to insert key %s: %v", key, err)
+				}
+			}
+			for _, i := range rng.Perm(n)[:n/2] {
+				key := []byte(fmt.Sprintf("key%05d", i))
+				if err := btree.Delete(key); err != nil {
+					t.Fatalf("Failed to delete key %s: %v", key, err)
+				}
+			}
+			keys := checkTree(t, btree)
+			if err := poolManager.Close(); err != nil {
+				t.Fatalf("Failed to close pool manager: %v", err)
+			}
+
+			// 再オープン時は、ファイルに記録されたページサイズを使用する
+			poolManager, err = pool.NewPoolManager(testFile, 20)
+			if err != nil {
+				t.Fatalf("Failed to reopen pool manager: %v", err)
+			}
+			defer poolManager.Close()
+			if got := poolManager.PageSize(); got != pageSize {
+				t.Errorf("Expected page size %d, got %d", pageSize, got)
+			}
+			btree, err = OpenBTree(poolManager)
+			if err != nil {
+				t.Fatalf("Failed to open BTree: %v", err)
+			}
+			if got := len(checkTree(t, btree)); got != len(keys) {
+				t.Errorf("Expected %d keys, got %d", len(keys), got)
+			}
+			for _, key := range keys {
+				var i int
+				fmt.Sscanf(string(key), "key%05d", &i)
+				got, err := btree.Search(key)
+				if err != nil {
+					t.Fatalf("Failed to search key %s: %v", key, err)
+				}
+				if !bytes.Equal(got, valueOf(i)) {
+					t.Errorf("Unexpected value for key %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestBTreeSmallPool(t *testing.T) {
+	// 木の高さより少し大きい程度のプールでも、ピンされたページは追い出されない
+	poolManager, err := pool.NewPoolManager(t.TempDir()+"/dbfile", 8)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+	defer poolManager.Close()
+
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+
+	n := 3000
+	rng := rand.New(rand.NewSource(4))
+	for _, i := range rng.Perm(n) {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Insert(key, []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatalf("Failed to insert key %s: %v", key, err)
+		}
+	}
+	for _, i := range rng.Perm(n)[:n/2] {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Delete(key); err != nil {
+			t.Fatalf("Failed to delete key %s: %v", key, err)
+		}
+	}
+
+	if got := len(checkTree(t, btree)); got != n/2 {
+		t.Errorf("Expected %d keys, got %d", n/2, got)
+	}
+
+	cursor, err := btree.Seek(nil)
+	if err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	count := 0
+	for ; cursor.Valid(); cursor.Next() {
+		count++
+	}
+	if count != n/2 {
+		t.Errorf("Expected %d keys, got %d", n/2, count)
+	}
+}
+
+func TestBTreePoolExhausted(t *testing.T) {
+	// 分割に必要なページをピンできないほど小さいプール
+	poolManager, err := pool.NewPoolManager(t.TempDir()+"/dbfile", 2)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+	defer poolManager.Close()
+
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+
+	// ルートの分割が必要になるまで挿入し、エラーで止まることを確認
+	inserted := 0
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		err := btree.Insert(key, []byte(fmt.Sprintf("value%05d", i)))
+		if err != nil {
+			if !errors.Is(err, pool.ErrPoolExhausted) {
+				t.Fatalf("Expected ErrPoolExhausted, got %v", err)
+			}
+			break
+		}
+		inserted++
+	}
+	if inserted == 1000 {
+		t.Fatalf("Expected ErrPoolExhausted, got none")
+	}
+
+	// エラーが起きても、挿入済みのキーはすべて検索できる
+	for i := 0; i < inserted; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		got, err := btree.Search(key)
+		if err != nil {
+			t.Fatalf("Failed to search key %s: %v", key, err)
+		}
+		if string(got) != fmt.Sprintf("value%05d", i) {
+			t.Errorf("Expected value%05d, got %s", i, got)
+		}
+	}
+	if got := len(checkTree(t, btree)); got != inserted {
+		t.Errorf("Expected %d keys, got %d", inserted, got)
+	}
+}
+
+func TestResetPairsPageFull(t *testing.T) {
+	p := page.NewPage()
+	p.ResetPageData()
+	p.SetNodeType(page.LeafNodeType)
+
+	// 1ページに収まらないペアは、パニックせずにエラーを返却する
+	pairs := []*page.Pair{
+		page.NewPair([]byte("a"), make([]byte, 3000)),
+		page.NewPair([]byte("b"), make([]byte, 3000)),
+	}
+	if err := resetPairs(p, pairs); !errors.Is(err, page.ErrPageFull) {
+		t.Fatalf("Expected ErrPageFull, got %v", err)
+	}
+	if err := resetPairs(p, pairs[:1]); err != nil {
+		t.Fatalf("Failed to reset pairs: %v", err)
+	}
+}
+
+func TestBTreeConcurrent(t *testing.T) {
+	poolManager, err := pool.NewPoolManager(t.TempDir()+"/dbfile", 64)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+	defer poolManager.Close()
+
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+
+	// 走査中も削除されないキーを先に挿入しておく
+	stableNum := 300
+	for i := range stableNum {
+		key := []byte(fmt.Sprintf("stable%05d", i))
+		if err := btree.Insert(key, key); err != nil {
+			t.Fatalf("Failed to insert key %s: %v", key, err)
+		}
+	}
+
+	writerNum := 8
+	readerNum := 4
+	n := 400 // 各書き込みゴルーチンが扱うキーの数
+
+	var writers sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, writerNum+readerNum)
+
+	// 書き込み: 自分のキーをすべて挿入し、偶数番目のキーを削除
+	for w := range writerNum {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for _, i := range rng.Perm(n) {
+				key := []byte(fmt.Sprintf("key%02d-%05d", w, i))
+				if err := btree.Insert(key, key); err != nil {
+					errs <- err
+					return
+				}
+			}
+			for _, i := range rng.Perm(n) {
+				if i%2 != 0 {
+					continue
+				}
+				key := []byte(fmt.Sprintf("key%02d-%05d", w, i))
+				if err := btree.Delete(key); err != nil {
+					errs <- fmt.Errorf("delete %s: %w", key, err)
+					return
+				}
+			}
+		}()
+	}
+
+	// 読み込み: 検索と走査を繰り返し、見えた値と順序が正しいことを確認
+	var readers sync.WaitGroup
+	for r := range readerNum {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			rng := rand.New(rand.NewSource(int64(100 + r)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				key := []byte(fmt.Sprintf("key%02d-%05d", rng.Intn(writerNum), rng.Intn(n)))
+				value, err := btree.Search(key)
+				if err != nil && !errors.Is(err, ErrKeyNotFound) {
+					errs <- err
+					return
+				}
+				if err == nil && string(value) != string(key) {
+					errs <- fmt.Errorf("search %s: got %s", key, value)
+					return
+				}
+
+				cursor, err := btree.Seek(nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				var prev []byte
+				stable := 0
+				for ; cursor.Valid(); cursor.Next() {
+					if prev != nil && util.CompareByteSlice(prev, cursor.Key()) != util.Less {
+						errs <- fmt.Errorf("scan out of order: %s after %s", cursor.Key(), prev)
+						return
+					}
+					if string(cursor.Key()[:6]) == "stable" {
+						stable++
+					}
+					prev = cursor.Key()
+				}
+				if cursor.Err() != nil {
+					errs <- cursor.Err()
+					return
+				}
+				if stable != stableNum {
+					errs <- fmt.Errorf("scan saw %d stable keys, expected %d", stable, stableNum)
+					return
+				}
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// 奇数番目のキーだけが残っている
+	keys := checkTree(t, btree)
+	if len(keys) != stableNum+writerNum*n/2 {
+		t.Fatalf("Expected %d keys, got %d", stableNum+writerNum*n/2, len(keys))
+	}
+	for w := range writerNum {
+		for i := range n {
+			key := []byte(fmt.Sprintf("key%02d-%05d", w, i))
+			_, err := btree.Search(key)
+			if i%2 == 0 && !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Expected key %s to be deleted, got %v", key, err)
+			}
+			if i%2 != 0 && err != nil {
+				t.Errorf("Failed to search key %s: %v", key, err)
+			}
+		}
+	}
+}
+
+func TestBTreeReusePages(t *testing.T) {
+	path := t.TempDir() + "/dbfile"
+	poolManager, err := pool.NewPoolManager(path, 100)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+	defer poolManager.Close()
+
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+
+	n := 2000
+	insertAll := func() int64 {
+		for i := range n {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			if err := btree.Insert(key, []byte(fmt.Sprintf("value%05d", i))); err != nil {
+				t.Fatalf("Failed to insert key %s: %v", key, err)
+			}
+		}
+		if err := poolManager.Sync(); err != nil {
+			t.Fatalf("Failed to sync: %v", err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat file: %v", err)
+		}
+		return info.Size()
+	}
+
+	size := insertAll()
+
+	// すべて削除すると、統合で木から外れたページは空きページに戻る
+	for i := range n {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Delete(key); err != nil {
+			t.Fatalf("Failed to delete key %s: %v", key, err)
+		}
+	}
+	if got := len(checkTree(t, btree)); got != 0 {
+		t.Fatalf("Expected empty tree, got %d keys", got)
+	}
+
+	// 再挿入では空きページが再利用されるので、ファイルはほとんど大きくならない
+	if got := insertAll(); got > size+size/10 {
+		t.Errorf("Expected file size about %d, got %d", size, got)
+	}
+	if got := len(checkTree(t, btree)); got != n {
+		t.Errorf("Expected %d keys, got %d", n, got)
+	}
+}
+
+// ファイルを閉じずに異常終了した時点のヒープファイルとログファイルを、別のパスにコピー
+// heapは異常終了した時点のヒープファイルの内容（nilの場合は現在の内容）
+// ログファイルはwalSizeバイトで切り詰め、ログの書き込み途中で中断された状態を再現する
+// heapを読み込んだ後にヒープファイルへの書き込みがあった場合は、その時点のログのサイズ以下で切り詰めること
+func copyCrashed(t *testing.T, path string, heap []byte, crashedPath string, walSize int64) {
+	t.Helper()
+
+	if heap == nil {
+		var err error
+		if heap, err = os.ReadFile(path); err != nil {
+			t.Fatalf("Failed to read heap file: %v", err)
+		}
+	}
+	log, err := os.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if err := os.WriteFile(crashedPath, heap, 0755); err != nil {
+		t.Fatalf("Failed to write heap file: %v", err)
+	}
+	if err := os.WriteFile(crashedPath+".wal", log[:walSize], 0755); err != nil {
+		t.Fatalf("Failed to write log file: %v", err)
+	}
+}
+
+func TestBTreeCrashRecovery(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for round := range 20 {
+		dir := t.TempDir()
+		path := dir + "/dbfile"
+
+		// プールを小さくして、更新されたページが途中でファイルに書き込まれるようにする
+		// このプールマネージャは閉じずに放棄する
+		poolManager, err := pool.NewPoolManager(path, 10)
+		if err != nil {
+			t.Fatalf("Failed to create pool manager: %v", err)
+		}
+		btree, err := NewBTree(poolManager)
+		if err != nil {
+			t.Fatalf("Failed to create BTree: %v", err)
+		}
+
+		// 挿入と削除をランダムに繰り返す
+		model := make(map[string]string)
+		ops := rng.Intn(800)
+		for i := range ops {
+			key := fmt.Sprintf("key%04d", rng.Intn(400))
+			if _, ok := model[key]; ok {
+				if err := btree.Delete([]byte(key)); err != nil {
+					t.Fatalf("Round %d: failed to delete key %s: %v", round, key, err)
+				}
+				delete(model, key)
+				continue
+			}
+			value := fmt.Sprintf("value%04d-%s", i, bytes.Repeat([]byte("x"), rng.Intn(200)))
+			if err := btree.Insert([]byte(key), []byte(value)); err != nil {
+				t.Fatalf("Round %d: failed to insert key %s: %v", round, key, err)
+			}
+			model[key] = value
+		}
+
+		// 分割を伴う挿入（複数ページの更新）のログを書き込んでいる途中で異常終了
+		// 挿入のログはコミットでまとめて書き込まれるので、コミットの直前にヒープファイルを読み込み、
+		// ヒープファイルとログファイルを同じ時点（ログを書き込んでいる途中）の状態にする
+		var walSize, crashedWalSize int64
+		var crashKey, crashValue, heap []byte
+		for i := 0; ; i++ {
+			info, err := os.Stat(path + ".wal")
+			if err != nil {
+				t.Fatalf("Failed to stat log file: %v", err)
+			}
+			walSize = info.Size()
+
+			crashKey = []byte(fmt.Sprintf("crash%04d", i))
+			crashValue = []byte(fmt.Sprintf("value%04d-%s", i, bytes.Repeat([]byte("x"), 200)))
+			tx := Begin(poolManager)
+			if err := tx.Insert(btree, crashKey, crashValue); err != nil {
+				t.Fatalf("Round %d: failed to insert key %s: %v", round, crashKey, err)
+			}
+			if heap, err = os.ReadFile(path); err != nil {
+				t.Fatalf("Failed to read heap file: %v", err)
+			}
+			info, err = os.Stat(path + ".wal")
+			if err != nil {
+				t.Fatalf("Failed to stat log file: %v", err)
+			}
+			if info.Size() != walSize {
+				t.Fatalf("Round %d: log was written before commit", round)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Round %d: failed to commit key %s: %v", round, crashKey, err)
+			}
+			info, err = os.Stat(path + ".wal")
+			if err != nil {
+				t.Fatalf("Failed to stat log file: %v", err)
+			}
+			crashedWalSize = info.Size()
+
+			// 1ページ分のレコードより大きければ、複数ページを更新している
+			if crashedWalSize-walSize > 2*4096+100 {
+				break
+			}
+			model[string(crashKey)] = string(crashValue)
+		}
+		crashedPath := dir + "/crashed"
+		copyCrashed(t, path, heap, crashedPath, walSize+rng.Int63n(crashedWalSize-walSize+1))
+
+		// ログから復旧し、木の構造とコミット済みのキーを検証
+		crashedPoolManager, err := pool.NewPoolManager(crashedPath, 10)
+		if err != nil {
+			t.Fatalf("Round %d: failed to recover: %v", round, err)
+		}
+		crashedBTree, err := OpenBTree(crashedPoolManager)
+		if err != nil {
+			t.Fatalf("Round %d: failed to open BTree: %v", round, err)
+		}
+		keys := checkTree(t, crashedBTree)
+		for key, value := range model {
+			got, err := crashedBTree.Search([]byte(key))
+			if err != nil {
+				t.Fatalf("Round %d: failed to search key %s: %v", round, key, err)
+			}
+			if string(got) != value {
+				t.Fatalf("Round %d: expected %s for key %s, got %s", round, value, key, got)
+			}
+		}
+
+		// 中断された挿入は、すべて反映されているか、まったく反映されていないかのどちらか
+		got, err := crashedBTree.Search(crashKey)
+		switch {
+		case errors.Is(err, ErrKeyNotFound):
+			if len(keys) != len(model) {
+				t.Fatalf("Round %d: expected %d keys, got %d", round, len(model), len(keys))
+			}
+		case err == nil:
+			if !bytes.Equal(got, crashValue) || len(keys) != len(model)+1 {
+				t.Fatalf("Round %d: unexpected crash key %s with %d keys", round, got, len(keys))
+			}
+		default:
+			t.Fatalf("Round %d: failed to search key %s: %v", round, crashKey, err)
+		}
+
+		if err := crashedPoolManager.Close(); err != nil {
+			t.Fatalf("Failed to close pool manager: %v", err)
+		}
+	}
+}
+
+func TestBTreeReadOnly(t *testing.T) {
+	testFile := t.TempDir() + "/dbfile"
+	poolManager, err := pool.NewPoolManager(testFile, 100)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+	n := 1000
+	for i := range n {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Insert(key, []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatalf("Failed to insert key %s: %v", key, err)
+		}
+	}
+	if err := poolManager.Close(); err != nil {
+		t.Fatalf("Failed to close pool manager: %v", err)
+	}
+	before, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+
+	// 読み取り専用で開き、プールより大きい木を走査する
+	poolManager, err = pool.NewPoolManager(testFile, 10, pool.WithReadOnly())
+	if err != nil {
+		t.Fatalf("Failed to open pool manager: %v", err)
+	}
+	if _, err := NewBTree(poolManager); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from NewBTree, got %v", err)
+	}
+	btree, err = OpenBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to open BTree: %v", err)
+	}
+	if got := len(checkTree(t, btree)); got != n {
+		t.Errorf("Expected %d keys, got %d", n, got)
+	}
+	got, err := btree.Search([]byte("key00500"))
+	if err != nil || string(got) != "value00500" {
+		t.Errorf("Expected value00500, got %s (%v)", got, err)
+	}
+
+	// 書き込みはすべてErrReadOnly
+	key := []byte("key00500")
+	writes := map[string]error{
+		"Insert":         btree.Insert([]byte("new"), []byte("value")),
+		"Put":            btree.Put(key, []byte("value")),
+		"InsertNew":      btree.InsertNew([]byte("new"), []byte("value")),
+		"Update":         btree.Update(key, []byte("value")),
+		"CompareAndSwap": btree.CompareAndSwap(key, []byte("value00500"), []byte("value")),
+		"Delete":         btree.Delete(key),
+	}
+	tx := Begin(poolManager)
+	writes["Txn.Put"] = tx.Put(btree, key, []byte("value"))
+	writes["Txn.Delete"] = tx.Delete(btree, key)
+	if err := tx.Commit(); err != nil {
+		t.Errorf("Failed to commit empty txn: %v", err)
+	}
+	for name, err := range writes {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s: expected ErrReadOnly, got %v", name, err)
+		}
+	}
+
+	if err := poolManager.Close(); err != nil {
+		t.Fatalf("Failed to close pool manager: %v", err)
+	}
+	after, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("File was modified by read-only open")
+	}
+}
@@ -0,0 +1,283 @@
+package btree
+
+import (
+	"fmt"
+
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/page"
+	"github.com/yuya-isaka/chibidb/pool"
+	"github.com/yuya-isaka/chibidb/util"
+)
+
+// 葉の連結リストをたどってペアを順に読み出すカーソル
+// カーソルは移動の間だけ葉ページの共有ラッチを取得し、呼び出し元に戻るときには解放する
+// 移動の合間に葉ページが分割・統合されても、現在位置のキーを基準に次のペアを探す
+// プールの4分の1を超える葉ページをたどった後はリングバッファで葉ページを読み込み、大きな走査でプールを汚さない
+type Cursor struct {
+	btree  *BTree
+	pageID disk.PageID // 現在位置の葉ページID（無効な位置の場合は-1）
+	key    []byte      // 現在位置のキー
+	value  []byte      // 現在位置の値
+	start  []byte      // 範囲の下限（含む、nilの場合は制限なし）
+	end    []byte      // 範囲の上限（含まない、nilの場合は制限なし）
+	err    error       // 移動中に発生したエラー
+
+	leaves   int            // 連結リストをたどって移動した葉ページ数
+	strategy *pool.Strategy // 大きな走査で葉ページの読み込みに使うリングバッファ（使い始めるまではnil）
+}
+
+// キー以上の最初のペアに位置するカーソルを返却
+func (b *BTree) Seek(key []byte) (*Cursor, error) {
+	return b.seek(key, nil, nil)
+}
+
+// start以上end未満のペアを走査するカーソルを返却
+// startがnilの場合は先頭から、endがnilの場合は末尾まで走査する
+func (b *BTree) Scan(start []byte, end []byte) (*Cursor, error) {
+	return b.seek(start, start, end)
+}
+
+// prefixで始まるキーのペアを走査するカーソルを返却
+func (b *BTree) Prefix(prefix []byte) (*Cursor, error) {
+	return b.seek(prefix, prefix, prefixEnd(prefix))
+}
+
+func (b *BTree) seek(key []byte, start []byte, end []byte) (*Cursor, error) {
+	leafPage, err := b.findLeaf(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cursor{
+		btree: b,
+		start: start,
+		end:   end,
+	}
+	c.moveForward(leafPage, key, true)
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return c, nil
+}
+
+// カーソルが有効なペアを指しているかを返却
+func (c *Cursor) Valid() bool {
+	return c.pageID != disk.PageID(-1)
+}
+
+// 次のペアに進み、有効なペアを指しているかを返却
+func (c *Cursor) Next() bool {
+	if !c.Valid() {
+		return false
+	}
+	leafPage, err := c.currentLeaf(true)
+	if err != nil {
+		c.invalidate(err)
+		return false
+	}
+	c.moveForward(leafPage, c.key, false)
+	return c.Valid()
+}
+
+// 前のペアに戻り、有効なペアを指しているかを返却
+func (c *Cursor) Prev() bool {
+	if !c.Valid() {
+		return false
+	}
+	leafPage, err := c.currentLeaf(false)
+	if err != nil {
+		c.invalidate(err)
+		return false
+	}
+	c.moveBackward(leafPage, c.key)
+	return c.Valid()
+}
+
+// 現在位置のキーを返却
+func (c *Cursor) Key() []byte {
+	return c.key
+}
+
+// 現在位置の値を返却
+func (c *Cursor) Value() []byte {
+	return c.value
+}
+
+// 移動中に発生したエラーを返却
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// カーソルを閉じる
+func (c *Cursor) Close() error {
+	c.invalidate(nil)
+	return nil
+}
+
+// 現在位置の葉ページを共有ラッチを取得して返却
+// 前回の移動の後に葉ページが統合されて木から外れたり、現在位置のキーより後ろ（forwardがfalseの場合は前）の
+// ペアしか持たなくなった場合は、葉の連結リストをたどっても正しく移動できないのでルートから探し直す
+func (c *Cursor) currentLeaf(forward bool) (*page.Page, error) {
+	leafPage, err := c.fetchLeaf(c.pageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if num := leafPage.GetPointersNum(); leafPage.GetNodeType() == page.LeafNodeType && num > 0 {
+		if forward && util.CompareByteSlice(leafPage.GetKey(0), c.key) != util.Greater {
+			return leafPage, nil
+		}
+		if !forward && util.CompareByteSlice(leafPage.GetKey(num-1), c.key) != util.Less {
+			return leafPage, nil
+		}
+	}
+
+	c.btree.releaseR(leafPage)
+	return c.btree.findLeaf(c.key)
+}
+
+// key以上（inclusiveがfalseの場合はkeyより大きい）の最初のペアに移動する
+// 葉ページにない場合は、見つかるまで次の葉ページに進む
+// 次の葉ページは現在の葉ページのラッチを解放してから取得するので、取得後に隣り合っていることを確認し、
+// 分割・統合で連結リストが変わっていた場合はルートから探し直す
+// leafPageはピンと共有ラッチを取得している必要があり、この関数内で解放される
+func (c *Cursor) moveForward(leafPage *page.Page, key []byte, inclusive bool) {
+	for {
+		idx, found := leafPage.SearchKey(key)
+		if found && !inclusive {
+			idx++
+		}
+		if idx < leafPage.GetPointersNum() {
+			c.load(leafPage, idx)
+			c.btree.releaseR(leafPage)
+			return
+		}
+
+		leafID := leafPage.PageID
+		nextID := leafPage.GetNextID()
+		c.btree.releaseR(leafPage)
+		if nextID == disk.PageID(-1) {
+			c.invalidate(nil)
+			return
+		}
+		c.leaves++
+		nextPage, err := c.fetchLeaf(nextID)
+		if err != nil {
+			c.invalidate(err)
+			return
+		}
+		if nextPage.GetNodeType() == page.LeafNodeType && nextPage.GetPrevID() == leafID {
+			leafPage = nextPage
+			continue
+		}
+
+		c.btree.releaseR(nextPage)
+		if leafPage, err = c.btree.findLeaf(key); err != nil {
+			c.invalidate(err)
+			return
+		}
+	}
+}
+
+// keyより小さい最後のペアに移動する
+// 葉ページにない場合は、見つかるまで前の葉ページに戻る
+// leafPageはピンと共有ラッチを取得している必要があり、この関数内で解放される
+func (c *Cursor) moveBackward(leafPage *page.Page, key []byte) {
+	for {
+		idx, _ := leafPage.SearchKey(key)
+		if idx > 0 {
+			c.load(leafPage, idx-1)
+			c.btree.releaseR(leafPage)
+			return
+		}
+
+		leafID := leafPage.PageID
+		prevID := leafPage.GetPrevID()
+		c.btree.releaseR(leafPage)
+		if prevID == disk.PageID(-1) {
+			c.invalidate(nil)
+			return
+		}
+		c.leaves++
+		prevPage, err := c.fetchLeaf(prevID)
+		if err != nil {
+			c.invalidate(err)
+			return
+		}
+		if prevPage.GetNodeType() == page.LeafNodeType && prevPage.GetNextID() == leafID {
+			leafPage = prevPage
+			continue
+		}
+
+		c.btree.releaseR(prevPage)
+		if leafPage, err = c.btree.findLeaf(key); err != nil {
+			c.invalidate(err)
+			return
+		}
+	}
+}
+
+// 葉ページを取得し、共有ラッチを取得
+// たどった葉ページがプールのフレーム数の4分の1を超えたら、以降はリングバッファを使って読み込む
+func (c *Cursor) fetchLeaf(pageID disk.PageID) (*page.Page, error) {
+	poolManager := c.btree.poolManager
+	if c.strategy == nil {
+		if uint(c.leaves) <= poolManager.Size()/4 {
+			return c.btree.fetchRLatched(pageID)
+		}
+		c.strategy = poolManager.NewRingStrategy()
+	}
+
+	p, err := poolManager.FetchPageWithStrategy(pageID, c.strategy)
+	if err != nil {
+		return nil, fmt.Errorf("fetch page %d: %w", pageID, err)
+	}
+	p.RLatch()
+	return p, nil
+}
+
+// idx番目のペアを読み込み、範囲外であればカーソルを無効にする
+func (c *Cursor) load(leafPage *page.Page, idx uint16) {
+	pair := leafPage.GetPair(idx)
+	if c.start != nil && util.CompareByteSlice(pair.Key, c.start) == util.Less {
+		c.invalidate(nil)
+		return
+	}
+	if c.end != nil && util.CompareByteSlice(pair.Key, c.end) != util.Less {
+		c.invalidate(nil)
+		return
+	}
+	// ページデータは後で書き換わる可能性があるのでコピーしておく
+	value, err := c.btree.loadValue(pair.Value)
+	if err != nil {
+		c.invalidate(err)
+		return
+	}
+	c.pageID = leafPage.PageID
+	c.key = append([]byte(nil), pair.Key...)
+	c.value = value
+}
+
+// カーソルを無効な位置にする
+func (c *Cursor) invalidate(err error) {
+	c.pageID = disk.PageID(-1)
+	c.key = nil
+	c.value = nil
+	if err != nil {
+		c.err = err
+	}
+}
+
+// prefixで始まるすべてのキーより大きい最小のキーを返却
+// prefixがすべて0xffの場合は上限がないのでnilを返却
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
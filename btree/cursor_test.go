@@ -0,0 +1,221 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/pool"
+	"github.com/yuya-isaka/chibidb/wal"
+)
+
+// 0からn-1までのキーをランダムな順序で挿入したBTreeを作成
+func newTestBTree(t *testing.T, n int) *BTree {
+	t.Helper()
+
+	// ファイルを使わずにメモリ上に作成
+	storage, err := disk.NewMemoryStorage(disk.DefaultPageSize)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	log, err := wal.OpenMemory()
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	poolManager, err := pool.NewPoolManagerWithStorage(storage, log, 100)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+	t.Cleanup(func() { poolManager.Close() })
+
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+	for _, i := range rand.New(rand.NewSource(3)).Perm(n) {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := btree.Insert(key, []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatalf("Failed to insert key %s: %v", key, err)
+		}
+	}
+	return btree
+}
+
+func TestCursor(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+	n := 1000
+	btree := newTestBTree(t, n)
+
+	t.Run("Forward and Backward", func(t *testing.T) {
+		cursor, err := btree.Seek(nil)
+		assert.NoError(err)
+		defer cursor.Close()
+
+		// 先頭から末尾まで順に走査
+		i := 0
+		for ; cursor.Valid(); cursor.Next() {
+			assert.Equal(fmt.Sprintf("key%05d", i), string(cursor.Key()))
+			assert.Equal(fmt.Sprintf("value%05d", i), string(cursor.Value()))
+			i++
+		}
+		assert.NoError(cursor.Err())
+		assert.Equal(n, i)
+
+		// 末尾から先頭まで逆順に走査
+		cursor, err = btree.Seek([]byte(fmt.Sprintf("key%05d", n-1)))
+		assert.NoError(err)
+		i = n - 1
+		for ; cursor.Valid(); cursor.Prev() {
+			assert.Equal(fmt.Sprintf("key%05d", i), string(cursor.Key()))
+			i--
+		}
+		assert.NoError(cursor.Err())
+		assert.Equal(-1, i)
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		// 存在するキー
+		cursor, err := btree.Seek([]byte("key00500"))
+		assert.NoError(err)
+		assert.True(cursor.Valid())
+		assert.Equal("key00500", string(cursor.Key()))
+
+		// 存在しないキーの場合は、次に大きいキー
+		cursor, err = btree.Seek([]byte("key00500a"))
+		assert.NoError(err)
+		assert.True(cursor.Valid())
+		assert.Equal("key00501", string(cursor.Key()))
+		assert.True(cursor.Prev())
+		assert.Equal("key00500", string(cursor.Key()))
+
+		// すべてのキーより大きい場合は無効
+		cursor, err = btree.Seek([]byte("zzz"))
+		assert.NoError(err)
+		assert.False(cursor.Valid())
+		assert.False(cursor.Next())
+		assert.Nil(cursor.Key())
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		cursor, err := btree.Scan([]byte("key00100"), []byte("key00200"))
+		assert.NoError(err)
+		defer cursor.Close()
+
+		var keys []string
+		for ; cursor.Valid(); cursor.Next() {
+			keys = append(keys, string(cursor.Key()))
+		}
+		assert.Len(keys, 100)
+		assert.Equal("key00100", keys[0])
+		assert.Equal("key00199", keys[len(keys)-1])
+
+		// 下限より前には戻らない
+		cursor, err = btree.Scan([]byte("key00100"), []byte("key00200"))
+		assert.NoError(err)
+		assert.False(cursor.Prev())
+	})
+
+	t.Run("Prefix", func(t *testing.T) {
+		cursor, err := btree.Prefix([]byte("key004"))
+		assert.NoError(err)
+		defer cursor.Close()
+
+		count := 0
+		for ; cursor.Valid(); cursor.Next() {
+			assert.Equal(fmt.Sprintf("key%05d", 400+count), string(cursor.Key()))
+			count++
+		}
+		assert.Equal(100, count)
+
+		cursor, err = btree.Prefix([]byte("nonexistent"))
+		assert.NoError(err)
+		assert.False(cursor.Valid())
+	})
+
+	t.Run("After Delete", func(t *testing.T) {
+		// 葉の統合が起きるように偶数のキーを削除
+		for i := 0; i < n; i += 2 {
+			assert.NoError(btree.Delete([]byte(fmt.Sprintf("key%05d", i))))
+		}
+
+		cursor, err := btree.Seek(nil)
+		assert.NoError(err)
+		defer cursor.Close()
+
+		i := 1
+		for ; cursor.Valid(); cursor.Next() {
+			assert.Equal(fmt.Sprintf("key%05d", i), string(cursor.Key()))
+			i += 2
+		}
+		assert.Equal(n+1, i)
+	})
+}
+
+func TestCursorRingStrategy(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+	poolManager, err := pool.NewPoolManager(t.TempDir()+"/dbfile", 20)
+	assert.NoError(err)
+	defer poolManager.Close()
+	btree, err := NewBTree(poolManager)
+	assert.NoError(err)
+
+	// 葉ページがプールより多くなるよう、大きめの値を挿入
+	n := 2000
+	value := make([]byte, 200)
+	for _, i := range rand.New(rand.NewSource(3)).Perm(n) {
+		assert.NoError(btree.Insert([]byte(fmt.Sprintf("key%05d", i)), value))
+	}
+
+	t.Run("Large Range", func(t *testing.T) {
+		cursor, err := btree.Scan(nil, nil)
+		assert.NoError(err)
+		defer cursor.Close()
+
+		// 多くの葉ページをたどるとリングバッファに切り替わり、すべてのペアを読み出せる
+		i := 0
+		for ; cursor.Valid(); cursor.Next() {
+			assert.Equal(fmt.Sprintf("key%05d", i), string(cursor.Key()))
+			i++
+		}
+		assert.NoError(cursor.Err())
+		assert.Equal(n, i)
+		assert.NotNil(cursor.strategy)
+
+		// 逆順でも読み出せる
+		cursor, err = btree.Seek([]byte(fmt.Sprintf("key%05d", n-1)))
+		assert.NoError(err)
+		for i = n - 1; cursor.Valid(); cursor.Prev() {
+			assert.Equal(fmt.Sprintf("key%05d", i), string(cursor.Key()))
+			i--
+		}
+		assert.NoError(cursor.Err())
+		assert.Equal(-1, i)
+		assert.NotNil(cursor.strategy)
+	})
+
+	t.Run("Small Range", func(t *testing.T) {
+		cursor, err := btree.Scan([]byte("key00100"), []byte("key00110"))
+		assert.NoError(err)
+		defer cursor.Close()
+
+		// 少数の葉ページしかたどらなければ、通常どおりプールを使う
+		i := 100
+		for ; cursor.Valid(); cursor.Next() {
+			assert.Equal(fmt.Sprintf("key%05d", i), string(cursor.Key()))
+			i++
+		}
+		assert.Equal(110, i)
+		assert.Nil(cursor.strategy)
+	})
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("abd"), prefixEnd([]byte("abc")))
+	assert.Equal(t, []byte("ac"), prefixEnd([]byte{'a', 'b', 0xff}))
+	assert.Nil(t, prefixEnd([]byte{0xff, 0xff}))
+	assert.Nil(t, prefixEnd(nil))
+}
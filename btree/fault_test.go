@@ -0,0 +1,300 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/pool"
+	"github.com/yuya-isaka/chibidb/wal"
+)
+
+// 障害を注入する記憶領域とログファイルでBTreeを作成
+// プールを小さくして、更新されたページが途中で記憶領域に書き込まれるようにする
+func newFaultBTree(t *testing.T) (*disk.FaultStorage, *wal.FaultFile, *pool.PoolManager, *BTree) {
+	t.Helper()
+
+	storage, err := disk.NewFaultStorage(disk.DefaultPageSize)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	logFile := wal.NewFaultFile()
+	log, err := wal.OpenFault(logFile)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	poolManager, err := pool.NewPoolManagerWithStorage(storage, log, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pool manager: %v", err)
+	}
+	btree, err := NewBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to create BTree: %v", err)
+	}
+	return storage, logFile, poolManager, btree
+}
+
+// 同じ記憶領域とログファイルからBTreeを開き直す（ログに残っている更新は復旧される）
+func reopenFaultBTree(t *testing.T, storage *disk.FaultStorage, logFile *wal.FaultFile) (*pool.PoolManager, *BTree) {
+	t.Helper()
+
+	log, err := wal.OpenFault(logFile)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	poolManager, err := pool.NewPoolManagerWithStorage(storage, log, 10)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	btree, err := OpenBTree(poolManager)
+	if err != nil {
+		t.Fatalf("Failed to open BTree: %v", err)
+	}
+	return poolManager, btree
+}
+
+// 木の構造を検証し、キーと値がmodelと一致するか確認
+// uncertainのキーは、操作が反映されていてもいなくてもよい
+func checkModel(t *testing.T, btree *BTree, model map[string]string, uncertain map[string]string) {
+	t.Helper()
+
+	pairs := dumpTree(t, btree)
+	for key, value := range model {
+		if _, ok := uncertain[key]; ok {
+			continue
+		}
+		if got, ok := pairs[key]; !ok || got != value {
+			t.Fatalf("Key %s: expected %q, got %q (found %v)", key, value, got, ok)
+		}
+	}
+	for key, value := range pairs {
+		if _, ok := model[key]; ok {
+			continue
+		}
+		if want, ok := uncertain[key]; !ok || want != value {
+			t.Fatalf("Unexpected key %s with value %q", key, value)
+		}
+	}
+}
+
+// 挿入と削除をランダムに行い、成功した操作をmodelに反映
+// 操作が失敗した場合は、そのキーとエラーを返却して中断する
+func randomOps(btree *BTree, rng *rand.Rand, model map[string]string, ops int) (string, string, error) {
+	for i := range ops {
+		key := fmt.Sprintf("key%04d", rng.Intn(300))
+		if _, ok := model[key]; ok && rng.Intn(3) == 0 {
+			if err := btree.Delete([]byte(key)); err != nil {
+				return key, "", err
+			}
+			delete(model, key)
+			continue
+		}
+		value := fmt.Sprintf("value%04d-%s", i, bytes.Repeat([]byte("x"), rng.Intn(200)))
+		if err := btree.Put([]byte(key), []byte(value)); err != nil {
+			return key, value, err
+		}
+		model[key] = value
+	}
+	return "", "", nil
+}
+
+func TestBTreeIOError(t *testing.T) {
+	faults := []struct {
+		name   string
+		inject func(storage *disk.FaultStorage, n int)
+	}{
+		{"Read", func(storage *disk.FaultStorage, n int) { storage.FailRead(n) }},
+		{"Write", func(storage *disk.FaultStorage, n int) { storage.FailWrite(n) }},
+		{"Short Write", func(storage *disk.FaultStorage, n int) { storage.ShortWrite(n, 100) }},
+	}
+
+	for _, fault := range faults {
+		t.Run(fault.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			for round := range 10 {
+				storage, logFile, poolManager, btree := newFaultBTree(t)
+				model := make(map[string]string)
+				if _, _, err := randomOps(btree, rng, model, 200); err != nil {
+					t.Fatalf("Round %d: unexpected error: %v", round, err)
+				}
+
+				// 失敗した操作は取り消され、それ以外の操作は続けられる
+				fault.inject(storage, 1+rng.Intn(20))
+				failed := 0
+				for range 5 {
+					key, _, err := randomOps(btree, rng, model, 100)
+					if err == nil {
+						continue
+					}
+					if !errors.Is(err, disk.ErrInjectedFault) {
+						t.Fatalf("Round %d: expected injected fault for key %s, got %v", round, key, err)
+					}
+					failed++
+				}
+				if failed == 0 {
+					t.Fatalf("Round %d: injected fault did not occur", round)
+				}
+				checkModel(t, btree, model, nil)
+
+				// 閉じて開き直しても、成功した操作だけが反映されている
+				if err := poolManager.Close(); err != nil {
+					t.Fatalf("Round %d: failed to close: %v", round, err)
+				}
+				poolManager, btree = reopenFaultBTree(t, storage, logFile)
+				checkModel(t, btree, model, nil)
+				if err := poolManager.Close(); err != nil {
+					t.Fatalf("Round %d: failed to close: %v", round, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBTreePowerLoss(t *testing.T) {
+	t.Run("Drop Unsynced Writes", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(2))
+		for round := range 20 {
+			storage, logFile, poolManager, btree := newFaultBTree(t)
+
+			// 途中でチェックポイントを挟みながら操作し、Syncしていない書き込みを失う
+			model := make(map[string]string)
+			for range rng.Intn(4) {
+				if _, _, err := randomOps(btree, rng, model, rng.Intn(300)); err != nil {
+					t.Fatalf("Round %d: unexpected error: %v", round, err)
+				}
+				if err := poolManager.Sync(); err != nil {
+					t.Fatalf("Round %d: failed to sync: %v", round, err)
+				}
+			}
+			if _, _, err := randomOps(btree, rng, model, rng.Intn(300)); err != nil {
+				t.Fatalf("Round %d: unexpected error: %v", round, err)
+			}
+			storage.Crash()
+			logFile.Crash()
+
+			// コミットした操作はログから復旧される
+			poolManager, btree = reopenFaultBTree(t, storage, logFile)
+			checkModel(t, btree, model, nil)
+			if err := poolManager.Close(); err != nil {
+				t.Fatalf("Round %d: failed to close: %v", round, err)
+			}
+		}
+	})
+
+	t.Run("Crash After Checkpoint", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(6))
+		for round := range 20 {
+			storage, logFile, poolManager, btree := newFaultBTree(t)
+
+			// チェックポイントの直後に電源断を起こし、Syncしていない書き込みを失う
+			model := make(map[string]string)
+			if _, _, err := randomOps(btree, rng, model, 1+rng.Intn(300)); err != nil {
+				t.Fatalf("Round %d: unexpected error: %v", round, err)
+			}
+			if err := poolManager.Sync(); err != nil {
+				t.Fatalf("Round %d: failed to sync: %v", round, err)
+			}
+			storage.Crash()
+			logFile.Crash()
+
+			// 開き直してからコミットした操作も、もう一度電源断が起きた後にログから復旧される
+			poolManager, btree = reopenFaultBTree(t, storage, logFile)
+			checkModel(t, btree, model, nil)
+			if _, _, err := randomOps(btree, rng, model, 1+rng.Intn(300)); err != nil {
+				t.Fatalf("Round %d: unexpected error: %v", round, err)
+			}
+			storage.Crash()
+			logFile.Crash()
+
+			poolManager, btree = reopenFaultBTree(t, storage, logFile)
+			checkModel(t, btree, model, nil)
+			if err := poolManager.Close(); err != nil {
+				t.Fatalf("Round %d: failed to close: %v", round, err)
+			}
+		}
+	})
+
+	t.Run("Torn Page", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(3))
+		for round := range 20 {
+			storage, logFile, poolManager, btree := newFaultBTree(t)
+			model := make(map[string]string)
+			if _, _, err := randomOps(btree, rng, model, 200); err != nil {
+				t.Fatalf("Round %d: unexpected error: %v", round, err)
+			}
+
+			// ページの書き込み途中で電源断が起きる（チェックポイント中の場合もある）
+			storage.TearWrite(1+rng.Intn(30), rng.Intn(disk.DefaultPageSize))
+			var key, value string
+			var err error
+			for err == nil {
+				key, value, err = randomOps(btree, rng, model, 50)
+				if err == nil && rng.Intn(4) == 0 {
+					err = poolManager.Sync()
+					key = ""
+				}
+			}
+			if !errors.Is(err, disk.ErrPowerLoss) {
+				t.Fatalf("Round %d: expected power loss, got %v", round, err)
+			}
+			storage.Crash()
+			logFile.Crash()
+
+			// 電源断で中断した操作は、反映されていてもいなくてもよい
+			uncertain := make(map[string]string)
+			if key != "" {
+				uncertain[key] = value
+			}
+			poolManager, btree = reopenFaultBTree(t, storage, logFile)
+			checkModel(t, btree, model, uncertain)
+			if err := poolManager.Close(); err != nil {
+				t.Fatalf("Round %d: failed to close: %v", round, err)
+			}
+		}
+	})
+	// ログの書き込みが途中で中断される（コミットのほか、ページを書き出す前の同期の場合もある）
+	logFaults := []struct {
+		name   string
+		inject func(logFile *wal.FaultFile, n int, size int)
+		err    error
+	}{
+		{"Torn Log Write", func(logFile *wal.FaultFile, n int, size int) { logFile.TearWrite(n, size) }, disk.ErrPowerLoss},
+		{"Short Log Write", func(logFile *wal.FaultFile, n int, size int) { logFile.ShortWrite(n, size) }, disk.ErrInjectedFault},
+	}
+	for i, fault := range logFaults {
+		t.Run(fault.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(int64(4 + i)))
+			for round := range 20 {
+				storage, logFile, poolManager, btree := newFaultBTree(t)
+				model := make(map[string]string)
+				if _, _, err := randomOps(btree, rng, model, 200); err != nil {
+					t.Fatalf("Round %d: unexpected error: %v", round, err)
+				}
+
+				// 1つのコミットで書き込むレコードは、1ページ分のレコードより大きいことがある
+				fault.inject(logFile, 1+rng.Intn(30), rng.Intn(3*disk.DefaultPageSize))
+				var key, value string
+				var err error
+				for err == nil {
+					key, value, err = randomOps(btree, rng, model, 50)
+				}
+				if !errors.Is(err, fault.err) {
+					t.Fatalf("Round %d: expected %v, got %v", round, fault.err, err)
+				}
+				storage.Crash()
+				logFile.Crash()
+
+				// 中断した操作は、反映されていてもいなくてもよい
+				// それより前にコミットした操作は、書き込み途中のレコードを切り捨てて復旧される
+				poolManager, btree = reopenFaultBTree(t, storage, logFile)
+				checkModel(t, btree, model, map[string]string{key: value})
+				if err := poolManager.Close(); err != nil {
+					t.Fatalf("Round %d: failed to close: %v", round, err)
+				}
+			}
+		})
+	}
+}
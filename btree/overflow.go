@@ -0,0 +1,156 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/page"
+	"github.com/yuya-isaka/chibidb/pool"
+)
+
+// 葉ノードの値の先頭1バイトは、値の格納方法を示す
+// inlineValue:   [1byte][値]
+// overflowValue: [1byte][値の長さ 8byte][先頭のオーバーフローページID 8byte]
+// オーバーフローページは連結リストで、次のページIDをページヘッダに、値の一部をボディに格納する
+const (
+	inlineValue   byte = 0
+	overflowValue byte = 1
+
+	overflowStubSize = 1 + 8 + 8
+)
+
+var ErrKeyTooLarge = errors.New("key too large")
+
+// ペアのサイズがこれを超える場合、値をオーバーフローページに格納する
+// 分割後のページには必ず収まり、1ページに複数のペアが入るようにする
+func (b *BTree) maxInlinePairSize() int {
+	return int(page.MaxPairSize(b.poolManager.PageSize())) / 4
+}
+
+// 葉ノードに格納する値を作成する関数
+// 値が大きい場合はオーバーフローページに書き込み、作成したページIDも返却する
+// オーバーフローページは1ページずつ書き込んでログに記録し、ラッチを解放する（大きな値でもプールを使い切らないように）
+// 呼び出し時点で、トランザクションに登録されたページがないこと
+func (b *BTree) storeValue(tx *pool.Txn, key []byte, value []byte) ([]byte, []disk.PageID, error) {
+	if 2+len(key)+1+len(value) <= b.maxInlinePairSize() {
+		return append([]byte{inlineValue}, value...), nil, nil
+	}
+	if 2+len(key)+overflowStubSize > b.maxInlinePairSize() {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, len(key))
+	}
+
+	// 後ろの断片から書き込み、各ページに次のページIDを設定する
+	bodySize := len(page.NewPageWithSize(b.poolManager.PageSize()).GetBody())
+	var pageIDs []disk.PageID
+	nextID := disk.PageID(-1)
+	for end := len(value); end > 0; {
+		start := (end - 1) / bodySize * bodySize
+		overflowPage, err := b.createWLatched(tx)
+		if err != nil {
+			b.freeValue(tx, pageIDs)
+			return nil, nil, err
+		}
+		overflowPage.SetNodeType(page.OverflowType)
+		overflowPage.SetNextID(nextID)
+		body := make([]byte, bodySize)
+		copy(body, value[start:end])
+		if err := overflowPage.SetBody(body); err != nil {
+			b.freeValue(tx, pageIDs)
+			return nil, nil, err
+		}
+		tx.Apply()
+
+		nextID = overflowPage.PageID
+		pageIDs = append(pageIDs, nextID)
+		end = start
+	}
+
+	stub := make([]byte, 0, overflowStubSize)
+	stub = append(stub, overflowValue)
+	stub = binary.LittleEndian.AppendUint64(stub, uint64(len(value)))
+	stub = binary.LittleEndian.AppendUint64(stub, uint64(nextID))
+	return stub, pageIDs, nil
+}
+
+// 葉ノードに格納された値から、元の値を組み立てて返却する関数
+// オーバーフローページが解放されないよう、値を格納している葉ページのラッチを保持した状態で呼び出すこと
+func (b *BTree) loadValue(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("invalid value: empty")
+	}
+	if stored[0] == inlineValue {
+		return append([]byte{}, stored[1:]...), nil
+	}
+
+	size, pageID, err := decodeStub(stored)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 0, size)
+	err = b.walkOverflow(pageID, func(overflowPage *page.Page) {
+		n := min(size-len(value), len(overflowPage.GetBody()))
+		value = append(value, overflowPage.GetBody()[:n]...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(value) != size {
+		return nil, fmt.Errorf("invalid overflow chain: expected %d bytes, got %d", size, len(value))
+	}
+	return value, nil
+}
+
+// 葉ノードに格納された値が使用しているオーバーフローページIDを返却する関数
+// 値を格納している葉ページのラッチを保持した状態で呼び出すこと
+func (b *BTree) overflowPages(stored []byte) ([]disk.PageID, error) {
+	if len(stored) == 0 || stored[0] == inlineValue {
+		return nil, nil
+	}
+
+	_, pageID, err := decodeStub(stored)
+	if err != nil {
+		return nil, err
+	}
+	var pageIDs []disk.PageID
+	err = b.walkOverflow(pageID, func(overflowPage *page.Page) {
+		pageIDs = append(pageIDs, overflowPage.PageID)
+	})
+	return pageIDs, err
+}
+
+// コミット後にオーバーフローページを空きページに戻すよう登録
+func (b *BTree) freeValue(tx *pool.Txn, pageIDs []disk.PageID) {
+	for _, pageID := range pageIDs {
+		tx.Free(pageID)
+	}
+}
+
+// オーバーフローページの連結リストを先頭から順にたどる関数
+// 各ページは共有ラッチを取得した状態でfnに渡す
+func (b *BTree) walkOverflow(pageID disk.PageID, fn func(overflowPage *page.Page)) error {
+	for pageID != disk.PageID(-1) {
+		overflowPage, err := b.fetchRLatched(pageID)
+		if err != nil {
+			return err
+		}
+		if overflowPage.GetNodeType() != page.OverflowType {
+			b.releaseR(overflowPage)
+			return fmt.Errorf("invalid overflow page: %d", pageID)
+		}
+		fn(overflowPage)
+		pageID = overflowPage.GetNextID()
+		b.releaseR(overflowPage)
+	}
+	return nil
+}
+
+func decodeStub(stored []byte) (int, disk.PageID, error) {
+	if stored[0] != overflowValue || len(stored) != overflowStubSize {
+		return 0, disk.PageID(-1), fmt.Errorf("invalid value: unknown format")
+	}
+	size := binary.LittleEndian.Uint64(stored[1:9])
+	pageID := disk.PageID(binary.LittleEndian.Uint64(stored[9:17]))
+	return int(size), pageID, nil
+}
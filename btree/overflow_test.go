@@ -0,0 +1,177 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/page"
+	"github.com/yuya-isaka/chibidb/pool"
+)
+
+func TestOverflow(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	// インラインに収まる境界付近の値（キーは8バイト）と、複数ページにまたがる値
+	maxInlinePairSize := int(page.MaxPairSize(disk.DefaultPageSize)) / 4
+	bodySize := len(page.NewPage().GetBody())
+	sizes := []int{0, 1, maxInlinePairSize - 11, maxInlinePairSize - 10, 4096, bodySize*3 - 1, bodySize * 3, 100000}
+	valueOf := func(i int, size int) []byte {
+		value := make([]byte, size)
+		for j := range value {
+			value[j] = byte(i + j)
+		}
+		return value
+	}
+
+	t.Run("Insert Search Scan", func(t *testing.T) {
+		path := t.TempDir() + "/dbfile"
+		// 最大の値より小さいプールでも格納できる
+		poolManager, err := pool.NewPoolManager(path, 10)
+		assert.NoError(err)
+		btree, err := NewBTree(poolManager)
+		assert.NoError(err)
+
+		for i, size := range sizes {
+			assert.NoError(btree.Insert([]byte(fmt.Sprintf("key%05d", i)), valueOf(i, size)))
+		}
+		check := func(btree *BTree) {
+			for i, size := range sizes {
+				value, err := btree.Search([]byte(fmt.Sprintf("key%05d", i)))
+				assert.NoError(err)
+				assert.True(bytes.Equal(valueOf(i, size), value), "size %d", size)
+			}
+
+			cursor, err := btree.Scan(nil, nil)
+			assert.NoError(err)
+			for i, size := range sizes {
+				assert.True(cursor.Valid())
+				assert.Equal([]byte(fmt.Sprintf("key%05d", i)), cursor.Key())
+				assert.True(bytes.Equal(valueOf(i, size), cursor.Value()), "size %d", size)
+				cursor.Next()
+			}
+			assert.False(cursor.Valid())
+			assert.NoError(cursor.Err())
+			checkTree(t, btree)
+		}
+		check(btree)
+
+		// 再オープン後も読み出せる
+		assert.NoError(poolManager.Close())
+		poolManager, err = pool.NewPoolManager(path, 10)
+		assert.NoError(err)
+		defer poolManager.Close()
+		btree, err = OpenBTree(poolManager)
+		assert.NoError(err)
+		check(btree)
+	})
+
+	t.Run("Free On Delete", func(t *testing.T) {
+		path := t.TempDir() + "/dbfile"
+		poolManager, err := pool.NewPoolManager(path, 10)
+		assert.NoError(err)
+		defer poolManager.Close()
+		btree, err := NewBTree(poolManager)
+		assert.NoError(err)
+
+		insertAll := func() int64 {
+			for i := range 20 {
+				assert.NoError(btree.Insert([]byte(fmt.Sprintf("key%05d", i)), valueOf(i, 20000)))
+			}
+			assert.NoError(poolManager.Sync())
+			info, err := os.Stat(path)
+			assert.NoError(err)
+			return info.Size()
+		}
+		size := insertAll()
+
+		// 削除するとオーバーフローページは空きページに戻り、再挿入で再利用される
+		for i := range 20 {
+			assert.NoError(btree.Delete([]byte(fmt.Sprintf("key%05d", i))))
+		}
+		assert.Equal(size, insertAll())
+	})
+
+	t.Run("Free On Replace", func(t *testing.T) {
+		path := t.TempDir() + "/dbfile"
+		poolManager, err := pool.NewPoolManager(path, 10)
+		assert.NoError(err)
+		defer poolManager.Close()
+		btree, err := NewBTree(poolManager)
+		assert.NoError(err)
+
+		putAll := func(i int) int64 {
+			assert.NoError(btree.Put([]byte("key"), valueOf(i, 20000)))
+			assert.NoError(poolManager.Sync())
+			info, err := os.Stat(path)
+			assert.NoError(err)
+			return info.Size()
+		}
+		putAll(0)
+		size := putAll(1)
+
+		// 置き換え前の値のオーバーフローページは空きページに戻り、次の置き換えで再利用される
+		for i := 2; i < 10; i++ {
+			assert.Equal(size, putAll(i))
+		}
+		value, err := btree.Search([]byte("key"))
+		assert.NoError(err)
+		assert.True(bytes.Equal(valueOf(9, 20000), value))
+
+		// 比較する値もオーバーフローページから組み立てる
+		assert.ErrorIs(btree.CompareAndSwap([]byte("key"), valueOf(8, 20000), nil), ErrValueMismatch)
+		assert.NoError(btree.CompareAndSwap([]byte("key"), valueOf(9, 20000), []byte("small")))
+		value, err = btree.Search([]byte("key"))
+		assert.NoError(err)
+		assert.Equal([]byte("small"), value)
+		assert.Equal(size, putAll(10))
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		path := t.TempDir() + "/dbfile"
+		poolManager, err := pool.NewPoolManager(path, 10)
+		assert.NoError(err)
+		defer poolManager.Close()
+		btree, err := NewBTree(poolManager)
+		assert.NoError(err)
+		assert.NoError(btree.Insert([]byte("key"), valueOf(0, 20000)))
+
+		// ロールバックすると、削除した値は元に戻り、挿入した値のオーバーフローページは解放される
+		tx := Begin(poolManager)
+		assert.NoError(tx.Delete(btree, []byte("key")))
+		assert.NoError(tx.Insert(btree, []byte("other"), valueOf(1, 20000)))
+		assert.NoError(tx.Rollback())
+
+		value, err := btree.Search([]byte("key"))
+		assert.NoError(err)
+		assert.True(bytes.Equal(valueOf(0, 20000), value))
+		_, err = btree.Search([]byte("other"))
+		assert.ErrorIs(err, ErrKeyNotFound)
+
+		assert.NoError(poolManager.Sync())
+		info, err := os.Stat(path)
+		assert.NoError(err)
+		assert.NoError(btree.Insert([]byte("other"), valueOf(1, 20000)))
+		assert.NoError(poolManager.Sync())
+		reused, err := os.Stat(path)
+		assert.NoError(err)
+		assert.Equal(info.Size(), reused.Size())
+	})
+
+	t.Run("Key Too Large", func(t *testing.T) {
+		poolManager, err := pool.NewPoolManager(t.TempDir()+"/dbfile", 10)
+		assert.NoError(err)
+		defer poolManager.Close()
+		btree, err := NewBTree(poolManager)
+		assert.NoError(err)
+
+		// キーはオーバーフローページに格納できない
+		assert.ErrorIs(btree.Insert(make([]byte, btree.maxInlinePairSize()), nil), ErrKeyTooLarge)
+		assert.ErrorIs(btree.Insert(make([]byte, 4096), []byte("value")), ErrKeyTooLarge)
+		assert.Equal(0, len(checkTree(t, btree)))
+	})
+}
@@ -0,0 +1,118 @@
+package btree
+
+import (
+	"errors"
+
+	"github.com/yuya-isaka/chibidb/pool"
+)
+
+var (
+	ErrTxnDone      = errors.New("transaction already finished")
+	ErrPoolMismatch = errors.New("btree belongs to another pool manager")
+)
+
+// 同じプールマネージャ上の1つ以上のBTreeへの書き込み・削除を、まとめて不可分に反映するトランザクション
+// ロールバックではページをトランザクション開始前のイメージに戻すので、終了するまで同じプールマネージャの他の更新
+// （トランザクション外のInsert・Deleteを含む）は待たされる
+// コミット前の更新は、SearchやCursorから見える
+// トランザクションを開始したゴルーチンは、終了前にトランザクション外のInsert・Delete、Sync、Closeを呼び出さないこと
+type Txn struct {
+	poolManager *pool.PoolManager
+	tx          *pool.Txn
+	done        bool
+}
+
+// トランザクションを開始
+func Begin(poolManager *pool.PoolManager) *Txn {
+	return &Txn{
+		poolManager: poolManager,
+		tx:          poolManager.BeginExclusive(),
+	}
+}
+
+// トランザクション内でキーと値を挿入する関数
+// キーが既に存在する場合は値を置き換える（Putと同じ）
+// 途中でエラーが起きた場合、この挿入の更新だけが取り消され、トランザクションは続けて使用できる
+func (t *Txn) Insert(b *BTree, key []byte, value []byte) error {
+	return t.Put(b, key, value)
+}
+
+// トランザクション内でキーと値を書き込む関数（BTree.Putを参照）
+func (t *Txn) Put(b *BTree, key []byte, value []byte) error {
+	return t.put(b, key, value, nil)
+}
+
+// トランザクション内で、キーが存在しない場合だけキーと値を挿入する関数（BTree.InsertNewを参照）
+func (t *Txn) InsertNew(b *BTree, key []byte, value []byte) error {
+	return t.put(b, key, value, mustNotExist)
+}
+
+// トランザクション内で、キーが存在する場合だけ値を置き換える関数（BTree.Updateを参照）
+func (t *Txn) Update(b *BTree, key []byte, value []byte) error {
+	return t.put(b, key, value, mustExist)
+}
+
+// トランザクション内で、キーの現在の値がoldValueと一致する場合だけ値を置き換える関数（BTree.CompareAndSwapを参照）
+func (t *Txn) CompareAndSwap(b *BTree, key []byte, oldValue []byte, newValue []byte) error {
+	return t.put(b, key, newValue, b.mustMatch(oldValue))
+}
+
+// トランザクション内でキーを削除する関数
+// 途中でエラーが起きた場合、この削除の更新だけが取り消され、トランザクションは続けて使用できる
+func (t *Txn) Delete(b *BTree, key []byte) error {
+	if err := t.check(b); err != nil {
+		return err
+	}
+	if err := b.deleteOp(t.tx, key); err != nil {
+		return err
+	}
+	t.tx.Apply()
+	return nil
+}
+
+// トランザクション内の更新をログに記録してコミット
+// 返却時にコミットが永続化されているかは、プールマネージャのwal.Durability（pool.WithDurability）による
+// DurabilityFullとDurabilityGroupCommitは、ログをファイルと同期してから返却する（GroupCommitは他のコミットとまとめて同期するため、
+// 最大でwindowの間は永続化されないまま待つ）
+// DurabilityOSBufferedはOSの停止（電源断など）で、DurabilityNoneはプロセスの異常終了でも、返却後にコミットが失われることがある
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	return t.tx.Commit()
+}
+
+// トランザクション内の更新をすべて取り消す
+func (t *Txn) Rollback() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	return t.tx.Abort()
+}
+
+// 途中でエラーが起きた場合、この書き込みの更新だけが取り消され、トランザクションは続けて使用できる
+func (t *Txn) put(b *BTree, key []byte, value []byte, cond putCond) error {
+	if err := t.check(b); err != nil {
+		return err
+	}
+	if err := b.putOp(t.tx, key, value, cond); err != nil {
+		return err
+	}
+	t.tx.Apply()
+	return nil
+}
+
+func (t *Txn) check(b *BTree) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if b.poolManager != t.poolManager {
+		return ErrPoolMismatch
+	}
+	if b.poolManager.ReadOnly() {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package btree
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/pool"
+)
+
+// 木のすべてのキーと値を返却
+func dumpTree(t *testing.T, btree *BTree) map[string]string {
+	t.Helper()
+
+	pairs := make(map[string]string)
+	for _, key := range checkTree(t, btree) {
+		value, err := btree.Search(key)
+		assert.NoError(t, err)
+		pairs[string(key)] = string(value)
+	}
+	return pairs
+}
+
+// ログファイルを切り詰めずに、異常終了した時点のファイルをコピーして開く
+func openCrashed(t *testing.T, path string) (*pool.PoolManager, *BTree) {
+	t.Helper()
+
+	info, err := os.Stat(path + ".wal")
+	assert.NoError(t, err)
+	crashedPath := path + "-crashed"
+	copyCrashed(t, path, nil, crashedPath, info.Size())
+
+	poolManager, err := pool.NewPoolManager(crashedPath, 10)
+	assert.NoError(t, err)
+	btree, err := OpenBTree(poolManager)
+	assert.NoError(t, err)
+	return poolManager, btree
+}
+
+func TestTxn(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	// 1000件のキーを挿入した木を作成
+	setup := func(t *testing.T) (string, *pool.PoolManager, *BTree) {
+		path := t.TempDir() + "/dbfile"
+		poolManager, err := pool.NewPoolManager(path, 10)
+		assert.NoError(err)
+		btree, err := NewBTree(poolManager)
+		assert.NoError(err)
+		for i := range 1000 {
+			assert.NoError(btree.Insert([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i))))
+		}
+		return path, poolManager, btree
+	}
+
+	// 既存のキーの半分を削除し、新しいキーを挿入する（分割と統合が起きる）
+	update := func(tx *Txn, btree *BTree) {
+		for i := 0; i < 1000; i += 2 {
+			assert.NoError(tx.Delete(btree, []byte(fmt.Sprintf("key%05d", i))))
+		}
+		for i := 1000; i < 2000; i++ {
+			assert.NoError(tx.Insert(btree, []byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i))))
+		}
+	}
+
+	t.Run("Commit", func(t *testing.T) {
+		path, poolManager, btree := setup(t)
+		defer poolManager.Close()
+		other, err := NewBTree(poolManager)
+		assert.NoError(err)
+
+		// 複数の木をまとめて更新
+		tx := Begin(poolManager)
+		update(tx, btree)
+		assert.NoError(tx.Insert(other, []byte("other"), []byte("value")))
+		assert.NoError(tx.Commit())
+
+		pairs := dumpTree(t, btree)
+		assert.Len(pairs, 1500)
+		assert.Equal("value01999", pairs["key01999"])
+		assert.NotContains(pairs, "key00000")
+		value, err := other.Search([]byte("other"))
+		assert.NoError(err)
+		assert.Equal([]byte("value"), value)
+
+		// コミットした更新は異常終了しても失われない
+		crashedPoolManager, crashedBTree := openCrashed(t, path)
+		defer crashedPoolManager.Close()
+		value, err = crashedBTree.Search([]byte("other"))
+		assert.NoError(err)
+		assert.Equal([]byte("value"), value)
+
+		// 終了したトランザクションは使用できない
+		assert.ErrorIs(tx.Insert(btree, []byte("key"), []byte("value")), ErrTxnDone)
+		assert.ErrorIs(tx.Commit(), ErrTxnDone)
+		assert.ErrorIs(tx.Rollback(), ErrTxnDone)
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		path, poolManager, btree := setup(t)
+		defer poolManager.Close()
+		expected := dumpTree(t, btree)
+		assert.NoError(poolManager.Sync())
+		info, err := os.Stat(path)
+		assert.NoError(err)
+
+		tx := Begin(poolManager)
+		update(tx, btree)
+		assert.NoError(tx.Rollback())
+
+		// 木はトランザクション開始前の状態に戻る
+		assert.Equal(expected, dumpTree(t, btree))
+
+		// トランザクション内で作成したページは空きページに戻り、再利用される
+		tx = Begin(poolManager)
+		update(tx, btree)
+		assert.NoError(tx.Commit())
+		assert.NoError(poolManager.Sync())
+		reused, err := os.Stat(path)
+		assert.NoError(err)
+		assert.Less(reused.Size(), 2*info.Size())
+
+		// ロールバックした更新は、後のトランザクションをコミットした後に異常終了しても取り消されたまま
+		// （同じページへの後の更新も消えない）
+		tx = Begin(poolManager)
+		assert.NoError(tx.Insert(btree, []byte("key99998"), []byte("rollback")))
+		assert.NoError(tx.Rollback())
+		assert.NoError(btree.Insert([]byte("key99999"), []byte("commit")))
+
+		crashedPoolManager, crashedBTree := openCrashed(t, path)
+		defer crashedPoolManager.Close()
+		pairs := dumpTree(t, crashedBTree)
+		assert.Len(pairs, 1501)
+		assert.Contains(pairs, "key99999")
+		assert.NotContains(pairs, "key99998")
+	})
+
+	t.Run("Crash Before Commit", func(t *testing.T) {
+		path, poolManager, btree := setup(t)
+		expected := dumpTree(t, btree)
+
+		// プールが小さいので、コミット前の更新もファイルに書き込まれる
+		tx := Begin(poolManager)
+		update(tx, btree)
+
+		// コミットしていない更新は、復旧時にすべて取り消される
+		crashedPoolManager, crashedBTree := openCrashed(t, path)
+		defer crashedPoolManager.Close()
+		assert.Equal(expected, dumpTree(t, crashedBTree))
+
+		assert.NoError(tx.Rollback())
+		assert.NoError(poolManager.Close())
+	})
+
+	t.Run("Operation Error", func(t *testing.T) {
+		_, poolManager, btree := setup(t)
+		defer poolManager.Close()
+
+		tx := Begin(poolManager)
+		assert.NoError(tx.Insert(btree, []byte("key"), []byte("value")))
+
+		// 失敗した操作だけが取り消され、トランザクションは続けて使用できる
+		assert.ErrorIs(tx.Delete(btree, []byte("missing")), ErrKeyNotFound)
+		assert.NoError(tx.Delete(btree, []byte("key00000")))
+		assert.ErrorIs(tx.InsertNew(btree, []byte("key"), []byte("new")), ErrKeyExists)
+		assert.ErrorIs(tx.Update(btree, []byte("key00000"), []byte("new")), ErrKeyNotFound)
+		assert.ErrorIs(tx.CompareAndSwap(btree, []byte("key"), []byte("other"), []byte("new")), ErrValueMismatch)
+		assert.NoError(tx.CompareAndSwap(btree, []byte("key"), []byte("value"), []byte("swapped")))
+		assert.NoError(tx.Update(btree, []byte("key00001"), []byte("updated")))
+		assert.NoError(tx.Commit())
+
+		pairs := dumpTree(t, btree)
+		assert.Len(pairs, 1000)
+		assert.Equal("swapped", pairs["key"])
+		assert.Equal("updated", pairs["key00001"])
+		assert.NotContains(pairs, "key00000")
+
+		// 別のプールマネージャの木は更新できない
+		otherPoolManager, err := pool.NewPoolManager(t.TempDir()+"/dbfile", 10)
+		assert.NoError(err)
+		defer otherPoolManager.Close()
+		tx = Begin(otherPoolManager)
+		assert.ErrorIs(tx.Insert(btree, []byte("key"), []byte("value")), ErrPoolMismatch)
+		assert.NoError(tx.Rollback())
+	})
+}
@@ -1,124 +1,661 @@
 package disk
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"sync"
+	"time"
 )
 
 // ページIDを示す型
 type PageID int64
 
+const (
+	MetaPageID    PageID = 0 // メタページ（スーパーブロック）として予約されたページID
+	FormatVersion uint32 = 6 // ファイルフォーマットのバージョン
+
+	// ページサイズは2のべき乗で、MinPageSize以上MaxPageSize以下
+	// ページ内のスロットはオフセットと長さを2バイトで持つので、MaxPageSizeまでのページを扱える
+	DefaultPageSize = 4096
+	MinPageSize     = 4096
+	MaxPageSize     = 32768
+
+	// ページ内のチェックサム（CRC32C、4バイト）の位置
+	// 書き込み時にFileManagerが設定し、読み込み時に検証してから0に戻すので、メモリ上のページでは常に0
+	ChecksumOffset = 36
+	checksumSize   = 4
+)
+
+// ファイルの先頭（メタページの先頭）に書き込むマジックナンバー
+var Magic = [8]byte{'C', 'H', 'I', 'B', 'I', 'D', 'B', 0}
+
+// 機能フラグ
+// 互換性のある機能（Compat）は、知らないフラグが立っていてもファイルを開ける
+// 互換性のない機能（Incompat）は、知らないフラグが立っているファイルを開かない
+const (
+	IncompatChecksums uint32 = 1 << 0 // ページがチェックサムを持つ
+
+	// このバージョンが扱える互換性のない機能
+	supportedIncompat = IncompatChecksums
+)
+
+var (
+	// ファイルがこのデータベースのファイルではないことを示すエラー
+	ErrNotDatabase = errors.New("データベースファイルではありません")
+	// 扱えないバージョンのファイルフォーマットであることを示すエラー
+	ErrUnsupportedVersion = errors.New("対応していないファイルフォーマットのバージョンです")
+	// 扱えない機能を使用しているファイルであることを示すエラー
+	ErrIncompatibleFeatures = errors.New("対応していない機能を使用しているファイルです")
+	// 他のプロセスがファイルを開いていることを示すエラー
+	ErrDatabaseLocked = errors.New("データベースファイルは他のプロセスが使用中です")
+	// 読み取り専用で開いたファイルに書き込もうとしたことを示すエラー
+	ErrReadOnly = errors.New("読み取り専用で開いたデータベースには書き込めません")
+)
+
+// チェックサムの計算に使うテーブル（CRC32C）
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ファイルから読み込んだページのチェックサムが一致しないことを示すエラー
+var ErrChecksumMismatch = errors.New("ページのチェックサムが一致しません")
+
+// ページのチェックサムが一致しない場合に返却するエラー
+// errors.IsでErrChecksumMismatchと比較でき、errors.Asで壊れたページのIDを取り出せる
+type ChecksumError struct {
+	PageID   PageID // 壊れたページのID
+	Stored   uint32 // ファイルに記録されていたチェックサム
+	Computed uint32 // ページデータから計算したチェックサム
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s。ページID: %d, 記録された値: %08x, 計算した値: %08x", ErrChecksumMismatch, e.PageID, e.Stored, e.Computed)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// 空きページはメタページを先頭とする連結リストで管理する
+// 空きページの先頭8バイトには、次の空きページID（末尾の場合は-1）が格納される
+
+// メタページ（ファイルヘッダ）
+// [0:8]   マジックナンバー
+// [8:12]  ファイルフォーマットのバージョン
+// [12:16] ページサイズ
+// [16:24] ファイルの作成時刻（UnixNano）
+// [24:28] 互換性のある機能フラグ
+// [28:32] 互換性のない機能フラグ
+// [36:40] チェックサム（ChecksumOffset）
+// [40:48] B+木のルートページID
+// [48:56] 空きページリストの先頭ページID
+// [56:64] 最後のチェックポイントで破棄したログの最大LSN
+// [0:32]はファイルを開くときに、チェックサムの検証より先に読み込んで検証する
+
+// メタページに記録される情報
+// Version、PageSize、CreatedAt、機能フラグはファイル作成時に決まり、WriteMetaでは無視される
+type Meta struct {
+	Version          uint32    // ファイルフォーマットのバージョン
+	PageSize         uint32    // ページサイズ
+	CreatedAt        time.Time // ファイルの作成時刻
+	CompatFeatures   uint32    // 互換性のある機能フラグ
+	IncompatFeatures uint32    // 互換性のない機能フラグ
+	RootID           PageID    // B+木のルートページID（未作成の場合は-1）
+
+	// 最後のチェックポイントで破棄したログの最大LSN
+	// ログを破棄した後も、LSNを単調に増加させるために記録する
+	CheckpointLSN uint64
+
+	// 空きページリストの先頭ページID（空きページがない場合は-1）
+	// FileManagerが管理するので、WriteMetaでは無視される
+	FreeListHead PageID
+}
+
 // ======================================================================
 
 // ファイルマネージャ構造体
+// ページの読み書きは位置指定（ReadAt/WriteAt）で行うので、複数のゴルーチンから同時に呼び出せる
 type FileManager struct {
-	Heap   *os.File // ヒープファイルへのファイルポインタ
-	NextID PageID   // 次に割り当てるページID
+	Heap            *os.File   // ヒープファイルへのファイルポインタ
+	file            heapFile   // ページの読み書きに使用するファイル（通常はHeap、WithMmapの場合はメモリマップ）
+	NextID          PageID     // 次に割り当てるページID
+	freeListHead    PageID     // 空きページリストの先頭ページID（空きページがない場合は-1）
+	pageSize        int        // ページサイズ（ファイル作成時に決まり、メタページに記録される）
+	createdAt       int64      // ファイルの作成時刻（UnixNano）
+	compatFeatures  uint32     // 互換性のある機能フラグ（知らないフラグも書き換えずに残す）
+	ignoreChecksums bool       // 読み込み時にチェックサムを検証しない
+	mmap            bool       // ページの読み書きにメモリマップを使用する
+	bufferedWrites  bool       // ページの書き込みをOSのバッファに溜め、Syncで同期する
+	readOnly        bool       // 読み取り専用で開いている
+	mu              sync.Mutex // NextID、freeListHead、メタページの書き込みを保護するミューテックス
+}
+
+// ヒープファイルの読み書きと同期を行うインターフェース
+type heapFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// NewFileManagerの設定を変更するオプション
+type Option func(f *FileManager)
+
+// 読み込み時にチェックサムを検証しないオプション
+// 壊れたファイルから読み出せるデータを救出する場合に使用する（書き込み時のチェックサムは計算する）
+func WithIgnoreChecksums() Option {
+	return func(f *FileManager) {
+		f.ignoreChecksums = true
+	}
+}
+
+// ページの読み書きに、システムコールの代わりにファイルのメモリマップを使用するオプション
+// 読み込みの多い処理で、OSのキャッシュにあるページをシステムコールなしで読み込める
+// 書き込みはSyncを呼び出すまで永続化されない（O_SYNCで書き込む通常の場合とは異なる）
+// Linux以外では、NewFileManagerがエラーを返却する
+func WithMmap() Option {
+	return func(f *FileManager) {
+		f.mmap = true
+	}
+}
+
+// 既存のファイルを読み取り専用（O_RDONLY）で開くオプション
+// ページやメタページの書き込み、ページの割り当てと解放はErrReadOnlyを返却する
+// 他のプロセスと共有ロックを取り合うので、読み取り専用のプロセス同士は同時に開ける
+func WithReadOnly() Option {
+	return func(f *FileManager) {
+		f.readOnly = true
+	}
+}
+
+// ヒープファイルをO_SYNCなしで開くオプション
+// ページの書き込みはOSのページキャッシュに溜まり、Syncを呼び出すまで永続化されない
+// 大量のページを書き込む場合に、書き込みごとの同期を避けるために使用する
+func WithBufferedWrites() Option {
+	return func(f *FileManager) {
+		f.bufferedWrites = true
+	}
+}
+
+// 新規ファイルのページサイズを指定するオプション（デフォルトはDefaultPageSize）
+// 既存のファイルを開く場合は、メタページに記録されたページサイズを使用する
+func WithPageSize(pageSize int) Option {
+	return func(f *FileManager) {
+		f.pageSize = pageSize
+	}
 }
 
 // ファイルマネージャの生成
-func NewFileManager(path string) (*FileManager, error) {
+func NewFileManager(path string, opts ...Option) (*FileManager, error) {
+
+	// FileManagerの生成とオプションの適用
+	f := &FileManager{
+		freeListHead: PageID(-1),
+		pageSize:     DefaultPageSize,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
 
 	// ファイルオブジェクトの生成
-	// os.O_SYNCなくてもいいかも
-	heap, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_SYNC, 0755)
+	// WithBufferedWritesを指定しなければ、ページの書き込みごとにディスクと同期する（O_SYNC）
+	// 読み取り専用の場合は、ファイルを作成しない
+	flag := os.O_RDWR | os.O_CREATE
+	if f.readOnly {
+		flag = os.O_RDONLY
+	} else if !f.bufferedWrites {
+		flag |= os.O_SYNC
+	}
+	heap, err := os.OpenFile(path, flag, 0755)
 	if err != nil {
 		return nil, err
 	}
+	f.Heap = heap
+	f.file = heap
+
+	// 他のプロセスが同じファイルに書き込まないよう、ロックを取得（Closeで解放）
+	// 読み取り専用の場合は共有ロック、それ以外は排他ロック
+	if err := lockFile(heap, !f.readOnly); err != nil {
+		heap.Close()
+		return nil, err
+	}
 
 	// ファイルサイズの取得
 	info, err := heap.Stat()
 	if err != nil {
+		heap.Close()
 		return nil, err
 	}
 	heapSize := info.Size()
+	if heapSize == 0 && f.readOnly {
+		heap.Close()
+		return nil, fmt.Errorf("%w。読み取り専用では空のファイルを初期化できません。ファイル: %s", ErrNotDatabase, path)
+	}
+
+	// 既存ファイルの場合、ファイルヘッダを検証し、記録されたページサイズを使用
+	if heapSize > 0 {
+		if f.pageSize, err = readHeader(heap); err != nil {
+			heap.Close()
+			return nil, err
+		}
+	}
+	if err := validatePageSize(f.pageSize); err != nil {
+		heap.Close()
+		return nil, err
+	}
 
 	// ファイルサイズのバリデーション
-	if heapSize%4096 != 0 {
-		return nil, fmt.Errorf("ヒープファイルのサイズが無効です。期待されるサイズは4096の倍数ですが、現在のサイズは %d バイトです。", heapSize)
+	if heapSize%int64(f.pageSize) != 0 {
+		heap.Close()
+		return nil, fmt.Errorf("ヒープファイルのサイズが無効です。期待されるサイズは%dの倍数ですが、現在のサイズは %d バイトです。", f.pageSize, heapSize)
+	}
+
+	// メモリマップを使用する場合、ファイル全体をマップする
+	if f.mmap {
+		if f.file, err = newMmapFile(heap, !f.readOnly); err != nil {
+			heap.Close()
+			return nil, err
+		}
 	}
 
 	// 次に割り当てるページIDの計算とバリデーション
 	// heapSize==0の場合、nextID==0となる
-	// heapSize==4096の場合、nextID==1となる
-	// heapSize==8192の場合、nextID==2となる
-	nextID := PageID(heapSize) / 4096
-	if nextID < 0 {
-		return nil, fmt.Errorf("ページIDが無効です。指定されたページID: %d", nextID)
+	// heapSize==pageSizeの場合、nextID==1となる
+	// heapSize==pageSize*2の場合、nextID==2となる
+	f.NextID = PageID(heapSize / int64(f.pageSize))
+	if f.NextID < 0 {
+		f.file.Close()
+		return nil, fmt.Errorf("ページIDが無効です。指定されたページID: %d", f.NextID)
+	}
+
+	// 新規ファイルの場合、メタページを予約して初期化
+	if f.NextID == 0 {
+		if _, err := f.AllocPage(); err != nil {
+			f.file.Close()
+			return nil, err
+		}
+		f.createdAt = time.Now().UnixNano()
+		meta := &Meta{
+			RootID: PageID(-1),
+		}
+		if err := f.WriteMeta(meta); err != nil {
+			f.file.Close()
+			return nil, err
+		}
+		return f, nil
 	}
 
-	// FileManagerの生成と初期化
-	return &FileManager{
-		Heap:   heap,
-		NextID: nextID,
-	}, nil
+	// 既存ファイルの場合、メタページを検証
+	meta, err := f.ReadMeta()
+	if err != nil {
+		f.file.Close()
+		return nil, err
+	}
+	f.freeListHead = meta.FreeListHead
+	f.createdAt = meta.CreatedAt.UnixNano()
+	f.compatFeatures = meta.CompatFeatures
+
+	return f, nil
 }
 
-func (f *FileManager) seekData(pageID PageID) error {
-	// ページIDのバリデーション
-	if pageID < 0 || pageID >= f.NextID {
-		return fmt.Errorf("ページIDが無効です。指定されたページID: %d", pageID)
+// ファイルヘッダ（メタページの先頭）を読み込んで検証し、ページサイズを返却する関数
+// ページサイズが分かるまでメタページ全体を読み込めないので、チェックサムは後でReadMetaが検証する
+func readHeader(heap *os.File) (int, error) {
+	buf := make([]byte, 32)
+	if _, err := heap.ReadAt(buf, 0); err != nil {
+		return 0, fmt.Errorf("%w。ファイルヘッダを読み込めません。エラー詳細: %v", ErrNotDatabase, err)
 	}
-	// ファイルポインタの移動
-	if _, err := f.Heap.Seek(int64(pageID*4096), io.SeekStart); err != nil {
-		return fmt.Errorf("ページデータのシークに失敗しました。ページID: %d, エラー詳細: %w", pageID, err)
+	if err := validateHeader(buf); err != nil {
+		return 0, err
+	}
+	return int(binary.LittleEndian.Uint32(buf[12:16])), nil
+}
+
+// ファイルヘッダのマジックナンバー、バージョン、機能フラグを検証する関数
+func validateHeader(buf []byte) error {
+	if [8]byte(buf[0:8]) != Magic {
+		return fmt.Errorf("%w。マジックナンバーが一致しません。先頭のバイト列: %q", ErrNotDatabase, buf[0:8])
+	}
+	version := binary.LittleEndian.Uint32(buf[8:12])
+	if version > FormatVersion {
+		return fmt.Errorf("%w。より新しいバージョンで作成されたファイルです。扱えるバージョン: %d, ファイルのバージョン: %d", ErrUnsupportedVersion, FormatVersion, version)
+	}
+	if version < FormatVersion {
+		return fmt.Errorf("%w。古いバージョンで作成されたファイルです。扱えるバージョン: %d, ファイルのバージョン: %d", ErrUnsupportedVersion, FormatVersion, version)
+	}
+	if unknown := binary.LittleEndian.Uint32(buf[28:32]) &^ supportedIncompat; unknown != 0 {
+		return fmt.Errorf("%w。未対応の機能フラグ: %#x", ErrIncompatibleFeatures, unknown)
 	}
 	return nil
 }
 
-// 指定ページIDのデータ読み込みを行う関数
-func (f *FileManager) ReadData(pageID PageID, pageData []byte) error {
-	// ページデータサイズのバリデーション
-	if len(pageData) != 4096 {
-		return fmt.Errorf("不正なページサイズが指定されました。現在のサイズ: %d バイト, 要求される正確なサイズ: 4096 バイト", len(pageData))
+// ページサイズが2のべき乗で、MinPageSize以上MaxPageSize以下であることを検証する関数
+func validatePageSize(pageSize int) error {
+	if pageSize < MinPageSize || pageSize > MaxPageSize || pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("ページサイズが不正です。%d から %d までの2のべき乗を指定してください。指定されたサイズ: %d バイト", MinPageSize, MaxPageSize, pageSize)
 	}
+	return nil
+}
 
-	// ページIDからデータの位置を特定
-	if err := f.seekData(pageID); err != nil {
+// ページサイズを返却
+func (f *FileManager) PageSize() int {
+	return f.pageSize
+}
+
+// 割り当て済みのページ数（メタページを含む）を返却
+func (f *FileManager) NumPages() PageID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.NextID
+}
+
+// ファイルの内容をディスクと同期（読み取り専用の場合は何もしない）
+func (f *FileManager) Sync() error {
+	if f.readOnly {
+		return nil
+	}
+	return f.file.Sync()
+}
+
+// ファイルを閉じ、ロックを解放する
+func (f *FileManager) Close() error {
+	if err := unlockFile(f.Heap); err != nil {
+		f.file.Close()
 		return err
 	}
+	return f.file.Close()
+}
 
-	// ファイルからデータの読み込み
-	n, err := f.Heap.Read(pageData)
-	if err != nil {
-		return fmt.Errorf("ページデータの読み込みに失敗しました。ページID: %d, エラー詳細: %w", pageID, err)
+// ページIDを検証し、ファイル内のオフセットを返却する関数
+func (f *FileManager) pageOffset(pageID PageID) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pageOffsetLocked(pageID)
+}
+
+// f.muを取得した状態で呼び出すpageOffset
+func (f *FileManager) pageOffsetLocked(pageID PageID) (int64, error) {
+	// ページIDのバリデーション
+	if pageID < 0 || pageID >= f.NextID {
+		return 0, fmt.Errorf("ページIDが無効です。指定されたページID: %d", pageID)
 	}
-	if n != 4096 {
-		return fmt.Errorf("ページデータの読み込みに失敗しました。ページID: %d, 読み込まれたバイト数: %d", pageID, n)
+	return int64(pageID) * int64(f.pageSize), nil
+}
+
+// 指定ページIDのデータ読み込みを行う関数
+// チェックサムが一致しない場合は*ChecksumError（ErrChecksumMismatch）を返却
+func (f *FileManager) ReadPage(pageID PageID, pageData []byte) error {
+	// ページデータサイズのバリデーション
+	if len(pageData) != f.pageSize {
+		return fmt.Errorf("不正なページサイズが指定されました。現在のサイズ: %d バイト, 要求される正確なサイズ: %d バイト", len(pageData), f.pageSize)
 	}
 
-	return nil
+	// ページIDからデータの位置を特定
+	offset, err := f.pageOffset(pageID)
+	if err != nil {
+		return err
+	}
+
+	return f.readAt(pageID, pageData, offset)
 }
 
 // 指定ページIDへデータを書き込む関数
-func (f *FileManager) WriteData(pageID PageID, pageData []byte) error {
+// ページデータのチェックサムを計算し、ChecksumOffsetの位置に設定して書き込む（pageData自体は変更しない）
+func (f *FileManager) WritePage(pageID PageID, pageData []byte) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
 	// ページデータサイズのバリデーション
-	if len(pageData) != 4096 {
-		return fmt.Errorf("不正なページサイズが指定されました。現在のサイズ: %d バイト, 要求される正確なサイズ: 4096 バイト", len(pageData))
+	if len(pageData) != f.pageSize {
+		return fmt.Errorf("不正なページサイズが指定されました。現在のサイズ: %d バイト, 要求される正確なサイズ: %d バイト", len(pageData), f.pageSize)
 	}
 
 	// ページIDからデータの位置を特定
-	if err := f.seekData(pageID); err != nil {
+	offset, err := f.pageOffset(pageID)
+	if err != nil {
 		return err
 	}
 
-	// データのファイルへの書き込み
-	n, err := f.Heap.Write(pageData)
+	return f.writeAt(pageID, pageData, offset)
+}
+
+// ファイルからページを読み込み、チェックサムを検証する関数
+// 検証後、チェックサムの位置は0に戻す
+// 一度も書き込まれていないページ（すべて0のページ）は検証しない
+func (f *FileManager) readAt(pageID PageID, pageData []byte, offset int64) error {
+	n, err := f.file.ReadAt(pageData, offset)
+	if err != nil {
+		return fmt.Errorf("ページデータの読み込みに失敗しました。ページID: %d, エラー詳細: %w", pageID, err)
+	}
+	if n != f.pageSize {
+		return fmt.Errorf("ページデータの読み込みに失敗しました。ページID: %d, 読み込まれたバイト数: %d", pageID, n)
+	}
+
+	stored := binary.LittleEndian.Uint32(pageData[ChecksumOffset : ChecksumOffset+checksumSize])
+	clear(pageData[ChecksumOffset : ChecksumOffset+checksumSize])
+	if f.ignoreChecksums {
+		return nil
+	}
+	if computed := checksum(pageData); stored != computed && (stored != 0 || !isZero(pageData)) {
+		return &ChecksumError{PageID: pageID, Stored: stored, Computed: computed}
+	}
+	return nil
+}
+
+// チェックサムを設定したページをファイルに書き込む関数
+func (f *FileManager) writeAt(pageID PageID, pageData []byte, offset int64) error {
+	buf := append(make([]byte, 0, f.pageSize), pageData...)
+	clear(buf[ChecksumOffset : ChecksumOffset+checksumSize])
+	binary.LittleEndian.PutUint32(buf[ChecksumOffset:ChecksumOffset+checksumSize], checksum(buf))
+
+	n, err := f.file.WriteAt(buf, offset)
 	if err != nil {
 		return fmt.Errorf("ページデータの書き込みに失敗しました。ページID: %d, エラー詳細: %w", pageID, err)
 	}
-	if n != 4096 {
+	if n != f.pageSize {
 		return fmt.Errorf("ページデータの書き込みに失敗しました。ページID: %d, 書き込まれたバイト数: %d", pageID, n)
 	}
-
 	return nil
 }
 
+// チェックサムの位置を0としてページデータのCRC32Cを計算する関数
+func checksum(pageData []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, pageData[:ChecksumOffset])
+	crc = crc32.Update(crc, castagnoli, make([]byte, checksumSize))
+	return crc32.Update(crc, castagnoli, pageData[ChecksumOffset+checksumSize:])
+}
+
+// すべて0のページかを返却する関数
+func isZero(pageData []byte) bool {
+	for _, b := range pageData {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // 新しいページを割り当てる関数
+// 空きページがあればそれを再利用し、なければファイルの末尾に追加する
 func (f *FileManager) AllocPage() (PageID, error) {
+	if f.readOnly {
+		return PageID(-1), ErrReadOnly
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// 空きページリストの先頭を取り出す
+	if f.freeListHead != PageID(-1) {
+		pageID := f.freeListHead
+		offset, err := f.pageOffsetLocked(pageID)
+		if err != nil {
+			return PageID(-1), err
+		}
+		buf := make([]byte, f.pageSize)
+		if err := f.readAt(pageID, buf, offset); err != nil {
+			return PageID(-1), fmt.Errorf("空きページの読み込みに失敗しました。ページID: %d, エラー詳細: %w", pageID, err)
+		}
+
+		// メタページに書き込めたら、割り当てを確定する
+		// 異常終了後の復旧で使用中のページを空きページとして扱わないよう、返却する前に永続化する
+		nextFreeID := PageID(binary.LittleEndian.Uint64(buf[0:8]))
+		if err := f.writeFreeListHead(nextFreeID); err != nil {
+			return PageID(-1), err
+		}
+		if err := f.file.Sync(); err != nil {
+			return PageID(-1), fmt.Errorf("メタページの同期に失敗しました。エラー詳細: %w", err)
+		}
+		f.freeListHead = nextFreeID
+		return pageID, nil
+	}
+
 	// 新しいページIDを割り当てて次のIDを更新
 	pageID := f.NextID
 	f.NextID++
 	return pageID, nil
 }
+
+// pageIDまでのページが割り当て済みになるよう、NextIDを進める関数
+// ログからの復旧で、ファイルに書き込まれる前だったページを復元するために使用する
+func (f *FileManager) Extend(pageID PageID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if pageID >= f.NextID {
+		f.NextID = pageID + 1
+	}
+}
+
+// 空きページリストのページIDを先頭から順に返却する関数
+func (f *FileManager) FreePages() ([]PageID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var pageIDs []PageID
+	buf := make([]byte, f.pageSize)
+	for pageID := f.freeListHead; pageID != PageID(-1); {
+		// 壊れたリストで無限ループしないよう、ページ数を上限とする
+		if PageID(len(pageIDs)) >= f.NextID {
+			return nil, fmt.Errorf("空きページリストが循環しています。ページID: %d", pageID)
+		}
+		offset, err := f.pageOffsetLocked(pageID)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.readAt(pageID, buf, offset); err != nil {
+			return nil, fmt.Errorf("空きページの読み込みに失敗しました。ページID: %d, エラー詳細: %w", pageID, err)
+		}
+		pageIDs = append(pageIDs, pageID)
+		pageID = PageID(binary.LittleEndian.Uint64(buf[0:8]))
+	}
+	return pageIDs, nil
+}
+
+// ページを解放し、空きページリストの先頭に追加する関数
+// 解放したページの内容は失われる
+func (f *FileManager) FreePage(pageID PageID) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// メタページは解放できない
+	if pageID == MetaPageID {
+		return fmt.Errorf("メタページは解放できません。ページID: %d", pageID)
+	}
+	offset, err := f.pageOffsetLocked(pageID)
+	if err != nil {
+		return err
+	}
+
+	// 解放するページに、現在の先頭の空きページIDを書き込む
+	buf := make([]byte, f.pageSize)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(f.freeListHead))
+	if err := f.writeAt(pageID, buf, offset); err != nil {
+		return fmt.Errorf("空きページの書き込みに失敗しました。ページID: %d, エラー詳細: %w", pageID, err)
+	}
+	// O_SYNCで書き込まない場合は、メタページより先に永続化されるよう同期する
+	// （メタページだけが永続化されると、異常終了後に古いページの内容を次の空きページIDとして読んでしまう）
+	if f.bufferedWrites || f.mmap {
+		if err := f.file.Sync(); err != nil {
+			return fmt.Errorf("空きページの同期に失敗しました。ページID: %d, エラー詳細: %w", pageID, err)
+		}
+	}
+
+	if err := f.writeFreeListHead(pageID); err != nil {
+		return err
+	}
+	f.freeListHead = pageID
+	return nil
+}
+
+// メタページを読み込み、検証した上で返却する関数
+func (f *FileManager) ReadMeta() (*Meta, error) {
+	buf := make([]byte, f.pageSize)
+	if err := f.ReadPage(MetaPageID, buf); err != nil {
+		return nil, err
+	}
+
+	// マジックナンバー、バージョン、機能フラグ、ページサイズのバリデーション
+	if err := validateHeader(buf); err != nil {
+		return nil, err
+	}
+	meta := &Meta{
+		Version:          binary.LittleEndian.Uint32(buf[8:12]),
+		PageSize:         binary.LittleEndian.Uint32(buf[12:16]),
+		CreatedAt:        time.Unix(0, int64(binary.LittleEndian.Uint64(buf[16:24]))),
+		CompatFeatures:   binary.LittleEndian.Uint32(buf[24:28]),
+		IncompatFeatures: binary.LittleEndian.Uint32(buf[28:32]),
+		RootID:           PageID(binary.LittleEndian.Uint64(buf[40:48])),
+		FreeListHead:     PageID(binary.LittleEndian.Uint64(buf[48:56])),
+		CheckpointLSN:    binary.LittleEndian.Uint64(buf[56:64]),
+	}
+	if meta.PageSize != uint32(f.pageSize) {
+		return nil, fmt.Errorf("ページサイズが不正です。期待されるサイズ: %d バイト, 現在のサイズ: %d バイト", f.pageSize, meta.PageSize)
+	}
+
+	return meta, nil
+}
+
+// メタページを書き込む関数
+// ファイルヘッダと空きページリストの先頭ページIDは、FileManagerが管理している値を書き込む
+func (f *FileManager) WriteMeta(meta *Meta) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	buf := make([]byte, f.pageSize)
+	copy(buf[0:8], Magic[:])
+	binary.LittleEndian.PutUint32(buf[8:12], FormatVersion)
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(f.pageSize))
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(f.createdAt))
+	binary.LittleEndian.PutUint32(buf[24:28], f.compatFeatures)
+	binary.LittleEndian.PutUint32(buf[28:32], supportedIncompat)
+	binary.LittleEndian.PutUint64(buf[40:48], uint64(meta.RootID))
+	binary.LittleEndian.PutUint64(buf[48:56], uint64(f.freeListHead))
+	binary.LittleEndian.PutUint64(buf[56:64], meta.CheckpointLSN)
+	if err := f.writeAt(MetaPageID, buf, int64(MetaPageID)*int64(f.pageSize)); err != nil {
+		return fmt.Errorf("メタページの書き込みに失敗しました。エラー詳細: %w", err)
+	}
+	return nil
+}
+
+// メタページの空きページリストの先頭ページIDだけを書き換える関数
+// チェックサムを計算し直すため、メタページ全体を読み込んでから書き込む
+// f.muを取得した状態で呼び出すこと
+func (f *FileManager) writeFreeListHead(pageID PageID) error {
+	buf := make([]byte, f.pageSize)
+	if err := f.readAt(MetaPageID, buf, int64(MetaPageID)*int64(f.pageSize)); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(buf[48:56], uint64(pageID))
+	if err := f.writeAt(MetaPageID, buf, int64(MetaPageID)*int64(f.pageSize)); err != nil {
+		return fmt.Errorf("メタページの書き込みに失敗しました。エラー詳細: %w", err)
+	}
+	return nil
+}
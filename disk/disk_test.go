@@ -2,8 +2,11 @@ package disk
 
 import (
 	"bytes"
+	"encoding/binary"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -32,12 +35,12 @@ func TestReadWrite(t *testing.T) {
 		// 書き込み
 		testPageID, err := fileManager.AllocPage()
 		assert.NoError(err)
-		err = fileManager.WriteData(testPageID, helloByte)
+		err = fileManager.WritePage(testPageID, helloByte)
 		assert.NoError(err)
 
 		// 読み込み
 		readBuffer := make([]byte, 4096)
-		err = fileManager.ReadData(testPageID, readBuffer)
+		err = fileManager.ReadPage(testPageID, readBuffer)
 		assert.NoError(err)
 
 		// テスト
@@ -58,23 +61,23 @@ func TestReadWrite(t *testing.T) {
 		// 書き込み
 		helloPageID, err := fileManager.AllocPage()
 		assert.NoError(err)
-		err = fileManager.WriteData(helloPageID, helloByte)
+		err = fileManager.WritePage(helloPageID, helloByte)
 		assert.NoError(err)
 
 		// 書き込み
 		worldPageID, err := fileManager.AllocPage()
 		assert.NoError(err)
-		err = fileManager.WriteData(worldPageID, worldByte)
+		err = fileManager.WritePage(worldPageID, worldByte)
 		assert.NoError(err)
 
 		// 読み込み
 		helloBuffer := make([]byte, 4096)
-		err = fileManager.ReadData(helloPageID, helloBuffer)
+		err = fileManager.ReadPage(helloPageID, helloBuffer)
 		assert.NoError(err)
 
 		// 読み込み
 		worldBuffer := make([]byte, 4096)
-		err = fileManager.ReadData(worldPageID, worldBuffer)
+		err = fileManager.ReadPage(worldPageID, worldBuffer)
 		assert.NoError(err)
 
 		// テスト
@@ -96,12 +99,12 @@ func TestReadWrite(t *testing.T) {
 		// 書き込み
 		helloPageID, err := fileManager.AllocPage()
 		assert.NoError(err)
-		err = fileManager.WriteData(helloPageID, helloByte)
+		err = fileManager.WritePage(helloPageID, helloByte)
 		assert.NoError(err)
 
 		// 読み込み
 		helloBuffer := make([]byte, 4096)
-		err = fileManager.ReadData(helloPageID, helloBuffer)
+		err = fileManager.ReadPage(helloPageID, helloBuffer)
 		assert.NoError(err)
 
 		// テスト
@@ -112,12 +115,12 @@ func TestReadWrite(t *testing.T) {
 		// 書き込み
 		worldPageID, err := fileManager.AllocPage()
 		assert.NoError(err)
-		err = fileManager.WriteData(worldPageID, worldByte)
+		err = fileManager.WritePage(worldPageID, worldByte)
 		assert.NoError(err)
 
 		// 読み込み
 		worldBuffer := make([]byte, 4096)
-		err = fileManager.ReadData(worldPageID, worldBuffer)
+		err = fileManager.ReadPage(worldPageID, worldBuffer)
 		assert.NoError(err)
 
 		// テスト
@@ -137,7 +140,7 @@ func TestReadWrite(t *testing.T) {
 		// 読み込み: 存在しないページIDを指定
 		nonExistentPageID := PageID(-1)
 		errBuffer := make([]byte, 4096)
-		err = fileManager.ReadData(nonExistentPageID, errBuffer)
+		err = fileManager.ReadPage(nonExistentPageID, errBuffer)
 
 		// テスト: エラーが返されるか
 		assert.Error(err)
@@ -145,14 +148,14 @@ func TestReadWrite(t *testing.T) {
 
 		// ======================================================================
 
-		// 読み込み: 存在しないページIDを指定
-		nonExistentPageID = PageID(0)
+		// 読み込み: 存在しないページIDを指定（ページ0はメタページとして予約済み）
+		nonExistentPageID = PageID(1)
 		errBuffer = make([]byte, 4096)
-		err = fileManager.ReadData(nonExistentPageID, errBuffer)
+		err = fileManager.ReadPage(nonExistentPageID, errBuffer)
 
 		// テスト: エラーが出て空のページが返されるか
 		assert.Error(err)
-		assert.Equal("ページIDが無効です。指定されたページID: 0", err.Error())
+		assert.Equal("ページIDが無効です。指定されたページID: 1", err.Error())
 	})
 
 	t.Run("Error Handling: Write Non-Existent Page", func(t *testing.T) {
@@ -167,7 +170,7 @@ func TestReadWrite(t *testing.T) {
 
 		// 書き込み: 存在しないページIDを指定
 		nonExistentPageID := PageID(-1)
-		err = fileManager.WriteData(nonExistentPageID, helloByte)
+		err = fileManager.WritePage(nonExistentPageID, helloByte)
 
 		// テスト: エラーが返されるか
 		assert.Error(err)
@@ -195,14 +198,16 @@ func TestFileManager(t *testing.T) {
 	}
 
 	// データの書き込み
+	// チェックサムの位置はFileManagerが使用するので、読み込んだデータでは0になる
 	testData := bytes.Repeat([]byte{0xAB}, 4096)
-	if err := fm.WriteData(pageID, testData); err != nil {
+	clear(testData[ChecksumOffset : ChecksumOffset+4])
+	if err := fm.WritePage(pageID, testData); err != nil {
 		t.Fatalf("Failed to write data to page: %v", err)
 	}
 
 	// データの読み込み
 	readData := make([]byte, 4096)
-	if err := fm.ReadData(pageID, readData); err != nil {
+	if err := fm.ReadPage(pageID, readData); err != nil {
 		t.Fatalf("Failed to read data from page: %v", err)
 	}
 
@@ -213,10 +218,528 @@ func TestFileManager(t *testing.T) {
 
 	// 不正なページIDでの読み書きのテスト
 	invalidPageID := PageID(-1)
-	if err := fm.ReadData(invalidPageID, make([]byte, 4096)); err == nil {
+	if err := fm.ReadPage(invalidPageID, make([]byte, 4096)); err == nil {
 		t.Errorf("Expected error for invalid read pageID, got none")
 	}
-	if err := fm.WriteData(invalidPageID, make([]byte, 4096)); err == nil {
+	if err := fm.WritePage(invalidPageID, make([]byte, 4096)); err == nil {
 		t.Errorf("Expected error for invalid write pageID, got none")
 	}
 }
+
+//=================================================================================
+
+func TestMeta(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("New File Reserves Meta Page", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+		defer fm.Heap.Close()
+
+		// ページ0はメタページとして予約されている
+		assert.Equal(PageID(1), fm.NextID)
+		pageID, err := fm.AllocPage()
+		assert.NoError(err)
+		assert.Equal(PageID(1), pageID)
+
+		// 初期状態のメタページ
+		meta, err := fm.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(FormatVersion, meta.Version)
+		assert.Equal(uint32(4096), meta.PageSize)
+		assert.Equal(PageID(-1), meta.RootID)
+		assert.Equal(PageID(-1), meta.FreeListHead)
+	})
+
+	t.Run("Reopen Keeps Meta", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+
+		meta, err := fm.ReadMeta()
+		assert.NoError(err)
+		meta.RootID = PageID(42)
+		assert.NoError(fm.WriteMeta(meta))
+		assert.NoError(fm.Heap.Close())
+
+		// 再オープン
+		fm, err = NewFileManager(testPath)
+		assert.NoError(err)
+		defer fm.Heap.Close()
+
+		meta, err = fm.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(PageID(42), meta.RootID)
+		assert.Equal(PageID(1), fm.NextID)
+	})
+
+	t.Run("Error Handling: Unknown Version", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+
+		// 新しいバージョンで作成されたファイルを再現
+		_, err = fm.Heap.WriteAt(binary.LittleEndian.AppendUint32(nil, FormatVersion+1), 8)
+		assert.NoError(err)
+		assert.NoError(fm.Heap.Close())
+
+		// 再オープン
+		_, err = NewFileManager(testPath)
+		assert.ErrorIs(err, ErrUnsupportedVersion)
+		assert.Equal("対応していないファイルフォーマットのバージョンです。より新しいバージョンで作成されたファイルです。扱えるバージョン: 6, ファイルのバージョン: 7", err.Error())
+	})
+}
+
+//=================================================================================
+
+func TestFreePage(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Reuse Freed Pages", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+
+		for i := 1; i <= 3; i++ {
+			pageID, err := fm.AllocPage()
+			assert.NoError(err)
+			assert.Equal(PageID(i), pageID)
+		}
+
+		// 解放したページは、後に解放したものから順に再利用される
+		assert.NoError(fm.FreePage(PageID(1)))
+		assert.NoError(fm.FreePage(PageID(3)))
+		meta, err := fm.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(PageID(3), meta.FreeListHead)
+
+		pageID, err := fm.AllocPage()
+		assert.NoError(err)
+		assert.Equal(PageID(3), pageID)
+
+		// 空きページリストは再オープン後も保持される
+		assert.NoError(fm.Heap.Close())
+		fm, err = NewFileManager(testPath)
+		assert.NoError(err)
+		defer fm.Heap.Close()
+
+		pageID, err = fm.AllocPage()
+		assert.NoError(err)
+		assert.Equal(PageID(1), pageID)
+
+		// 空きページがなくなったら、ファイルの末尾に追加
+		pageID, err = fm.AllocPage()
+		assert.NoError(err)
+		assert.Equal(PageID(4), pageID)
+		meta, err = fm.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(PageID(-1), meta.FreeListHead)
+	})
+
+	t.Run("WriteMeta Keeps Free List", func(t *testing.T) {
+		fm, err := NewFileManager(t.TempDir() + "/dbfile")
+		assert.NoError(err)
+		defer fm.Heap.Close()
+
+		pageID, err := fm.AllocPage()
+		assert.NoError(err)
+		assert.NoError(fm.FreePage(pageID))
+
+		// 古いメタ情報を書き込んでも、空きページリストは失われない
+		meta := &Meta{Version: FormatVersion, PageSize: 4096, RootID: PageID(-1), FreeListHead: PageID(-1)}
+		assert.NoError(fm.WriteMeta(meta))
+		meta, err = fm.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(pageID, meta.FreeListHead)
+	})
+
+	t.Run("Error Handling", func(t *testing.T) {
+		fm, err := NewFileManager(t.TempDir() + "/dbfile")
+		assert.NoError(err)
+		defer fm.Heap.Close()
+
+		// メタページは解放できない
+		err = fm.FreePage(MetaPageID)
+		assert.Error(err)
+		assert.Equal("メタページは解放できません。ページID: 0", err.Error())
+
+		// 割り当てられていないページは解放できない
+		err = fm.FreePage(PageID(5))
+		assert.Error(err)
+		assert.Equal("ページIDが無効です。指定されたページID: 5", err.Error())
+	})
+}
+
+//=================================================================================
+
+func TestConcurrentReadWrite(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	fm, err := NewFileManager(t.TempDir() + "/dbfile")
+	assert.NoError(err)
+	defer fm.Heap.Close()
+
+	// 複数のゴルーチンから同時にページを割り当て、書き込み、読み込む
+	goroutineNum := 16
+	pageNum := 8
+	var wg sync.WaitGroup
+	pageIDs := make([][]PageID, goroutineNum)
+	for g := range goroutineNum {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pageNum {
+				pageID, err := fm.AllocPage()
+				assert.NoError(err)
+				pageIDs[g] = append(pageIDs[g], pageID)
+
+				data := bytes.Repeat([]byte{byte(g*pageNum + i)}, 4096)
+				assert.NoError(fm.WritePage(pageID, data))
+			}
+			for i, pageID := range pageIDs[g] {
+				readData := make([]byte, 4096)
+				assert.NoError(fm.ReadPage(pageID, readData))
+				want := bytes.Repeat([]byte{byte(g*pageNum + i)}, 4096)
+				clear(want[ChecksumOffset : ChecksumOffset+4])
+				assert.Equal(want, readData)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 割り当てられたページIDは重複しない
+	seen := make(map[PageID]bool)
+	for _, ids := range pageIDs {
+		for _, pageID := range ids {
+			assert.False(seen[pageID])
+			seen[pageID] = true
+		}
+	}
+	assert.Len(seen, goroutineNum*pageNum)
+	assert.Equal(PageID(goroutineNum*pageNum+1), fm.NextID)
+}
+
+//=================================================================================
+
+func TestChecksum(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	// ページを書き込んだ後、ファイル上の1バイトを書き換える
+	corrupt := func(t *testing.T, fm *FileManager, pageID PageID) {
+		_, err := fm.Heap.WriteAt([]byte{0xFF}, int64(pageID)*4096+100)
+		assert.NoError(err)
+	}
+
+	t.Run("Detect Corruption", func(t *testing.T) {
+		fm, err := NewFileManager(t.TempDir() + "/dbfile")
+		assert.NoError(err)
+		defer fm.Heap.Close()
+
+		pageID, err := fm.AllocPage()
+		assert.NoError(err)
+		data := make([]byte, 4096)
+		copy(data, "Hello")
+		assert.NoError(fm.WritePage(pageID, data))
+		corrupt(t, fm, pageID)
+
+		// 壊れたページは読み込めず、エラーから壊れたページIDを取り出せる
+		err = fm.ReadPage(pageID, make([]byte, 4096))
+		assert.ErrorIs(err, ErrChecksumMismatch)
+		var checksumErr *ChecksumError
+		assert.ErrorAs(err, &checksumErr)
+		assert.Equal(pageID, checksumErr.PageID)
+		assert.NotEqual(checksumErr.Stored, checksumErr.Computed)
+	})
+
+	t.Run("Unwritten Page", func(t *testing.T) {
+		fm, err := NewFileManager(t.TempDir() + "/dbfile")
+		assert.NoError(err)
+		defer fm.Heap.Close()
+
+		// 後ろのページだけ書き込むと、前のページは一度も書き込まれていない（すべて0の）ページになる
+		unwritten, err := fm.AllocPage()
+		assert.NoError(err)
+		pageID, err := fm.AllocPage()
+		assert.NoError(err)
+		assert.NoError(fm.WritePage(pageID, make([]byte, 4096)))
+
+		readData := make([]byte, 4096)
+		assert.NoError(fm.ReadPage(unwritten, readData))
+		assert.Equal(make([]byte, 4096), readData)
+	})
+
+	t.Run("Corrupted Meta", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+		corrupt(t, fm, MetaPageID)
+		assert.NoError(fm.Heap.Close())
+
+		// メタページが壊れたファイルは開けない
+		_, err = NewFileManager(testPath)
+		assert.ErrorIs(err, ErrChecksumMismatch)
+	})
+
+	t.Run("Ignore Checksums", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+		pageID, err := fm.AllocPage()
+		assert.NoError(err)
+		data := make([]byte, 4096)
+		copy(data, "Hello")
+		assert.NoError(fm.WritePage(pageID, data))
+		corrupt(t, fm, pageID)
+		corrupt(t, fm, MetaPageID)
+		assert.NoError(fm.Heap.Close())
+
+		// チェックサムを検証しなければ、壊れたファイルからも読み込める
+		fm, err = NewFileManager(testPath, WithIgnoreChecksums())
+		assert.NoError(err)
+		defer fm.Heap.Close()
+		readData := make([]byte, 4096)
+		assert.NoError(fm.ReadPage(pageID, readData))
+		assert.Equal([]byte("Hello"), readData[:5])
+		assert.Equal(byte(0xFF), readData[100])
+	})
+}
+
+//=================================================================================
+
+func TestPageSize(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Create and Reopen", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath, WithPageSize(16384))
+		assert.NoError(err)
+		assert.Equal(16384, fm.PageSize())
+
+		pageID, err := fm.AllocPage()
+		assert.NoError(err)
+		data := make([]byte, 16384)
+		copy(data[16000:], "Hello")
+		assert.NoError(fm.WritePage(pageID, data))
+
+		// ページサイズと異なる大きさのデータは読み書きできない
+		err = fm.WritePage(pageID, make([]byte, 4096))
+		assert.Error(err)
+		assert.Equal("不正なページサイズが指定されました。現在のサイズ: 4096 バイト, 要求される正確なサイズ: 16384 バイト", err.Error())
+		assert.NoError(fm.Heap.Close())
+
+		info, err := os.Stat(testPath)
+		assert.NoError(err)
+		assert.Equal(int64(16384*2), info.Size())
+
+		// 再オープン時は、オプションに関わらずメタページに記録されたページサイズを使用する
+		fm, err = NewFileManager(testPath, WithPageSize(8192))
+		assert.NoError(err)
+		defer fm.Heap.Close()
+		assert.Equal(16384, fm.PageSize())
+		assert.Equal(PageID(2), fm.NextID)
+		meta, err := fm.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(uint32(16384), meta.PageSize)
+
+		readData := make([]byte, 16384)
+		assert.NoError(fm.ReadPage(pageID, readData))
+		assert.Equal(data, readData)
+
+		// 空きページリストもページサイズに従う
+		assert.NoError(fm.FreePage(pageID))
+		reused, err := fm.AllocPage()
+		assert.NoError(err)
+		assert.Equal(pageID, reused)
+	})
+
+	t.Run("Error Handling: Invalid Page Size", func(t *testing.T) {
+		for _, pageSize := range []int{0, 1024, 6000, 65536} {
+			_, err := NewFileManager(t.TempDir()+"/dbfile", WithPageSize(pageSize))
+			assert.Error(err)
+		}
+		_, err := NewFileManager(t.TempDir()+"/dbfile", WithPageSize(6000))
+		assert.Equal("ページサイズが不正です。4096 から 32768 までの2のべき乗を指定してください。指定されたサイズ: 6000 バイト", err.Error())
+	})
+}
+
+//=================================================================================
+
+func TestHeader(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	// ファイルヘッダの指定位置を書き換える
+	overwrite := func(t *testing.T, testPath string, offset int64, data []byte) {
+		heap, err := os.OpenFile(testPath, os.O_RDWR, 0)
+		assert.NoError(err)
+		_, err = heap.WriteAt(data, offset)
+		assert.NoError(err)
+		assert.NoError(heap.Close())
+	}
+
+	t.Run("Create and Reopen", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+		assert.NoError(fm.Heap.Close())
+
+		// ファイルの先頭はマジックナンバー
+		data, err := os.ReadFile(testPath)
+		assert.NoError(err)
+		assert.Equal([]byte("CHIBIDB\x00"), data[0:8])
+
+		// 作成時刻と機能フラグは再オープン後も保持される
+		fm, err = NewFileManager(testPath)
+		assert.NoError(err)
+		defer fm.Heap.Close()
+		meta, err := fm.ReadMeta()
+		assert.NoError(err)
+		assert.WithinDuration(time.Now(), meta.CreatedAt, time.Minute)
+		assert.Equal(IncompatChecksums, meta.IncompatFeatures)
+		assert.Equal(uint32(0), meta.CompatFeatures)
+
+		createdAt := meta.CreatedAt
+		assert.NoError(fm.WriteMeta(&Meta{RootID: PageID(7)}))
+		meta, err = fm.ReadMeta()
+		assert.NoError(err)
+		assert.True(createdAt.Equal(meta.CreatedAt))
+		assert.Equal(FormatVersion, meta.Version)
+		assert.Equal(PageID(7), meta.RootID)
+	})
+
+	t.Run("Error Handling: Foreign File", func(t *testing.T) {
+		// ページサイズの倍数の大きさでも、マジックナンバーがなければ開かない
+		testPath := t.TempDir() + "/foreign"
+		assert.NoError(os.WriteFile(testPath, bytes.Repeat([]byte("not a database. "), 512), 0644))
+		_, err := NewFileManager(testPath)
+		assert.ErrorIs(err, ErrNotDatabase)
+		assert.Equal(`データベースファイルではありません。マジックナンバーが一致しません。先頭のバイト列: "not a da"`, err.Error())
+
+		// ファイルヘッダより小さいファイル
+		testPath = t.TempDir() + "/short"
+		assert.NoError(os.WriteFile(testPath, []byte("CHIBIDB"), 0644))
+		_, err = NewFileManager(testPath)
+		assert.ErrorIs(err, ErrNotDatabase)
+	})
+
+	t.Run("Error Handling: Old Version", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+		assert.NoError(fm.Heap.Close())
+		overwrite(t, testPath, 8, binary.LittleEndian.AppendUint32(nil, FormatVersion-1))
+
+		_, err = NewFileManager(testPath)
+		assert.ErrorIs(err, ErrUnsupportedVersion)
+		assert.Equal("対応していないファイルフォーマットのバージョンです。古いバージョンで作成されたファイルです。扱えるバージョン: 6, ファイルのバージョン: 5", err.Error())
+	})
+
+	t.Run("Feature Flags", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+		assert.NoError(fm.Heap.Close())
+
+		// 知らない互換性のある機能フラグは、開いた後も書き換えずに残す
+		// ヘッダはチェックサムより先に検証するので、チェックサムは検証しない
+		overwrite(t, testPath, 24, binary.LittleEndian.AppendUint32(nil, 1<<5))
+		fm, err = NewFileManager(testPath, WithIgnoreChecksums())
+		assert.NoError(err)
+		assert.NoError(fm.WriteMeta(&Meta{RootID: PageID(-1)}))
+		assert.NoError(fm.Heap.Close())
+		fm, err = NewFileManager(testPath)
+		assert.NoError(err)
+		meta, err := fm.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(uint32(1<<5), meta.CompatFeatures)
+		assert.NoError(fm.Heap.Close())
+
+		// 知らない互換性のない機能フラグが立っているファイルは開かない
+		overwrite(t, testPath, 28, binary.LittleEndian.AppendUint32(nil, IncompatChecksums|1<<3))
+		_, err = NewFileManager(testPath)
+		assert.ErrorIs(err, ErrIncompatibleFeatures)
+		assert.Equal("対応していない機能を使用しているファイルです。未対応の機能フラグ: 0x8", err.Error())
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	// ページを1つ書き込んだファイルを作成
+	setup := func(t *testing.T) (string, PageID) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+		pageID, err := fm.AllocPage()
+		assert.NoError(err)
+		data := make([]byte, DefaultPageSize)
+		copy(data[100:], "hello")
+		assert.NoError(fm.WritePage(pageID, data))
+		assert.NoError(fm.WriteMeta(&Meta{RootID: pageID}))
+		assert.NoError(fm.Close())
+		return testPath, pageID
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"File", []Option{WithReadOnly()}},
+		{"Mmap", []Option{WithReadOnly(), WithMmap()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testPath, pageID := setup(t)
+			before, err := os.ReadFile(testPath)
+			assert.NoError(err)
+
+			fm, err := NewFileManager(testPath, tc.opts...)
+			assert.NoError(err)
+
+			// 読み込みはできる
+			buf := make([]byte, DefaultPageSize)
+			assert.NoError(fm.ReadPage(pageID, buf))
+			assert.Equal([]byte("hello"), buf[100:105])
+			meta, err := fm.ReadMeta()
+			assert.NoError(err)
+			assert.Equal(pageID, meta.RootID)
+
+			// 書き込みはすべてErrReadOnly
+			assert.ErrorIs(fm.WritePage(pageID, buf), ErrReadOnly)
+			_, err = fm.AllocPage()
+			assert.ErrorIs(err, ErrReadOnly)
+			assert.ErrorIs(fm.FreePage(pageID), ErrReadOnly)
+			assert.ErrorIs(fm.WriteMeta(meta), ErrReadOnly)
+			assert.NoError(fm.Sync())
+			assert.NoError(fm.Close())
+
+			// ファイルは変更されない
+			after, err := os.ReadFile(testPath)
+			assert.NoError(err)
+			assert.Equal(before, after)
+		})
+	}
+
+	t.Run("Missing or Empty File", func(t *testing.T) {
+		// 存在しないファイルは作成しない
+		testPath := t.TempDir() + "/dbfile"
+		_, err := NewFileManager(testPath, WithReadOnly())
+		assert.ErrorIs(err, os.ErrNotExist)
+		_, err = os.Stat(testPath)
+		assert.ErrorIs(err, os.ErrNotExist)
+
+		// 空のファイルは初期化しない
+		assert.NoError(os.WriteFile(testPath, nil, 0755))
+		_, err = NewFileManager(testPath, WithReadOnly())
+		assert.ErrorIs(err, ErrNotDatabase)
+		info, err := os.Stat(testPath)
+		assert.NoError(err)
+		assert.Equal(int64(0), info.Size())
+	})
+}
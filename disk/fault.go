@@ -0,0 +1,317 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	// FaultStorageが注入した障害のエラー
+	ErrInjectedFault = errors.New("注入された障害です")
+	// 電源断の後、Crashを呼び出すまで返却するエラー
+	ErrPowerLoss = errors.New("電源断により記憶領域を使用できません")
+)
+
+// 障害の種類
+type faultKind int
+
+const (
+	failRead   faultKind = iota // 読み込みを失敗させる
+	failWrite                   // 書き込みを失敗させる
+	shortWrite                  // ページの先頭だけを書き込んで失敗させる
+	tearWrite                   // ページの先頭だけを書き込んだところで電源断を起こす
+	failAlloc                   // ページの割り当てを失敗させる
+)
+
+// 予約した障害
+type fault struct {
+	kind   faultKind
+	n      int // 何回目の読み込み（書き込み、割り当て）で起こすか（作成時からの通算）
+	offset int // 書き込むバイト数（shortWrite、tearWriteの場合）
+}
+
+// 障害を注入できる、メモリ上の記憶領域
+// クラッシュやI/Oエラーが起きたときの振る舞いをテストするために使用する
+// Syncまでの書き込み（ページ、メタページ、ページの割り当てと解放）は揮発性のキャッシュにあるものとして扱い、Crashで失われる
+// ただし空きページの再利用は、Storageの約束どおりすぐに永続化する
+// 書き込み途中で電源断が起きたページは、ファイルの記憶領域と同じくチェックサムの不一致として読み込みに失敗する
+type FaultStorage struct {
+	mu      sync.Mutex
+	current *MemoryStorage  // 現在の内容（Syncしていない書き込みを含む）
+	durable *MemoryStorage  // 最後にSyncした時点の内容
+	torn    map[PageID]bool // 書き込み途中で電源断が起きたページ
+	faults  []fault         // まだ起きていない障害
+	reads   int             // ReadPageの呼び出し回数
+	writes  int             // WritePageの呼び出し回数
+	allocs  int             // AllocPageの呼び出し回数
+	powered bool            // 電源が入っているか（falseの場合はCrashまですべての操作が失敗する）
+}
+
+// 指定したページサイズのFaultStorageを作成
+func NewFaultStorage(pageSize int) (*FaultStorage, error) {
+	current, err := NewMemoryStorage(pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return &FaultStorage{
+		current: current,
+		durable: current.clone(),
+		torn:    make(map[PageID]bool),
+		powered: true,
+	}, nil
+}
+
+// n回後（1なら次）のReadPageをErrInjectedFaultで失敗させる
+func (f *FaultStorage) FailRead(n int) {
+	f.inject(fault{kind: failRead, n: f.Reads() + n})
+}
+
+// n回後（1なら次）のWritePageをErrInjectedFaultで失敗させる（ページは書き込まれない）
+func (f *FaultStorage) FailWrite(n int) {
+	f.inject(fault{kind: failWrite, n: f.Writes() + n})
+}
+
+// n回後（1なら次）のWritePageで、ページの先頭sizeバイトだけを書き込んでio.ErrShortWriteで失敗させる
+func (f *FaultStorage) ShortWrite(n int, size int) {
+	f.inject(fault{kind: shortWrite, n: f.Writes() + n, offset: size})
+}
+
+// n回後（1なら次）のWritePageで、ページの先頭offsetバイトを書き込んだところで電源断を起こす
+// 書き込んだ部分だけが永続化され、以降の操作はCrashを呼び出すまでErrPowerLossで失敗する
+func (f *FaultStorage) TearWrite(n int, offset int) {
+	f.inject(fault{kind: tearWrite, n: f.Writes() + n, offset: offset})
+}
+
+// n回後（1なら次）のAllocPageをErrInjectedFaultで失敗させる（ページは割り当てられない）
+func (f *FaultStorage) FailAlloc(n int) {
+	f.inject(fault{kind: failAlloc, n: f.Allocs() + n})
+}
+
+func (f *FaultStorage) inject(ft fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, ft)
+}
+
+// 電源断を起こし、Syncしていない書き込みをすべて破棄して最後にSyncした時点の内容に戻す
+// 予約した障害も破棄する
+func (f *FaultStorage) Crash() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.current = f.durable.clone()
+	f.faults = nil
+	f.powered = true
+}
+
+// ReadPageの呼び出し回数を返却
+func (f *FaultStorage) Reads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reads
+}
+
+// WritePageの呼び出し回数を返却
+func (f *FaultStorage) Writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+// AllocPageの呼び出し回数を返却
+func (f *FaultStorage) Allocs() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.allocs
+}
+
+// 指定した回数の操作で起こす障害を取り出す
+// f.muを取得した状態で呼び出すこと
+func (f *FaultStorage) take(n int, kinds ...faultKind) (fault, bool) {
+	for i, ft := range f.faults {
+		for _, kind := range kinds {
+			if ft.kind == kind && ft.n == n {
+				f.faults = append(f.faults[:i], f.faults[i+1:]...)
+				return ft, true
+			}
+		}
+	}
+	return fault{}, false
+}
+
+// 電源断の後であればErrPowerLossを返却
+// f.muを取得した状態で呼び出すこと
+func (f *FaultStorage) check() error {
+	if !f.powered {
+		return ErrPowerLoss
+	}
+	return nil
+}
+
+func (f *FaultStorage) ReadPage(pageID PageID, pageData []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	f.reads++
+	if _, ok := f.take(f.reads, failRead); ok {
+		return fmt.Errorf("%w。ページの読み込みに失敗しました。ページID: %d", ErrInjectedFault, pageID)
+	}
+	if err := f.current.ReadPage(pageID, pageData); err != nil {
+		return err
+	}
+	if f.torn[pageID] {
+		return &ChecksumError{PageID: pageID}
+	}
+	return nil
+}
+
+func (f *FaultStorage) WritePage(pageID PageID, pageData []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	f.writes++
+	ft, ok := f.take(f.writes, failWrite, shortWrite, tearWrite)
+	if !ok {
+		if err := f.current.WritePage(pageID, pageData); err != nil {
+			return err
+		}
+		delete(f.torn, pageID)
+		return nil
+	}
+
+	if ft.kind == failWrite {
+		return fmt.Errorf("%w。ページの書き込みに失敗しました。ページID: %d", ErrInjectedFault, pageID)
+	}
+
+	// ページの先頭だけを書き込む
+	partial := make([]byte, len(pageData))
+	if err := f.current.ReadPage(pageID, partial); err != nil {
+		return err
+	}
+	offset := min(max(ft.offset, 0), len(pageData))
+	copy(partial, pageData[:offset])
+	if err := f.current.WritePage(pageID, partial); err != nil {
+		return err
+	}
+
+	if ft.kind == shortWrite {
+		return fmt.Errorf("%w。%w。ページID: %d, 書き込んだサイズ: %d バイト", ErrInjectedFault, io.ErrShortWrite, pageID, offset)
+	}
+
+	// 書き込み途中のページだけが永続化された状態で電源断
+	f.durable.Extend(pageID)
+	if err := f.durable.WritePage(pageID, partial); err != nil {
+		return err
+	}
+	f.torn[pageID] = true
+	f.powered = false
+	return ErrPowerLoss
+}
+
+func (f *FaultStorage) AllocPage() (PageID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return PageID(-1), err
+	}
+	f.allocs++
+	if _, ok := f.take(f.allocs, failAlloc); ok {
+		return PageID(-1), fmt.Errorf("%w。ページの割り当てに失敗しました", ErrInjectedFault)
+	}
+	pageID, err := f.current.AllocPage()
+	if err != nil {
+		return PageID(-1), err
+	}
+	// 空きページの再利用はすぐに永続化する
+	f.durable.reserve(pageID)
+	return pageID, nil
+}
+
+func (f *FaultStorage) FreePage(pageID PageID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.current.FreePage(pageID)
+}
+
+func (f *FaultStorage) FreePages() ([]PageID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.current.FreePages()
+}
+
+func (f *FaultStorage) Extend(pageID PageID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.check() == nil {
+		f.current.Extend(pageID)
+	}
+}
+
+func (f *FaultStorage) ReadMeta() (*Meta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.current.ReadMeta()
+}
+
+func (f *FaultStorage) WriteMeta(meta *Meta) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.current.WriteMeta(meta)
+}
+
+func (f *FaultStorage) NumPages() PageID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current.NumPages()
+}
+
+func (f *FaultStorage) PageSize() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current.PageSize()
+}
+
+// 現在の内容を永続化する
+func (f *FaultStorage) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	f.durable = f.current.clone()
+	return nil
+}
+
+// 内容は破棄しないので、閉じた後も同じFaultStorageで開き直せる
+func (f *FaultStorage) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.check()
+}
@@ -0,0 +1,241 @@
+package disk
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultStorage(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	page := func(s string) []byte {
+		data := make([]byte, DefaultPageSize)
+		for i := range data {
+			data[i] = s[i%len(s)]
+		}
+		return data
+	}
+	setup := func(t *testing.T) (*FaultStorage, PageID) {
+		f, err := NewFaultStorage(DefaultPageSize)
+		assert.NoError(err)
+		pageID, err := f.AllocPage()
+		assert.NoError(err)
+		assert.NoError(f.WritePage(pageID, page("a")))
+		assert.NoError(f.Sync())
+		return f, pageID
+	}
+
+	t.Run("Fail Nth Read and Write", func(t *testing.T) {
+		f, pageID := setup(t)
+		buf := make([]byte, DefaultPageSize)
+
+		f.FailRead(2)
+		assert.NoError(f.ReadPage(pageID, buf))
+		assert.ErrorIs(f.ReadPage(pageID, buf), ErrInjectedFault)
+		assert.NoError(f.ReadPage(pageID, buf))
+
+		// 失敗した書き込みはページを変更しない
+		f.FailWrite(1)
+		assert.ErrorIs(f.WritePage(pageID, page("b")), ErrInjectedFault)
+		assert.NoError(f.ReadPage(pageID, buf))
+		assert.Equal(page("a"), buf)
+		assert.NoError(f.WritePage(pageID, page("b")))
+		assert.Equal(3, f.Writes())
+	})
+
+	t.Run("Fail Alloc", func(t *testing.T) {
+		f, pageID := setup(t)
+
+		// 失敗した割り当てはページ数を変えない
+		f.FailAlloc(1)
+		_, err := f.AllocPage()
+		assert.ErrorIs(err, ErrInjectedFault)
+		assert.Equal(PageID(2), f.NumPages())
+		newPageID, err := f.AllocPage()
+		assert.NoError(err)
+		assert.Equal(pageID+1, newPageID)
+	})
+
+	t.Run("Short Write", func(t *testing.T) {
+		f, pageID := setup(t)
+
+		f.ShortWrite(1, 100)
+		err := f.WritePage(pageID, page("b"))
+		assert.ErrorIs(err, ErrInjectedFault)
+		assert.ErrorIs(err, io.ErrShortWrite)
+
+		buf := make([]byte, DefaultPageSize)
+		assert.NoError(f.ReadPage(pageID, buf))
+		assert.Equal(page("b")[:100], buf[:100])
+		assert.Equal(page("a")[100:], buf[100:])
+	})
+
+	t.Run("Crash Drops Unsynced Writes", func(t *testing.T) {
+		f, pageID := setup(t)
+		assert.NoError(f.WritePage(pageID, page("b")))
+		newPageID, err := f.AllocPage()
+		assert.NoError(err)
+		assert.NoError(f.WriteMeta(&Meta{RootID: newPageID}))
+
+		f.Crash()
+
+		buf := make([]byte, DefaultPageSize)
+		assert.NoError(f.ReadPage(pageID, buf))
+		assert.Equal(page("a"), buf)
+		assert.Equal(PageID(2), f.NumPages())
+		meta, err := f.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(PageID(-1), meta.RootID)
+	})
+
+	t.Run("Tear Write", func(t *testing.T) {
+		f, pageID := setup(t)
+		otherID, err := f.AllocPage()
+		assert.NoError(err)
+		assert.NoError(f.WritePage(otherID, page("c")))
+
+		// 電源断の後はCrashまですべての操作が失敗する
+		f.TearWrite(1, 100)
+		assert.ErrorIs(f.WritePage(pageID, page("b")), ErrPowerLoss)
+		buf := make([]byte, DefaultPageSize)
+		assert.ErrorIs(f.ReadPage(pageID, buf), ErrPowerLoss)
+		assert.ErrorIs(f.Sync(), ErrPowerLoss)
+
+		// 書き込み途中のページはチェックサムの不一致になり、Syncしていない書き込みは失われる
+		f.Crash()
+		err = f.ReadPage(pageID, buf)
+		assert.ErrorIs(err, ErrChecksumMismatch)
+		assert.Equal(page("b")[:100], buf[:100])
+		assert.Equal(page("a")[100:], buf[100:])
+		assert.Equal(PageID(2), f.NumPages())
+
+		// 書き直せば読み込める
+		assert.NoError(f.WritePage(pageID, page("d")))
+		assert.NoError(f.ReadPage(pageID, buf))
+		assert.Equal(page("d"), buf)
+	})
+
+	t.Run("Reused Free Page Survives Crash", func(t *testing.T) {
+		f, pageID := setup(t)
+		assert.NoError(f.FreePage(pageID))
+		assert.NoError(f.Sync())
+
+		// 空きページの再利用は、Syncしなくても失われない
+		reusedID, err := f.AllocPage()
+		assert.NoError(err)
+		assert.Equal(pageID, reusedID)
+		f.Crash()
+
+		freePageIDs, err := f.FreePages()
+		assert.NoError(err)
+		assert.Empty(freePageIDs)
+	})
+}
+
+// OSのページキャッシュを再現するファイル
+// ページの書き込みはSyncまでメモリ上に溜まり、電源断ではその一部だけがファイルに届く
+type cacheFile struct {
+	heapFile
+	pending map[int64][]byte // Syncしていないページの書き込み（オフセットごと）
+	mu      sync.Mutex
+}
+
+func newCacheFile(file heapFile) *cacheFile {
+	return &cacheFile{heapFile: file, pending: make(map[int64][]byte)}
+}
+
+func (c *cacheFile) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if data, ok := c.pending[off]; ok && len(data) == len(p) {
+		return copy(p, data), nil
+	}
+	return c.heapFile.ReadAt(p, off)
+}
+
+func (c *cacheFile) WriteAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[off] = append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (c *cacheFile) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.flush(func(int64) bool { return true }); err != nil {
+		return err
+	}
+	return c.heapFile.Sync()
+}
+
+// 電源断を起こし、Syncしていない書き込みのうちkeepが真を返却したものだけをファイルに書き込む
+func (c *cacheFile) crash(keep func(off int64) bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush(keep)
+}
+
+// c.muを取得した状態で呼び出すこと
+func (c *cacheFile) flush(keep func(off int64) bool) error {
+	for off, data := range c.pending {
+		if keep(off) {
+			if _, err := c.heapFile.WriteAt(data, off); err != nil {
+				return err
+			}
+		}
+	}
+	clear(c.pending)
+	return nil
+}
+
+func TestBufferedCrash(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Free Page Before Meta", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath, WithBufferedWrites())
+		assert.NoError(err)
+		data := make([]byte, DefaultPageSize)
+		for i := range data {
+			data[i] = 'x'
+		}
+		var pageIDs []PageID
+		for range 2 {
+			pageID, err := fm.AllocPage()
+			assert.NoError(err)
+			assert.NoError(fm.WritePage(pageID, data))
+			pageIDs = append(pageIDs, pageID)
+		}
+		assert.NoError(fm.Sync())
+
+		// 解放したページの書き込みより先に、メタページだけがファイルに届いた状態で電源断
+		cache := newCacheFile(fm.file)
+		fm.file = cache
+		assert.NoError(fm.FreePage(pageIDs[0]))
+		assert.NoError(cache.crash(func(off int64) bool { return off == int64(MetaPageID)*DefaultPageSize }))
+		assert.NoError(fm.Close())
+
+		// 空きページリストは壊れず、解放したページを再利用できる
+		fm, err = NewFileManager(testPath, WithBufferedWrites())
+		assert.NoError(err)
+		defer fm.Close()
+		freePageIDs, err := fm.FreePages()
+		assert.NoError(err)
+		assert.Equal([]PageID{pageIDs[0]}, freePageIDs)
+		reusedID, err := fm.AllocPage()
+		assert.NoError(err)
+		assert.Equal(pageIDs[0], reusedID)
+		newID, err := fm.AllocPage()
+		assert.NoError(err)
+		assert.Equal(pageIDs[1]+1, newID)
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package disk
+
+import "os"
+
+// flockがないOSではロックしない
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
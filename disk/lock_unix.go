@@ -0,0 +1,35 @@
+//go:build unix
+
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ファイルにアドバイザリロック（flock）をかける関数
+// exclusiveがtrueなら排他ロック、falseなら共有ロックを取得する
+// 他のプロセスが競合するロックを持っている場合は、待たずにErrDatabaseLockedを返却
+func lockFile(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("%w。ファイル: %s", ErrDatabaseLocked, file.Name())
+		}
+		return fmt.Errorf("ファイルのロックに失敗しました。ファイル: %s, エラー詳細: %w", file.Name(), err)
+	}
+	return nil
+}
+
+// lockFileで取得したロックを解放する関数
+func unlockFile(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		return fmt.Errorf("ファイルのロックの解放に失敗しました。ファイル: %s, エラー詳細: %w", file.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+//go:build unix
+
+package disk
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 別プロセスでファイルを開いたままにするヘルパー
+// TestLockから環境変数CHIBIDB_LOCK_HELPERにファイルのパスを指定して起動され、標準入力が閉じられるまでファイルを開き続ける
+func TestLockHelperProcess(t *testing.T) {
+	path := os.Getenv("CHIBIDB_LOCK_HELPER")
+	if path == "" {
+		t.Skip("helper process only")
+	}
+
+	fm, err := NewFileManager(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("locked")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+	fm.Close()
+	os.Exit(0)
+}
+
+func TestLock(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Another Process", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+
+		// 別プロセスでファイルを開く
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+		cmd.Env = append(os.Environ(), "CHIBIDB_LOCK_HELPER="+testPath)
+		stdin, err := cmd.StdinPipe()
+		assert.NoError(err)
+		stdout, err := cmd.StdoutPipe()
+		assert.NoError(err)
+		assert.NoError(cmd.Start())
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		assert.NoError(err)
+		assert.Equal("locked\n", line)
+
+		// 他のプロセスが開いている間は開けない
+		_, err = NewFileManager(testPath)
+		assert.ErrorIs(err, ErrDatabaseLocked)
+
+		// 他のプロセスが閉じれば開ける
+		assert.NoError(stdin.Close())
+		assert.NoError(cmd.Wait())
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+		assert.NoError(fm.Close())
+	})
+
+	t.Run("Same Process", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+
+		// 同じプロセスでも、閉じるまでは開けない
+		_, err = NewFileManager(testPath)
+		assert.ErrorIs(err, ErrDatabaseLocked)
+
+		assert.NoError(fm.Close())
+		fm, err = NewFileManager(testPath)
+		assert.NoError(err)
+		assert.NoError(fm.Close())
+	})
+
+	t.Run("Read Only", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath)
+		assert.NoError(err)
+		assert.NoError(fm.Close())
+
+		// 読み取り専用同士は同時に開ける
+		reader1, err := NewFileManager(testPath, WithReadOnly())
+		assert.NoError(err)
+		reader2, err := NewFileManager(testPath, WithReadOnly())
+		assert.NoError(err)
+
+		// 読み取り専用で開いている間は、書き込み用に開けない
+		_, err = NewFileManager(testPath)
+		assert.ErrorIs(err, ErrDatabaseLocked)
+		assert.NoError(reader1.Close())
+		assert.NoError(reader2.Close())
+
+		// 書き込み用に開いている間は、読み取り専用でも開けない
+		fm, err = NewFileManager(testPath)
+		assert.NoError(err)
+		defer fm.Close()
+		_, err = NewFileManager(testPath, WithReadOnly())
+		assert.ErrorIs(err, ErrDatabaseLocked)
+	})
+}
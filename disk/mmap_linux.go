@@ -0,0 +1,143 @@
+//go:build linux
+
+package disk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// マップする最小のサイズ（ファイルが大きくなるたびにマップし直さないよう、余裕を持ってマップする）
+const minMmapSize = 1 << 20
+
+// メモリマップしたヒープファイル
+// マップはファイルより大きく確保し、ファイルサイズを超える書き込みではファイルを伸ばす
+// マップに収まらなくなったら、2倍の大きさでマップし直す
+type mmapFile struct {
+	file *os.File
+	data []byte       // マップした領域（ファイルの末尾より後ろは読み書きしないこと）
+	size int64        // ファイルサイズ
+	prot int          // マップした領域の保護モード
+	mu   sync.RWMutex // dataとsizeを保護するミューテックス（マップし直す場合は排他で取得）
+}
+
+// writableがfalseの場合は読み込み専用でマップする（書き込むとプロセスが異常終了するので、呼び出し側で防ぐこと）
+func newMmapFile(file *os.File, writable bool) (heapFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &mmapFile{file: file, size: info.Size(), prot: syscall.PROT_READ}
+	if writable {
+		m.prot |= syscall.PROT_WRITE
+	}
+	if err := m.remap(max(m.size, minMmapSize)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 指定したサイズ以上の2のべき乗の大きさでマップし直す関数
+// m.muを排他で取得した状態で呼び出すこと
+func (m *mmapFile) remap(size int64) error {
+	length := int64(minMmapSize)
+	for length < size {
+		length *= 2
+	}
+	data, err := syscall.Mmap(int(m.file.Fd()), 0, int(length), m.prot, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("ファイルのメモリマップに失敗しました。サイズ: %d バイト, エラー詳細: %w", length, err)
+	}
+	if m.data != nil {
+		if err := syscall.Munmap(m.data); err != nil {
+			syscall.Munmap(data)
+			return fmt.Errorf("メモリマップの解除に失敗しました。エラー詳細: %w", err)
+		}
+	}
+	m.data = data
+	return nil
+}
+
+// os.File.ReadAtと同じく、ファイルの末尾を超える場合はio.EOFを返却
+func (m *mmapFile) ReadAt(b []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if off >= m.size {
+		return 0, io.EOF
+	}
+	n := copy(b, m.data[off:m.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mmapFile) WriteAt(b []byte, off int64) (int, error) {
+	end := off + int64(len(b))
+
+	m.mu.RLock()
+	if end > m.size {
+		// ファイルを伸ばしてから書き込む
+		m.mu.RUnlock()
+		if err := m.grow(end); err != nil {
+			return 0, err
+		}
+		m.mu.RLock()
+	}
+	defer m.mu.RUnlock()
+
+	return copy(m.data[off:end], b), nil
+}
+
+// ファイルをsizeまで伸ばし、マップに収まらなければマップし直す関数
+func (m *mmapFile) grow(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if size <= m.size {
+		return nil
+	}
+	if err := m.file.Truncate(size); err != nil {
+		return fmt.Errorf("ファイルの拡張に失敗しました。サイズ: %d バイト, エラー詳細: %w", size, err)
+	}
+	if size > int64(len(m.data)) {
+		if err := m.remap(size); err != nil {
+			return err
+		}
+	}
+	m.size = size
+	return nil
+}
+
+// マップした領域をmsyncでファイルに書き戻し、ファイルサイズも含めて同期する
+func (m *mmapFile) Sync() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.size > 0 {
+		_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&m.data[0])), uintptr(m.size), syscall.MS_SYNC)
+		if errno != 0 {
+			return fmt.Errorf("メモリマップの同期に失敗しました。エラー詳細: %w", errno)
+		}
+	}
+	return m.file.Sync()
+}
+
+// マップを解除してファイルを閉じる
+func (m *mmapFile) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.data != nil {
+		if err := syscall.Munmap(m.data); err != nil {
+			return fmt.Errorf("メモリマップの解除に失敗しました。エラー詳細: %w", err)
+		}
+		m.data = nil
+	}
+	return m.file.Close()
+}
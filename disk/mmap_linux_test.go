@@ -0,0 +1,160 @@
+//go:build linux
+
+package disk
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMmap(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Read and Write", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath, WithMmap())
+		assert.NoError(err)
+
+		// マップの大きさを超えるまでページを書き込む（途中でマップし直す）
+		n := 2*minMmapSize/DefaultPageSize + 10
+		for i := range n {
+			pageID, err := fm.AllocPage()
+			assert.NoError(err)
+			data := make([]byte, DefaultPageSize)
+			copy(data[100:], fmt.Sprintf("page%05d", i))
+			assert.NoError(fm.WritePage(pageID, data))
+		}
+		assert.Greater(len(fm.file.(*mmapFile).data), 2*minMmapSize)
+
+		buf := make([]byte, DefaultPageSize)
+		for i := range n {
+			assert.NoError(fm.ReadPage(PageID(i+1), buf))
+			assert.Equal([]byte(fmt.Sprintf("page%05d", i)), buf[100:109])
+		}
+		assert.NoError(fm.Sync())
+		assert.NoError(fm.Close())
+
+		// ファイルサイズは書き込んだページ数と一致し、通常のFileManagerで読み込める
+		info, err := os.Stat(testPath)
+		assert.NoError(err)
+		assert.Equal(int64(n+1)*DefaultPageSize, info.Size())
+
+		fm, err = NewFileManager(testPath)
+		assert.NoError(err)
+		defer fm.Close()
+		assert.NoError(fm.ReadPage(PageID(n), buf))
+		assert.Equal([]byte(fmt.Sprintf("page%05d", n-1)), buf[100:109])
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath, WithPageSize(8192))
+		assert.NoError(err)
+		pageID, err := fm.AllocPage()
+		assert.NoError(err)
+		data := make([]byte, 8192)
+		copy(data[100:], "hello")
+		assert.NoError(fm.WritePage(pageID, data))
+		assert.NoError(fm.WriteMeta(&Meta{RootID: pageID}))
+		assert.NoError(fm.Close())
+
+		// 既存のファイルをマップして開く
+		fm, err = NewFileManager(testPath, WithMmap())
+		assert.NoError(err)
+		defer fm.Close()
+		assert.Equal(8192, fm.PageSize())
+		meta, err := fm.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(pageID, meta.RootID)
+
+		buf := make([]byte, 8192)
+		assert.NoError(fm.ReadPage(pageID, buf))
+		assert.Equal(data, buf)
+
+		// 空きページリストもマップを通して読み書きする
+		assert.NoError(fm.FreePage(pageID))
+		reusedID, err := fm.AllocPage()
+		assert.NoError(err)
+		assert.Equal(pageID, reusedID)
+	})
+
+	t.Run("Checksum", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		fm, err := NewFileManager(testPath, WithMmap())
+		assert.NoError(err)
+		defer fm.Close()
+		pageID, err := fm.AllocPage()
+		assert.NoError(err)
+		assert.NoError(fm.WritePage(pageID, make([]byte, DefaultPageSize)))
+
+		// ファイルへの書き込みはマップにも反映され、チェックサムで検出される
+		_, err = fm.Heap.WriteAt([]byte{0xFF}, int64(pageID)*DefaultPageSize+100)
+		assert.NoError(err)
+		assert.ErrorIs(fm.ReadPage(pageID, make([]byte, DefaultPageSize)), ErrChecksumMismatch)
+	})
+}
+
+// システムコールで読み書きするファイル（O_SYNC）とメモリマップを比較するベンチマーク
+// go test -bench=Storage ./disk で実行する
+func BenchmarkStorage(b *testing.B) {
+	const pages = 1024
+
+	backends := []struct {
+		name string
+		opts []Option
+	}{
+		{"File", nil},
+		{"Mmap", []Option{WithMmap()}},
+	}
+	for _, backend := range backends {
+		setup := func(b *testing.B) *FileManager {
+			fm, err := NewFileManager(b.TempDir()+"/dbfile", backend.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() { fm.Close() })
+			data := make([]byte, DefaultPageSize)
+			for range pages {
+				pageID, err := fm.AllocPage()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := fm.WritePage(pageID, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			return fm
+		}
+
+		b.Run("Read/"+backend.name, func(b *testing.B) {
+			fm := setup(b)
+			rng := rand.New(rand.NewSource(1))
+			buf := make([]byte, DefaultPageSize)
+			b.SetBytes(DefaultPageSize)
+			b.ResetTimer()
+			for range b.N {
+				if err := fm.ReadPage(PageID(1+rng.Intn(pages)), buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run("Write/"+backend.name, func(b *testing.B) {
+			fm := setup(b)
+			rng := rand.New(rand.NewSource(1))
+			data := make([]byte, DefaultPageSize)
+			b.SetBytes(DefaultPageSize)
+			b.ResetTimer()
+			for range b.N {
+				if err := fm.WritePage(PageID(1+rng.Intn(pages)), data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package disk
+
+import (
+	"errors"
+	"os"
+)
+
+// Linux以外ではメモリマップに対応しない
+func newMmapFile(file *os.File, writable bool) (heapFile, error) {
+	return nil, errors.New("このOSではメモリマップに対応していません")
+}
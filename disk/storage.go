@@ -0,0 +1,240 @@
+package disk
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ページ単位でデータを保存する記憶領域
+// ページIDはメタページ（MetaPageID）を含めて0から順に割り当てる
+// 複数のゴルーチンから同時に呼び出せること
+type Storage interface {
+	// ページデータを読み込む（pageDataはPageSizeの大きさであること）
+	ReadPage(pageID PageID, pageData []byte) error
+	// ページデータを書き込む（pageDataはPageSizeの大きさであること）
+	WritePage(pageID PageID, pageData []byte) error
+	// 新しいページを割り当てる（空きページがあれば再利用する）
+	// 空きページを再利用した場合は、異常終了しても空きページに戻らないよう永続化してから返却すること
+	AllocPage() (PageID, error)
+	// ページを解放し、空きページに戻す（解放したページの内容は失われる）
+	FreePage(pageID PageID) error
+	// 空きページのIDを、次に再利用する順に返却
+	FreePages() ([]PageID, error)
+	// pageIDまでのページが割り当て済みになるよう、ページ数を増やす
+	Extend(pageID PageID)
+	// メタページの情報を返却
+	ReadMeta() (*Meta, error)
+	// メタページの情報を書き込む（RootIDとCheckpointLSN以外は記憶領域が管理する）
+	WriteMeta(meta *Meta) error
+	// 割り当て済みのページ数（メタページを含む）を返却
+	NumPages() PageID
+	// ページサイズを返却
+	PageSize() int
+	// 書き込んだ内容を永続化する
+	Sync() error
+	// 記憶領域を閉じる
+	Close() error
+}
+
+var (
+	_ Storage = (*FileManager)(nil)
+	_ Storage = (*MemoryStorage)(nil)
+	_ Storage = (*FaultStorage)(nil)
+)
+
+// ======================================================================
+
+// メモリ上にページを保存する記憶領域
+// テストや一時的なデータベースのように、ファイルに保存する必要がない場合に使用する
+// 閉じると内容は失われる
+type MemoryStorage struct {
+	pageSize  int
+	pages     [][]byte   // ページIDごとのページデータ（一度も書き込まれていないページはnil）
+	free      []PageID   // 空きページのID（末尾から再利用する）
+	meta      Meta       // メタページの情報
+	createdAt time.Time  // 作成時刻
+	mu        sync.Mutex // pages、free、metaを保護するミューテックス
+}
+
+// 指定したページサイズのMemoryStorageを作成
+func NewMemoryStorage(pageSize int) (*MemoryStorage, error) {
+	if err := validatePageSize(pageSize); err != nil {
+		return nil, err
+	}
+	return &MemoryStorage{
+		pageSize:  pageSize,
+		pages:     make([][]byte, 1), // メタページを予約
+		meta:      Meta{RootID: PageID(-1)},
+		createdAt: time.Now(),
+	}, nil
+}
+
+// ページIDとページデータの大きさを検証する関数
+// m.muを取得した状態で呼び出すこと
+func (m *MemoryStorage) validate(pageID PageID, pageData []byte) error {
+	if len(pageData) != m.pageSize {
+		return fmt.Errorf("不正なページサイズが指定されました。現在のサイズ: %d バイト, 要求される正確なサイズ: %d バイト", len(pageData), m.pageSize)
+	}
+	if pageID < 0 || pageID >= PageID(len(m.pages)) {
+		return fmt.Errorf("ページIDが無効です。指定されたページID: %d", pageID)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) ReadPage(pageID PageID, pageData []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.validate(pageID, pageData); err != nil {
+		return err
+	}
+	if m.pages[pageID] == nil {
+		clear(pageData)
+		return nil
+	}
+	copy(pageData, m.pages[pageID])
+	return nil
+}
+
+func (m *MemoryStorage) WritePage(pageID PageID, pageData []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.validate(pageID, pageData); err != nil {
+		return err
+	}
+	m.pages[pageID] = append(m.pages[pageID][:0], pageData...)
+	return nil
+}
+
+func (m *MemoryStorage) AllocPage() (PageID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if n := len(m.free); n > 0 {
+		pageID := m.free[n-1]
+		m.free = m.free[:n-1]
+		return pageID, nil
+	}
+	m.pages = append(m.pages, nil)
+	return PageID(len(m.pages) - 1), nil
+}
+
+func (m *MemoryStorage) FreePage(pageID PageID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pageID == MetaPageID {
+		return fmt.Errorf("メタページは解放できません。ページID: %d", pageID)
+	}
+	if pageID < 0 || pageID >= PageID(len(m.pages)) {
+		return fmt.Errorf("ページIDが無効です。指定されたページID: %d", pageID)
+	}
+	m.pages[pageID] = nil
+	m.free = append(m.free, pageID)
+	return nil
+}
+
+func (m *MemoryStorage) FreePages() ([]PageID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pageIDs := make([]PageID, 0, len(m.free))
+	for i := len(m.free) - 1; i >= 0; i-- {
+		pageIDs = append(pageIDs, m.free[i])
+	}
+	return pageIDs, nil
+}
+
+func (m *MemoryStorage) Extend(pageID PageID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for PageID(len(m.pages)) <= pageID {
+		m.pages = append(m.pages, nil)
+	}
+}
+
+func (m *MemoryStorage) ReadMeta() (*Meta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta := m.meta
+	meta.Version = FormatVersion
+	meta.PageSize = uint32(m.pageSize)
+	meta.CreatedAt = m.createdAt
+	meta.IncompatFeatures = supportedIncompat
+	meta.FreeListHead = PageID(-1)
+	if n := len(m.free); n > 0 {
+		meta.FreeListHead = m.free[n-1]
+	}
+	return &meta, nil
+}
+
+func (m *MemoryStorage) WriteMeta(meta *Meta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.meta.RootID = meta.RootID
+	m.meta.CheckpointLSN = meta.CheckpointLSN
+	return nil
+}
+
+func (m *MemoryStorage) NumPages() PageID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return PageID(len(m.pages))
+}
+
+func (m *MemoryStorage) PageSize() int {
+	return m.pageSize
+}
+
+// メモリ上の内容は永続化できないので、何もしない
+func (m *MemoryStorage) Sync() error {
+	return nil
+}
+
+// 保存しているページを破棄
+func (m *MemoryStorage) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pages = make([][]byte, 1)
+	m.free = nil
+	return nil
+}
+
+// 内容を複製したMemoryStorageを返却
+func (m *MemoryStorage) clone() *MemoryStorage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pages := make([][]byte, len(m.pages))
+	for i, data := range m.pages {
+		if data != nil {
+			pages[i] = append([]byte(nil), data...)
+		}
+	}
+	return &MemoryStorage{
+		pageSize:  m.pageSize,
+		pages:     pages,
+		free:      append([]PageID(nil), m.free...),
+		meta:      m.meta,
+		createdAt: m.createdAt,
+	}
+}
+
+// 空きページからpageIDを取り除く
+func (m *MemoryStorage) reserve(pageID PageID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, freeID := range m.free {
+		if freeID == pageID {
+			m.free = append(m.free[:i], m.free[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package disk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Read and Write", func(t *testing.T) {
+		m, err := NewMemoryStorage(DefaultPageSize)
+		assert.NoError(err)
+		defer m.Close()
+
+		// メタページが予約されている
+		assert.Equal(PageID(1), m.NumPages())
+
+		pageID, err := m.AllocPage()
+		assert.NoError(err)
+		assert.Equal(PageID(1), pageID)
+
+		// 一度も書き込んでいないページはゼロで埋められている
+		buf := make([]byte, DefaultPageSize)
+		buf[0] = 0xFF
+		assert.NoError(m.ReadPage(pageID, buf))
+		assert.Equal(make([]byte, DefaultPageSize), buf)
+
+		data := make([]byte, DefaultPageSize)
+		copy(data, "hello")
+		assert.NoError(m.WritePage(pageID, data))
+
+		// 書き込んだ後に呼び出し元のバッファを変更しても影響しない
+		data[0] = 'j'
+		assert.NoError(m.ReadPage(pageID, buf))
+		assert.Equal([]byte("hello"), buf[:5])
+	})
+
+	t.Run("Error Handling", func(t *testing.T) {
+		_, err := NewMemoryStorage(1000)
+		assert.Error(err)
+
+		m, err := NewMemoryStorage(DefaultPageSize)
+		assert.NoError(err)
+		defer m.Close()
+
+		buf := make([]byte, DefaultPageSize)
+		assert.Error(m.ReadPage(PageID(5), buf))
+		assert.Error(m.WritePage(PageID(-1), buf))
+		assert.Error(m.ReadPage(MetaPageID, buf[:100]))
+		assert.Error(m.FreePage(MetaPageID))
+	})
+
+	t.Run("Free Pages", func(t *testing.T) {
+		m, err := NewMemoryStorage(DefaultPageSize)
+		assert.NoError(err)
+		defer m.Close()
+
+		for range 3 {
+			_, err := m.AllocPage()
+			assert.NoError(err)
+		}
+		assert.NoError(m.FreePage(PageID(1)))
+		assert.NoError(m.FreePage(PageID(3)))
+
+		// 最後に解放したページから再利用する
+		freePageIDs, err := m.FreePages()
+		assert.NoError(err)
+		assert.Equal([]PageID{3, 1}, freePageIDs)
+		meta, err := m.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(PageID(3), meta.FreeListHead)
+
+		pageID, err := m.AllocPage()
+		assert.NoError(err)
+		assert.Equal(PageID(3), pageID)
+		assert.Equal(PageID(4), m.NumPages())
+
+		m.Extend(PageID(6))
+		assert.Equal(PageID(7), m.NumPages())
+	})
+
+	t.Run("Meta", func(t *testing.T) {
+		m, err := NewMemoryStorage(8192)
+		assert.NoError(err)
+		defer m.Close()
+
+		meta, err := m.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(FormatVersion, meta.Version)
+		assert.Equal(uint32(8192), meta.PageSize)
+		assert.Equal(PageID(-1), meta.RootID)
+		assert.Equal(PageID(-1), meta.FreeListHead)
+		assert.False(meta.CreatedAt.IsZero())
+
+		// RootIDとCheckpointLSNだけが書き込まれる
+		assert.NoError(m.WriteMeta(&Meta{RootID: PageID(2), CheckpointLSN: 10, PageSize: 4096}))
+		meta, err = m.ReadMeta()
+		assert.NoError(err)
+		assert.Equal(PageID(2), meta.RootID)
+		assert.Equal(uint64(10), meta.CheckpointLSN)
+		assert.Equal(uint32(8192), meta.PageSize)
+	})
+}
@@ -2,7 +2,10 @@ package page
 
 import (
 	"encoding/binary"
-	"log"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/yuya-isaka/chibidb/bsearch"
 	"github.com/yuya-isaka/chibidb/disk"
@@ -13,9 +16,33 @@ const (
 	NoneNodeType   string = "        " // 葉ノード、8 bytes
 	LeafNodeType   string = "LEAF    " // 葉ノード、8 bytes
 	BranchNodeType string = "BRANCH  " // 枝ノード、8 bytes
-	MaxPairSize    uint16 = 4064
+	OverflowType   string = "OVERFLOW" // オーバーフローページ、8 bytes
 )
 
+var (
+	// ペアを格納する空き容量がないことを示すエラー
+	ErrPageFull = errors.New("ページに空き容量がありません")
+	// 指定されたスロットが存在しないことを示すエラー
+	ErrSlotOutOfRange = errors.New("スロットの範囲外です")
+	// 指定されたデータ範囲がページに収まらないことを示すエラー
+	ErrInvalidRange = errors.New("データ範囲が不正です")
+)
+
+// ページヘッダ
+// [0:8]   ノードの種類
+// [8:16]  前のページID
+// [16:24] 次のページID
+// [24:26] スロット数
+// [26:28] フリーオフセット
+// [28:36] ページLSN（このページを最後に更新したログレコードのLSN）
+// [36:40] チェックサム（disk.ChecksumOffset、ファイルへの書き込み時にFileManagerが設定する）
+const headerSize uint16 = 40
+
+// pageSizeのページに格納できるペアの最大サイズ（ヘッダとスロット1つ分を差し引いた大きさ）
+func MaxPairSize(pageSize int) uint16 {
+	return uint16(pageSize) - headerSize - 4
+}
+
 type Pair struct {
 	Key   []byte
 	Value []byte
@@ -31,26 +58,76 @@ func NewPair(key []byte, value []byte) *Pair {
 // ==============================================================================
 
 // ストレージの1ページを表す構造体
+// PinCount、PageIDはプールマネージャのロック下で更新される
+// ページデータを複数のゴルーチンから扱う場合は、ラッチを取得してから読み書きすること
 type Page struct {
-	PageID   disk.PageID // ページの一意なID
-	pageData []byte      // ページのデータ内容
-	Counter  uint        // ページの参照数（Clock-Sweepアルゴリズムで使用）
-	Flag     bool        // ページの更新フラグ
+	PageID   disk.PageID  // ページの一意なID
+	pageData []byte       // ページのデータ内容
+	PinCount uint         // ページを使用中の利用者数（0より大きい間はプールから追い出されない）
+	Flag     atomic.Bool  // ページの更新フラグ
+	latch    sync.RWMutex // ページデータを保護するラッチ
 }
 
+// デフォルトのページサイズ（disk.DefaultPageSize）のページを作成
 func NewPage() *Page {
+	return NewPageWithSize(disk.DefaultPageSize)
+}
+
+// 指定したページサイズのページを作成
+// スロットのオフセットと長さは2バイトなので、ページサイズはdisk.MaxPageSize以下であること
+func NewPageWithSize(pageSize int) *Page {
 	return &Page{
 		PageID:   disk.PageID(-1),
-		pageData: make([]byte, 4096),
-		Counter:  0,
-		Flag:     false,
+		pageData: make([]byte, pageSize),
+		PinCount: 0,
 	}
 }
 
+// ページサイズを返却
+func (p *Page) Size() int {
+	return len(p.pageData)
+}
+
+// このページに格納できるペアの最大サイズ
+func (p *Page) MaxPairSize() uint16 {
+	return MaxPairSize(p.Size())
+}
+
+// ページの末尾（フリーオフセットの初期値）
+func (p *Page) end() uint16 {
+	return uint16(len(p.pageData))
+}
+
 func (p *Page) ResetPage() {
 	p.PageID = disk.PageID(-1)
-	p.Counter = 0
-	p.Flag = false
+	p.PinCount = 0
+	p.Flag.Store(false)
+}
+
+// ページデータを読み込むための共有ラッチを取得
+func (p *Page) RLatch() {
+	p.latch.RLock()
+}
+
+// 共有ラッチを解放
+func (p *Page) RUnlatch() {
+	p.latch.RUnlock()
+}
+
+// ページデータを書き換えるための排他ラッチを取得
+func (p *Page) WLatch() {
+	p.latch.Lock()
+}
+
+// 排他ラッチの取得を試み、取得できたかを返却
+// 他の利用者が保持している場合は待たずにfalseを返却する
+func (p *Page) TryWLatch() bool {
+	return p.latch.TryLock()
+}
+
+// 排他ラッチを解放
+func (p *Page) WUnlatch() {
+	p.latch.Unlock()
 }
 
 func (p *Page) ResetPageData() {
@@ -58,12 +135,13 @@ func (p *Page) ResetPageData() {
 	p.SetPrevID(disk.PageID(-1))
 	p.SetNextID(disk.PageID(-1))
 	p.SetPointersNum(0)
-	p.SetFreeOffset(4096)
-	p.SetBody(make([]byte, 4068))
+	p.SetFreeOffset(p.end())
+	p.SetLSN(0)
+	p.setData(headerSize, p.end(), make([]byte, p.end()-headerSize))
 }
 
 func (p *Page) GetAllData() []byte {
-	return p.pageData[0:4096]
+	return p.pageData
 }
 
 func (p *Page) GetNodeType() string {
@@ -71,7 +149,7 @@ func (p *Page) GetNodeType() string {
 }
 
 func (p *Page) SetNodeType(nt string) {
-	p.SetData(0, 8, []byte(nt))
+	p.setData(0, 8, []byte(nt))
 }
 
 func (p *Page) GetPrevID() disk.PageID {
@@ -79,7 +157,7 @@ func (p *Page) GetPrevID() disk.PageID {
 }
 
 func (p *Page) SetPrevID(prevID disk.PageID) {
-	p.SetData(8, 16, util.PageIDTo8Bytes(prevID))
+	p.setData(8, 16, util.PageIDTo8Bytes(prevID))
 }
 
 func (p *Page) GetNextID() disk.PageID {
@@ -87,7 +165,7 @@ func (p *Page) GetNextID() disk.PageID {
 }
 
 func (p *Page) SetNextID(nextID disk.PageID) {
-	p.SetData(16, 24, util.PageIDTo8Bytes(nextID))
+	p.setData(16, 24, util.PageIDTo8Bytes(nextID))
 }
 
 func (p *Page) GetPointersNum() uint16 {
@@ -95,7 +173,7 @@ func (p *Page) GetPointersNum() uint16 {
 }
 
 func (p *Page) SetPointersNum(numPtrs uint16) {
-	p.SetData(24, 26, util.Uint16To2Bytes(numPtrs))
+	p.setData(24, 26, util.Uint16To2Bytes(numPtrs))
 }
 
 func (p *Page) GetFreeOffset() uint16 {
@@ -103,20 +181,28 @@ func (p *Page) GetFreeOffset() uint16 {
 }
 
 func (p *Page) SetFreeOffset(freeOffset uint16) {
-	p.SetData(26, 28, util.Uint16To2Bytes(freeOffset))
+	p.setData(26, 28, util.Uint16To2Bytes(freeOffset))
+}
+
+func (p *Page) GetLSN() uint64 {
+	return binary.LittleEndian.Uint64(p.pageData[28:36])
+}
+
+func (p *Page) SetLSN(lsn uint64) {
+	p.setData(28, 36, util.Uint64To8Bytes(lsn))
 }
 
 func (p *Page) GetBody() []byte {
-	return p.pageData[28:]
+	return p.pageData[headerSize:]
 }
 
-func (p *Page) SetBody(data []byte) {
-	p.SetData(28, 4096, data)
+func (p *Page) SetBody(data []byte) error {
+	return p.SetData(headerSize, p.end(), data)
 }
 
 func (p *Page) GetPair(index uint16) *Pair {
-	offset := binary.LittleEndian.Uint16(p.pageData[28+index*4 : 28+index*4+2])
-	length := binary.LittleEndian.Uint16(p.pageData[28+index*4+2 : 28+index*4+4])
+	offset := binary.LittleEndian.Uint16(p.pageData[headerSize+index*4 : headerSize+index*4+2])
+	length := binary.LittleEndian.Uint16(p.pageData[headerSize+index*4+2 : headerSize+index*4+4])
 
 	// Keyの先頭2バイトにはKeyの長さが格納されている
 	keyStartOffset := offset + 2
@@ -134,52 +220,47 @@ func (p *Page) GetValue(index uint16) []byte {
 }
 
 // 葉ノードにキーと値のペアを挿入する関数
-func (p *Page) InsertPair(index uint16, pair *Pair) {
-	// ペアを挿入する場所が最後の位置より前の場合、ペアをシフトして空きスペースを作る
-	if index < p.GetPointersNum() {
-		p.shiftPairsRight(index)
-	}
-	p.insertPair(index, pair)
+// 空き容量が足りない場合はErrPageFull、indexが末尾より後ろを指している場合はErrSlotOutOfRangeを返却し、ページは変更しない
+func (p *Page) InsertPair(index uint16, pair *Pair) error {
+	return p.insertPair(index, pair)
 }
 
-// 指定されたインデックスから右にペアをシフトする関数
+// 指定されたインデックスから右にスロットポインタをシフトする関数
+// ボディのデータは移動せず、startIndexのスロットが空く
 func (p *Page) shiftPairsRight(startIndex uint16) {
-	lastIndex := p.GetPointersNum() - 1
-	// 最後のペアを一つ後ろに移動
-	p.InsertPair(lastIndex+1, p.GetPair(lastIndex))
-	for j := lastIndex; j > startIndex; j-- {
-		// 右に一つずつペアをシフト
-		p.updatePair(j, p.GetPair(j-1))
-	}
+	num := p.GetPointersNum()
+	p.setData(headerSize+(startIndex+1)*4, headerSize+(num+1)*4, append([]byte(nil), p.pageData[headerSize+startIndex*4:headerSize+num*4]...))
 }
 
+// 指定されたインデックスの右隣から左にスロットポインタをシフトする関数
+// startIndexのスロットは上書きされ、最後のスロットはクリアされる
 func (p *Page) shiftPairsLeft(startIndex uint16) {
-	for j := startIndex; j < p.GetPointersNum(); j++ {
-		if j+1 < p.GetPointersNum() {
-			// 左に一つずつペアをシフト
-			p.updatePair(j, p.GetPair(j+1))
-		} else {
-			// 最後のペアの場合、データをクリア
-			p.SetData(28+j*4, 28+j*4+2, util.Uint16To2Bytes(0))
-			p.SetData(28+j*4+2, 28+j*4+4, util.Uint16To2Bytes(0))
-		}
-	}
+	num := p.GetPointersNum()
+	p.setData(headerSize+startIndex*4, headerSize+(num-1)*4, append([]byte(nil), p.pageData[headerSize+(startIndex+1)*4:headerSize+num*4]...))
+	p.setData(headerSize+(num-1)*4, headerSize+num*4, make([]byte, 4))
 }
 
-func (p *Page) insertPair(index uint16, pair *Pair) {
-	// Keyの長さを格納する2バイトも含める
-	pairSize := uint16(len(pair.Key) + len(pair.Value) + 2)
-	// ポインタのサイズも含める
+func (p *Page) insertPair(index uint16, pair *Pair) error {
+	// indexが末尾より後ろを指している場合
+	if index > p.GetPointersNum() {
+		return fmt.Errorf("%w。インデックス: %d, スロット数: %d", ErrSlotOutOfRange, index, p.GetPointersNum())
+	}
+
+	// Keyの長さを格納する2バイトとポインタのサイズも含める
+	size := len(pair.Key) + len(pair.Value) + 2 + 4
+	if size > int(p.GetTotalFreeNum()) {
+		return fmt.Errorf("%w。必要なサイズ: %d バイト, 空き容量: %d バイト", ErrPageFull, size, p.GetTotalFreeNum())
+	}
+	pairSize := uint16(size - 4)
+
+	// 削除されたペアの領域を詰めれば収まる場合、コンパクションする
 	if p.GetFreeNum() < pairSize+4 {
-		// 手抜き
-		log.Panicf("no free space: got %d, want %d", p.GetFreeOffset(), pairSize)
-		return
+		p.Compact()
 	}
 
-	// もしindexの場所に既にペアが存在している場合、Panic
+	// ペアを挿入する場所が最後の位置より前の場合、スロットポインタをシフトして空きを作る
 	if index < p.GetPointersNum() {
-		log.Panicf("pair already exists at index %d", index)
-		return
+		p.shiftPairsRight(index)
 	}
 
 	// 1. スロット数とフリーオフセット更新
@@ -188,73 +269,103 @@ func (p *Page) insertPair(index uint16, pair *Pair) {
 
 	// 2. スロットポインタ更新
 	// offset
-	p.SetData(28+index*4, 28+index*4+2, util.Uint16To2Bytes(p.GetFreeOffset()))
+	p.setData(headerSize+index*4, headerSize+index*4+2, util.Uint16To2Bytes(p.GetFreeOffset()))
 	// length
-	p.SetData(28+index*4+2, 28+index*4+4, util.Uint16To2Bytes(pairSize))
+	p.setData(headerSize+index*4+2, headerSize+index*4+4, util.Uint16To2Bytes(pairSize))
 
 	// 3. スロットボディ更新
 	// すでにFreeOffsetは更新されているので、その位置にペアを挿入する
 	// keyLength 2byte
-	p.SetData(p.GetFreeOffset(), p.GetFreeOffset()+2, util.Uint16To2Bytes(uint16(len(pair.Key))))
+	p.setData(p.GetFreeOffset(), p.GetFreeOffset()+2, util.Uint16To2Bytes(uint16(len(pair.Key))))
 	// key
-	p.SetData(p.GetFreeOffset()+2, p.GetFreeOffset()+2+uint16(len(pair.Key)), pair.Key)
+	p.setData(p.GetFreeOffset()+2, p.GetFreeOffset()+2+uint16(len(pair.Key)), pair.Key)
 	// value
-	p.SetData(p.GetFreeOffset()+2+uint16(len(pair.Key)), p.GetFreeOffset()+pairSize, pair.Value)
+	p.setData(p.GetFreeOffset()+2+uint16(len(pair.Key)), p.GetFreeOffset()+pairSize, pair.Value)
+	return nil
 }
 
-func (p *Page) updatePair(index uint16, pair *Pair) {
-	// Keyの長さを格納する2バイトも含める
-	pairSize := uint16(len(pair.Key) + len(pair.Value) + 2)
-	// ポインタのサイズも含める
-	if p.GetFreeNum() < pairSize+4 {
-		log.Panicf("no free space: got %d, want %d", p.GetFreeOffset(), pairSize)
-		return
-	}
-
+// 指定されたインデックスのペアを置き換える関数
+// 古いペアの領域はコンパクションで再利用される
+// 空き容量が足りない場合はErrPageFullを返却し、ページは変更しない
+func (p *Page) UpdatePair(index uint16, pair *Pair) error {
 	if index >= p.GetPointersNum() {
-		log.Panicf("pair does not exist at index %d", index)
-		return
+		return fmt.Errorf("%w。インデックス: %d, スロット数: %d", ErrSlotOutOfRange, index, p.GetPointersNum())
 	}
 
-	// 1. スロットポインタ更新
-	// offset
-	p.SetData(28+index*4, 28+index*4+2, util.Uint16To2Bytes(p.GetFreeOffset()))
-	// length
-	p.SetData(28+index*4+2, 28+index*4+4, util.Uint16To2Bytes(pairSize))
+	// 古いペアを削除すると、その領域とスロットポインタの分が空く
+	size := len(pair.Key) + len(pair.Value) + 2 + 4
+	free := int(p.GetTotalFreeNum()) + int(p.pairLength(index)) + 4
+	if size > free {
+		return fmt.Errorf("%w。必要なサイズ: %d バイト, 空き容量: %d バイト", ErrPageFull, size, free)
+	}
 
-	// 2. スロットボディ更新
-	offset := binary.LittleEndian.Uint16(p.pageData[28+index*4 : 28+index*4+2])
-	length := binary.LittleEndian.Uint16(p.pageData[28+index*4+2 : 28+index*4+4])
-	p.SetData(offset, offset+2, util.Uint16To2Bytes(uint16(len(pair.Key))))
-	p.SetData(offset+2, offset+2+uint16(len(pair.Key)), pair.Key)
-	p.SetData(offset+2+uint16(len(pair.Key)), offset+length, pair.Value)
+	if err := p.DeletePair(index); err != nil {
+		return err
+	}
+	return p.insertPair(index, pair)
 }
 
-func (p *Page) DeletePair(index uint16) {
+// 指定されたインデックスのペアを削除する関数
+// indexにペアが存在しない場合はErrSlotOutOfRangeを返却し、ページは変更しない
+func (p *Page) DeletePair(index uint16) error {
 	if index >= p.GetPointersNum() {
-		log.Panicf("pair does not exist at index %d", index)
-		return
+		return fmt.Errorf("%w。インデックス: %d, スロット数: %d", ErrSlotOutOfRange, index, p.GetPointersNum())
 	}
 
-	// 1. スロット数更新
+	// 1. スロットポインタ更新
+	p.shiftPairsLeft(index)
+
+	// 2. スロット数更新
 	p.SetPointersNum(p.GetPointersNum() - 1)
 
-	// 2. フリーオフセット更新
-	// 現状何もしない
-	// オフセットは増やしていく、コンパクションは、後で考える
-	// length := binary.LittleEndian.Uint16(p.pageData[28+index*4+2 : 28+index*4+4])
-	// p.SetFreeOffset(p.GetFreeOffset() + length)
+	// 3. スロットボディ更新
+	// 何もしない
+	// 論理削除（物理的にはデータは残り、InsertPairで領域が足りない場合にコンパクションで回収される）
+	return nil
+}
+
+// 有効なペアをボディの末尾から隙間なく詰め直し、フリーオフセットを戻す関数
+// スロットの順序とヘッダ（ノードの種類、前後のページID、ページLSN）は変わらない
+func (p *Page) Compact() {
+	num := p.GetPointersNum()
+	pairs := make([][]byte, num)
+	for i := uint16(0); i < num; i++ {
+		offset := p.pairOffset(i)
+		pairs[i] = append([]byte(nil), p.pageData[offset:offset+p.pairLength(i)]...)
+	}
 
-	// 3. スロットポインタ更新
-	p.shiftPairsLeft(index)
+	// 空き領域になる部分はゼロで埋める
+	p.setData(headerSize+num*4, p.end(), make([]byte, p.end()-headerSize-num*4))
 
-	// 4. スロットボディ更新
-	// 何もしない
-	// 論理削除（物理的にはデータは残るが、まあよし）
+	freeOffset := p.end()
+	for i, pair := range pairs {
+		freeOffset -= uint16(len(pair))
+		p.setData(headerSize+uint16(i)*4, headerSize+uint16(i)*4+2, util.Uint16To2Bytes(freeOffset))
+		p.setData(freeOffset, freeOffset+uint16(len(pair)), pair)
+	}
+	p.SetFreeOffset(freeOffset)
 }
 
+// フリーオフセットとスロットポインタの間にある、連続した空き容量
 func (p *Page) GetFreeNum() uint16 {
-	return p.GetFreeOffset() - 28 - p.GetPointersNum()*4
+	return p.GetFreeOffset() - headerSize - p.GetPointersNum()*4
+}
+
+// コンパクションで回収できる領域も含めた空き容量
+func (p *Page) GetTotalFreeNum() uint16 {
+	used := uint16(0)
+	for i := uint16(0); i < p.GetPointersNum(); i++ {
+		used += p.pairLength(i)
+	}
+	return p.end() - headerSize - p.GetPointersNum()*4 - used
+}
+
+func (p *Page) pairOffset(index uint16) uint16 {
+	return binary.LittleEndian.Uint16(p.pageData[headerSize+index*4 : headerSize+index*4+2])
+}
+
+func (p *Page) pairLength(index uint16) uint16 {
+	return binary.LittleEndian.Uint16(p.pageData[headerSize+index*4+2 : headerSize+index*4+4])
 }
 
 func (p *Page) GetLimitPairSize() uint16 {
@@ -270,18 +381,23 @@ func (p *Page) SearchKey(key []byte) (uint16, bool) {
 
 // ===================================================================================================
 
-func (p *Page) SetData(start uint16, end uint16, data []byte) {
-	length := uint16(len(data))
-	if end-start != length {
-		log.Panicf("設定しようとしたデータサイズが不正です。データサイズ: %d バイト, 許容される最大サイズ: %d バイト", length, 4096-start)
-		return
+// ページデータの[start:end]にdataを書き込む関数
+// 範囲がページに収まらない場合、またはdataの長さが範囲と一致しない場合はErrInvalidRangeを返却する
+func (p *Page) SetData(start uint16, end uint16, data []byte) error {
+	if int(end) > len(p.pageData) {
+		return fmt.Errorf("%w。指定されたデータ範囲がページサイズを超えています。開始位置: %d, 終了位置: %d, ページサイズ: %d バイト", ErrInvalidRange, start, end, len(p.pageData))
 	}
-
-	if end > 4096 {
-		log.Panicf("指定されたデータ範囲がページサイズを超えています。開始位置: %d, 終了位置: %d, ページサイズ: %d バイト", start, end, len(p.pageData))
-		return
+	if end < start || int(end-start) != len(data) {
+		return fmt.Errorf("%w。設定しようとしたデータサイズが不正です。データサイズ: %d バイト, 開始位置: %d, 終了位置: %d", ErrInvalidRange, len(data), start, end)
 	}
 
-	p.Flag = true
-	copy(p.pageData[start:start+length], data)
+	p.setData(start, end, data)
+	return nil
+}
+
+// 範囲の検査をせずにページデータを書き込む関数
+// ヘッダやスロットなど、範囲がページに収まることが分かっている書き込みに使用する
+func (p *Page) setData(start uint16, end uint16, data []byte) {
+	p.Flag.Store(true)
+	copy(p.pageData[start:end], data)
 }
@@ -12,8 +12,31 @@ func TestNewPage(t *testing.T) {
 	assert.NotNil(t, p)
 	assert.Equal(t, disk.PageID(-1), p.PageID)
 	assert.Equal(t, make([]byte, 4096), p.pageData)
-	assert.Equal(t, uint(0), p.Counter)
-	assert.False(t, p.Flag)
+	assert.Equal(t, uint(0), p.PinCount)
+	assert.False(t, p.Flag.Load())
+}
+
+func TestNewPageWithSize(t *testing.T) {
+	// 最大のページサイズでも、フリーオフセットとスロットでページ全体を扱える
+	p := NewPageWithSize(disk.MaxPageSize)
+	p.ResetPageData()
+	assert.Equal(t, disk.MaxPageSize, p.Size())
+	assert.Equal(t, disk.MaxPageSize, len(p.GetAllData()))
+	assert.Equal(t, uint16(disk.MaxPageSize), p.GetFreeOffset())
+	assert.Equal(t, MaxPairSize(disk.MaxPageSize)+4, p.GetTotalFreeNum())
+
+	// 最大サイズのペアが1つ収まる
+	value := make([]byte, p.MaxPairSize()-2-1)
+	assert.NoError(t, p.InsertPair(0, NewPair([]byte("k"), value)))
+	assert.Equal(t, uint16(0), p.GetTotalFreeNum())
+	assert.Equal(t, value, p.GetValue(0))
+	assert.ErrorIs(t, p.InsertPair(1, NewPair([]byte("x"), nil)), ErrPageFull)
+
+	// 削除した領域はコンパクションで回収される
+	assert.NoError(t, p.DeletePair(0))
+	assert.NoError(t, p.InsertPair(0, NewPair([]byte("a"), make([]byte, 20000))))
+	assert.NoError(t, p.InsertPair(1, NewPair([]byte("b"), make([]byte, 10000))))
+	assert.Equal(t, []byte("b"), p.GetKey(1))
 }
 
 func TestSetDataAndGetAllData(t *testing.T) {
@@ -30,7 +53,7 @@ func TestSetPairAndGetPair(t *testing.T) {
 	key := []byte("key")
 	value := []byte("value")
 	pair := NewPair(key, value)
-	p.InsertPair(0, pair)
+	assert.NoError(t, p.InsertPair(0, pair))
 
 	retrievedPair := p.GetPair(0)
 	assert.Equal(t, key, retrievedPair.Key)
@@ -41,9 +64,13 @@ func TestSetDataOutOfRange(t *testing.T) {
 	p := NewPage()
 	data := []byte("this is a test that exceeds the boundaries of the page data allowed")
 
-	assert.Panics(t, func() {
-		p.SetData(0, uint16(len(p.pageData)+1), data)
-	}, "The code did not panic when it should have")
+	err := p.SetData(0, uint16(len(p.pageData)+1), data)
+	assert.ErrorIs(t, err, ErrInvalidRange)
+
+	// データの長さが範囲と一致しない場合
+	err = p.SetData(0, 10, data)
+	assert.ErrorIs(t, err, ErrInvalidRange)
+	assert.False(t, p.Flag.Load())
 }
 
 func TestSetPairNoFreeSpace(t *testing.T) {
@@ -52,17 +79,17 @@ func TestSetPairNoFreeSpace(t *testing.T) {
 	value := make([]byte, 1100)
 	pair := NewPair(key, value)
 
-	assert.Panics(t, func() {
-		p.InsertPair(0, pair)
-	}, "The code did not panic when the pair was too large to fit in the free space")
+	err := p.InsertPair(0, pair)
+	assert.ErrorIs(t, err, ErrPageFull)
+	assert.Equal(t, uint16(0), p.GetPointersNum())
 }
 
 func TestErrorHandling(t *testing.T) {
 	p := NewPage()
 	data := make([]byte, 4100) // deliberately too large
-	assert.PanicsWithValue(t, "指定されたデータ範囲がページサイズを超えています。開始位置: 0, 終了位置: 4100, ページサイズ: 4096 バイト", func() {
-		p.SetData(0, 4100, data)
-	})
+	err := p.SetData(0, 4100, data)
+	assert.ErrorIs(t, err, ErrInvalidRange)
+	assert.EqualError(t, err, "データ範囲が不正です。指定されたデータ範囲がページサイズを超えています。開始位置: 0, 終了位置: 4100, ページサイズ: 4096 バイト")
 }
 
 func TestSearchKey(t *testing.T) {
@@ -72,8 +99,8 @@ func TestSearchKey(t *testing.T) {
 	key2 := []byte("banana")
 	pair1 := NewPair(key1, []byte("red"))
 	pair2 := NewPair(key2, []byte("yellow"))
-	p.InsertPair(0, pair1)
-	p.InsertPair(1, pair2)
+	assert.NoError(t, p.InsertPair(0, pair1))
+	assert.NoError(t, p.InsertPair(1, pair2))
 
 	index, found := p.SearchKey([]byte("banana"))
 	assert.True(t, found)
@@ -82,3 +109,105 @@ func TestSearchKey(t *testing.T) {
 	_, found = p.SearchKey([]byte("cherry"))
 	assert.False(t, found)
 }
+
+func TestInsertAndDeletePairOrder(t *testing.T) {
+	p := NewPage()
+	p.ResetPageData()
+
+	// 途中への挿入
+	assert.NoError(t, p.InsertPair(0, NewPair([]byte("b"), []byte("2"))))
+	assert.NoError(t, p.InsertPair(0, NewPair([]byte("a"), []byte("1"))))
+	assert.NoError(t, p.InsertPair(2, NewPair([]byte("d"), []byte("4"))))
+	assert.NoError(t, p.InsertPair(2, NewPair([]byte("c"), []byte("3"))))
+
+	assert.Equal(t, uint16(4), p.GetPointersNum())
+	for i, key := range []string{"a", "b", "c", "d"} {
+		assert.Equal(t, []byte(key), p.GetKey(uint16(i)))
+	}
+
+	// 先頭と途中の削除
+	assert.NoError(t, p.DeletePair(0))
+	assert.NoError(t, p.DeletePair(1))
+
+	assert.Equal(t, uint16(2), p.GetPointersNum())
+	assert.Equal(t, []byte("b"), p.GetKey(0))
+	assert.Equal(t, []byte("2"), p.GetValue(0))
+	assert.Equal(t, []byte("d"), p.GetKey(1))
+	assert.Equal(t, []byte("4"), p.GetValue(1))
+
+	assert.ErrorIs(t, p.DeletePair(2), ErrSlotOutOfRange)
+	assert.ErrorIs(t, p.InsertPair(3, NewPair([]byte("e"), []byte("5"))), ErrSlotOutOfRange)
+	assert.ErrorIs(t, p.UpdatePair(2, NewPair([]byte("e"), []byte("5"))), ErrSlotOutOfRange)
+	assert.Equal(t, uint16(2), p.GetPointersNum())
+}
+
+func TestCompact(t *testing.T) {
+	p := NewPage()
+	p.ResetPageData()
+	p.SetNodeType(LeafNodeType)
+	p.SetNextID(disk.PageID(3))
+	p.SetLSN(10)
+	for i, key := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, p.InsertPair(uint16(i), NewPair([]byte(key), []byte(key+"-value"))))
+	}
+	assert.NoError(t, p.DeletePair(1))
+	assert.NoError(t, p.DeletePair(2))
+	free := p.GetTotalFreeNum()
+	assert.Less(t, p.GetFreeNum(), free)
+
+	// 有効なペアとヘッダは変わらず、空き領域は連続する
+	p.Compact()
+	assert.Equal(t, free, p.GetFreeNum())
+	assert.Equal(t, free, p.GetTotalFreeNum())
+	assert.Equal(t, uint16(2), p.GetPointersNum())
+	assert.Equal(t, []byte("a"), p.GetKey(0))
+	assert.Equal(t, []byte("a-value"), p.GetValue(0))
+	assert.Equal(t, []byte("c"), p.GetKey(1))
+	assert.Equal(t, []byte("c-value"), p.GetValue(1))
+	assert.Equal(t, LeafNodeType, p.GetNodeType())
+	assert.Equal(t, disk.PageID(3), p.GetNextID())
+	assert.Equal(t, uint64(10), p.GetLSN())
+}
+
+func TestInsertAndDeleteRepeatedly(t *testing.T) {
+	p := NewPage()
+	p.ResetPageData()
+	value := make([]byte, 1000)
+
+	// 削除した領域はコンパクションで回収されるので、同じページで挿入と削除を繰り返せる
+	for i := range 100 {
+		value[0] = byte(i)
+		assert.NoError(t, p.InsertPair(p.GetPointersNum(), NewPair([]byte("key"), value)))
+		if p.GetPointersNum() == 3 {
+			assert.NoError(t, p.DeletePair(0))
+		}
+	}
+	assert.Equal(t, uint16(2), p.GetPointersNum())
+	assert.Equal(t, byte(98), p.GetValue(0)[0])
+	assert.Equal(t, byte(99), p.GetValue(1)[0])
+
+	// 有効なペアだけで空きが足りない場合はエラー
+	assert.ErrorIs(t, p.InsertPair(0, NewPair([]byte("key"), make([]byte, 2100))), ErrPageFull)
+	assert.Equal(t, uint16(2), p.GetPointersNum())
+}
+
+func TestUpdatePair(t *testing.T) {
+	p := NewPage()
+	p.ResetPageData()
+	assert.NoError(t, p.InsertPair(0, NewPair([]byte("a"), []byte("1"))))
+	assert.NoError(t, p.InsertPair(1, NewPair([]byte("b"), []byte("2"))))
+
+	// 古いペアの領域は再利用されるので、何度でも置き換えられる
+	for i := range 100 {
+		assert.NoError(t, p.UpdatePair(0, NewPair([]byte("a"), make([]byte, 2000+i))))
+	}
+	assert.Equal(t, uint16(2), p.GetPointersNum())
+	assert.Equal(t, []byte("a"), p.GetKey(0))
+	assert.Len(t, p.GetValue(0), 2099)
+	assert.Equal(t, []byte("b"), p.GetKey(1))
+	assert.Equal(t, []byte("2"), p.GetValue(1))
+
+	// 空きが足りない場合はエラーになり、元のペアは残る
+	assert.ErrorIs(t, p.UpdatePair(1, NewPair([]byte("b"), make([]byte, 2000))), ErrPageFull)
+	assert.Equal(t, []byte("2"), p.GetValue(1))
+}
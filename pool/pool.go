@@ -1,131 +1,323 @@
 package pool
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/yuya-isaka/chibidb/disk"
 	"github.com/yuya-isaka/chibidb/page"
+	"github.com/yuya-isaka/chibidb/wal"
 )
 
+// プール内のすべてのページがピンされていて、使用可能なページがない場合のエラー
+var ErrPoolExhausted = errors.New("プール内のすべてのページが使用中です")
+
+// ピンされているページを削除しようとした場合のエラー
+var ErrPagePinned = errors.New("ページはピンされています")
+
 // ページプールとページテーブルを管理
+// 複数のゴルーチンから同時に呼び出せる
+// ページテーブルとページの割り当てはmuで保護し、ページデータは各ページのラッチで保護する
+// ページの更新はTxnでログに記録し、ログに書き込まれるまでページをファイルに書き込まない（WAL）
 type PoolManager struct {
-	fileManager *disk.FileManager    // データのファイルへの保存・読み込みを行うマネージャ
+	storage     disk.Storage         // ページの保存・読み込みを行う記憶領域
 	pool        []*page.Page         // プール内の全ページ
-	sweepIndex  uint                 // 次にプールから削除するページのインデックス
+	replacer    Replacer             // プールから追い出すページを選ぶアルゴリズム
+	ringOwner   []*Strategy          // フレームを使い回しているリング（リングで使い回さないフレームはnil）
 	pageTable   map[disk.PageID]uint // ページIDとプール内のインデックスをマッピングするテーブル
+	mu          sync.Mutex           // ページテーブル、replacer、ringOwner、各ページのピン数を保護するミューテックス
+	wal         *wal.Log             // 先行書き込みログ
+	walPath     string               // ログファイルのパス（ログをファイルに保存しない場合は空）
+	txnLatch    sync.RWMutex         // トランザクション（共有）とチェックポイント（排他）を排他制御するラッチ
+	nextTxnID   atomic.Uint64        // 最後に割り当てたトランザクションID
+	fileOptions []disk.Option        // FileManagerの作成時に渡すオプション（NewPoolManagerWithStorageでは使用しない）
+	logOptions  []wal.Option         // ログを開くときに渡すオプション（NewPoolManagerWithStorageでは使用しない）
+	readOnly    bool                 // 読み取り専用で開いている
+	pendingFree []disk.PageID        // ピンされていたため、コミット後に空きページに戻せなかったページ（muで保護し、チェックポイントで戻す）
+}
+
+// NewPoolManagerの設定を変更するオプション
+type Option func(pm *PoolManager)
+
+// プールから追い出すページを選ぶアルゴリズムを指定するオプション（デフォルトはクロックスイープ）
+func WithReplacer(newReplacer ReplacerFactory) Option {
+	return func(pm *PoolManager) {
+		pm.replacer = newReplacer(uint(len(pm.pool)))
+	}
+}
+
+// 新規ファイルのページサイズを指定するオプション（デフォルトはdisk.DefaultPageSize）
+// 既存のファイルを開く場合は、ファイルに記録されたページサイズを使用する
+func WithPageSize(pageSize int) Option {
+	return func(pm *PoolManager) {
+		pm.fileOptions = append(pm.fileOptions, disk.WithPageSize(pageSize))
+	}
+}
+
+// コミットの永続性を指定するオプション（デフォルトはwal.DurabilityFull）
+// DurabilityFull以外では、ページの書き込みもOSのバッファに溜め、チェックポイント（Sync）でまとめて同期する
+func WithDurability(durability wal.Durability) Option {
+	return func(pm *PoolManager) {
+		pm.logOptions = append(pm.logOptions, wal.WithDurability(durability))
+		if durability != wal.DurabilityFull {
+			pm.fileOptions = append(pm.fileOptions, disk.WithBufferedWrites())
+		}
+	}
+}
+
+// グループコミットで他のコミットを待つ時間と、待たずに同期するログのサイズを指定するオプション
+func WithGroupCommitWindow(window time.Duration, bytes int) Option {
+	return func(pm *PoolManager) {
+		pm.logOptions = append(pm.logOptions, wal.WithGroupCommitWindow(window, bytes))
+	}
+}
+
+// ページの読み書きにファイルのメモリマップを使用するオプション（Linuxのみ）
+func WithMmap() Option {
+	return func(pm *PoolManager) {
+		pm.fileOptions = append(pm.fileOptions, disk.WithMmap())
+	}
+}
+
+// 読み込み時にページのチェックサムを検証しないオプション
+// 壊れたファイルから読み出せるデータを救出する場合に使用する
+func WithIgnoreChecksums() Option {
+	return func(pm *PoolManager) {
+		pm.fileOptions = append(pm.fileOptions, disk.WithIgnoreChecksums())
+	}
 }
 
 // 新しいPoolManagerを作成
-// エラーは起きないはず
-func NewPoolManager(path string, poolNum uint) (*PoolManager, error) {
+// ログファイルは path + ".wal" に作成し、前回正常に閉じられていなければログから更新を復旧する
+func NewPoolManager(path string, poolNum uint, opts ...Option) (*PoolManager, error) {
+	pm := newPoolManager(poolNum, opts)
+	pm.walPath = path + ".wal"
 
-	fm, err := disk.NewFileManager(path)
+	fm, err := disk.NewFileManager(path, pm.fileOptions...)
 	if err != nil {
 		return nil, err
 	}
+	log, err := wal.Open(pm.walPath, pm.logOptions...)
+	if err != nil {
+		fm.Close()
+		return nil, err
+	}
+	if err := pm.open(fm, log); err != nil {
+		log.Close()
+		fm.Close()
+		return nil, err
+	}
+	return pm, nil
+}
 
-	// 一定数のページを持つプールを作成し、各ページを初期化
-	// （辞書アクセスでバグらせないように）
-	pool := make([]*page.Page, 0, poolNum)
-	for range poolNum {
-		pool = append(pool, page.NewPage())
+// 指定した記憶領域とログを使用する新しいPoolManagerを作成
+// ログに残っている更新は記憶領域に復旧する
+// ファイルとログに関するオプション（WithPageSize、WithDurabilityなど）は使用されない（記憶領域とログの作成時に指定すること）
+// 閉じると記憶領域とログも閉じる
+func NewPoolManagerWithStorage(storage disk.Storage, log *wal.Log, poolNum uint, opts ...Option) (*PoolManager, error) {
+	pm := newPoolManager(poolNum, opts)
+	if err := pm.open(storage, log); err != nil {
+		return nil, err
 	}
+	return pm, nil
+}
 
-	return &PoolManager{
-		fileManager: fm,
-		pool:        pool,
-		sweepIndex:  0,
-		pageTable:   make(map[disk.PageID]uint),
-	}, nil
+// オプションを適用したPoolManagerを作成
+// プールの各ページは、記憶領域のページサイズが決まってからopenで初期化する
+func newPoolManager(poolNum uint, opts []Option) *PoolManager {
+	pm := &PoolManager{
+		pool:      make([]*page.Page, poolNum),
+		replacer:  NewClockReplacer(poolNum),
+		ringOwner: make([]*Strategy, poolNum),
+		pageTable: make(map[disk.PageID]uint),
+	}
+	for _, opt := range opts {
+		opt(pm)
+	}
+	return pm
 }
 
-// プールで使用可能なページとそのインデクスを返却
-// クロックスイープアルゴリズム: プールからページを削除するインデックスの探索
-// TODO:改良の余地あり
-func (pm *PoolManager) sweepPage() (*page.Page, uint, error) {
+// 記憶領域とログを設定し、ログから更新を復旧
+func (pm *PoolManager) open(storage disk.Storage, log *wal.Log) error {
+	// 読み取り専用の場合、ログから復旧したページはメモリ上にだけ保持する
+	if pm.readOnly {
+		storage = newOverlayStorage(storage)
+	}
+	pm.storage = storage
+	pm.wal = log
 
-	// ------------------------------------------------------------------
-	for {
-		sweepi := pm.sweepIndex
-		page := pm.pool[sweepi]
+	// 記憶領域のページサイズで各ページを初期化
+	// （辞書アクセスでバグらせないように）
+	for i := range pm.pool {
+		pm.pool[i] = page.NewPageWithSize(storage.PageSize())
+	}
 
-		if page.Counter == 0 {
-			// ページがページテーブルに登録されていれば、登録を削除
-			delete(pm.pageTable, page.PageID)
+	// ログから更新を復旧し、復旧したログを破棄（読み取り専用の場合、ログは残す）
+	if err := pm.recover(); err != nil {
+		return err
+	}
+	if pm.readOnly {
+		return nil
+	}
+	return pm.truncateLog()
+}
 
-			// ページが更新されていれば、その内容をファイルに書き込み
-			if page.Flag {
-				if err := pm.fileManager.WriteData(page.PageID, page.GetAllData()); err != nil {
-					page.Flag = false
-					return nil, 0, err
-				}
-			}
+// プールで使用可能なページとそのインデクスを返却
+// 追い出すページはReplacerが選ぶ（ピンされているページは選ばない）
+// すべてのページがピンされている場合はErrPoolExhaustedを返却
+// 返却したページはReplacerの追い出し対象から外れているので、pinまたはunpinFrameで戻すこと
+// pm.muを取得した状態で呼び出すこと
+func (pm *PoolManager) sweepPage() (*page.Page, uint, error) {
+	poolIndex, ok := pm.replacer.Evict()
+	if !ok {
+		return nil, 0, ErrPoolExhausted
+	}
+	if err := pm.evictPage(poolIndex); err != nil {
+		pm.replacer.Unpin(poolIndex)
+		return nil, 0, err
+	}
 
-			pm.sweepIndex = (sweepi + 1) % uint(len(pm.pool))
+	// このページとインデックス使っていいよー
+	return pm.pool[poolIndex], poolIndex, nil
+}
 
-			// このページとインデックス使っていいよー
-			return page, sweepi, nil
+// ピンされていないフレームのページをプールから取り除く
+// ページが更新されていれば、その内容をファイルに書き込み
+// 更新を記録したログを先にファイルに書き込む（WAL）
+// 書き込みに失敗した場合、更新内容を失わないようページはプールに残す
+// 読み取り専用の場合は、更新されていても書き込まずに破棄する
+// pm.muを取得した状態で呼び出すこと
+func (pm *PoolManager) evictPage(poolIndex uint) error {
+	page := pm.pool[poolIndex]
+	if page.Flag.Load() && !pm.readOnly {
+		if err := pm.wal.Flush(page.GetLSN()); err != nil {
+			return err
 		}
+		if err := pm.storage.WritePage(page.PageID, page.GetAllData()); err != nil {
+			return err
+		}
+	}
 
-		page.Counter--
-		pm.sweepIndex = (sweepi + 1) % uint(len(pm.pool))
+	// ページがページテーブルに登録されていれば、登録を削除
+	delete(pm.pageTable, page.PageID)
+	page.ResetPage()
+	pm.ringOwner[poolIndex] = nil
+	return nil
+}
+
+// ページをピンし、最初のピンであればReplacerの追い出し対象から外す
+// pm.muを取得した状態で呼び出すこと
+func (pm *PoolManager) pin(poolIndex uint) {
+	page := pm.pool[poolIndex]
+	page.PinCount++
+	if page.PinCount == 1 {
+		pm.replacer.Pin(poolIndex)
 	}
 }
 
+// ピンされていないフレームを、Replacerの追い出し対象に戻す
+// pm.muを取得した状態で呼び出すこと
+func (pm *PoolManager) unpinFrame(poolIndex uint) {
+	pm.replacer.Unpin(poolIndex)
+}
+
 // 新しいページを作成し、そのページIDを返却
+// 作成したページはピンされないので、使用する場合はFetchPageで取得すること
 func (pm *PoolManager) CreatePage() (disk.PageID, error) {
+	return pm.CreatePageWithStrategy(nil)
+}
+
+// strategyのリング内のフレームを使い回して、新しいページを作成する関数（strategyがnilの場合はCreatePageと同じ）
+// 一括読み込みで多くのページを作成しても、他のページをプールから追い出さない
+func (pm *PoolManager) CreatePageWithStrategy(strategy *Strategy) (disk.PageID, error) {
+	if pm.readOnly {
+		return disk.PageID(-1), ErrReadOnly
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
 
 	// プールから使用可能なページを取得
-	page, poolIndex, err := pm.sweepPage()
+	page, poolIndex, err := pm.allocFrame(strategy)
 	if err != nil {
 		return disk.PageID(-1), err
 	}
 
-	page.ResetPage()
-	page.ResetPageData() // Flagをtrueにする
-
-	// 新しいページの設定
-	newPageID, err := pm.fileManager.AllocPage()
+	// 新しいページIDを割り当てる
+	// 割り当てに失敗した場合は、フレームを空のまま追い出し対象に戻す（ページIDのない更新済みのページを残さない）
+	newPageID, err := pm.storage.AllocPage()
 	if err != nil {
+		page.ResetPage()
+		pm.unpinFrame(poolIndex)
 		return disk.PageID(-1), err
 	}
+
+	// 新しいページの設定
+	page.ResetPage()
+	page.ResetPageData() // Flagをtrueにする
 	page.PageID = newPageID
 
 	// ページテーブルに登録
 	pm.pageTable[newPageID] = poolIndex
 
+	// 作成したページはピンしないので、追い出し対象に戻す
+	pm.unpinFrame(poolIndex)
+
 	return newPageID, nil
 }
 
 // 指定したページIDのページを取得し返却
+// 取得したページはピンされるので、使用後はUnpinPageで解放すること
+// ファイルからの読み込みもpm.muを取得したまま行う
 func (pm *PoolManager) FetchPage(pageID disk.PageID) (*page.Page, error) {
+	return pm.FetchPageWithStrategy(pageID, nil)
+}
+
+// strategyのリング内のフレームを使い回して、ページを取得する関数（strategyがnilの場合はFetchPageと同じ）
+// プールにないページはリング内のフレームに読み込み、参照を記録しないので、
+// 大きな走査でも他の利用者が使用しているページをプールから追い出さない
+func (pm *PoolManager) FetchPageWithStrategy(pageID disk.PageID, strategy *Strategy) (*page.Page, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
 
-	// 無効なページIDはエラー
-	if pageID <= disk.PageID(-1) || pageID >= pm.fileManager.NextID {
+	// 無効なページIDはエラー（メタページはFileManagerが管理するためプールでは扱わない）
+	if pageID <= disk.MetaPageID || pageID >= pm.storage.NumPages() {
 		return nil, fmt.Errorf("指定されたページIDが無効です。ページID: %d", pageID)
 	}
 
 	// ページテーブルにページIDのページが存在するか確認
 	if poolIndex, ok := pm.pageTable[pageID]; ok {
-		page := pm.pool[poolIndex]
-		page.Counter++   // ページ利用のためカウントを増加
-		return page, nil // 存在すれば、そのページを返却
+		// 他の利用者も使用するページは、リングで使い回さない
+		if strategy == nil || pm.ringOwner[poolIndex] != strategy {
+			pm.ringOwner[poolIndex] = nil
+			pm.replacer.RecordAccess(poolIndex) // ページ利用を記録
+		}
+		pm.pin(poolIndex)              // 使用中のためピン
+		return pm.pool[poolIndex], nil // 存在すれば、そのページを返却
 	}
 
 	// ページテーブルに存在しなければ、プールからページを取得しファイルから内容を読み込み
-	newPage, poolIndex, err := pm.sweepPage()
+	newPage, poolIndex, err := pm.allocFrame(strategy)
 	if err != nil {
 		return nil, err
 	}
 
 	// データ初期化------------------------------------------------------
 	// ファイルからページデータを読み込み
-	if err = pm.fileManager.ReadData(pageID, newPage.GetAllData()); err != nil {
+	if err = pm.storage.ReadPage(pageID, newPage.GetAllData()); err != nil {
+		pm.unpinFrame(poolIndex)
 		return nil, err
 	}
 	newPage.PageID = pageID
-	newPage.Flag = false // データは更新されていないのでfalse
-	newPage.Counter++    // ページ利用のためカウントを増加
+	newPage.Flag.Store(false) // データは更新されていないのでfalse
+	if strategy == nil {
+		pm.replacer.RecordAccess(poolIndex) // ページ利用を記録
+	}
+	pm.pin(poolIndex) // 使用中のためピン
 	//-----------------------------------------------------------------
 
 	// ページテーブルに登録
@@ -134,21 +326,215 @@ func (pm *PoolManager) FetchPage(pageID disk.PageID) (*page.Page, error) {
 	return newPage, nil
 }
 
+// FetchPageで取得したページのピンを解放
+// dirtyがtrueの場合、ページを更新済みとして扱う
+func (pm *PoolManager) UnpinPage(pageID disk.PageID, dirty bool) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	poolIndex, ok := pm.pageTable[pageID]
+	if !ok {
+		return fmt.Errorf("ページがプールに存在しません。ページID: %d", pageID)
+	}
+
+	page := pm.pool[poolIndex]
+	if page.PinCount == 0 {
+		return fmt.Errorf("ページはピンされていません。ページID: %d", pageID)
+	}
+	page.PinCount--
+	if page.PinCount == 0 {
+		pm.unpinFrame(poolIndex)
+	}
+	if dirty {
+		page.Flag.Store(true)
+	}
+
+	return nil
+}
+
+// ページをプールから取り除き、ファイルの空きページとして解放
+// ピンされているページは他の利用者が使用中なので、ErrPagePinnedを返却する
+// 解放したページIDは、後のCreatePageで再利用される
+func (pm *PoolManager) DeletePage(pageID disk.PageID) error {
+	if pm.readOnly {
+		return ErrReadOnly
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if poolIndex, ok := pm.pageTable[pageID]; ok {
+		page := pm.pool[poolIndex]
+		if page.PinCount > 0 {
+			return fmt.Errorf("%w。ページID: %d", ErrPagePinned, pageID)
+		}
+
+		// 更新内容は不要なので書き込まずに破棄
+		delete(pm.pageTable, pageID)
+		page.ResetPage()
+		pm.ringOwner[poolIndex] = nil
+	}
+
+	return pm.storage.FreePage(pageID)
+}
+
+// ページサイズを返却
+func (pm *PoolManager) PageSize() int {
+	return pm.storage.PageSize()
+}
+
+// プールのフレーム数を返却
+func (pm *PoolManager) Size() uint {
+	return uint(len(pm.pool))
+}
+
+// メタページに記録されたルートページIDを返却
+func (pm *PoolManager) RootID() (disk.PageID, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	meta, err := pm.storage.ReadMeta()
+	if err != nil {
+		return disk.PageID(-1), err
+	}
+	return meta.RootID, nil
+}
+
+// メタページのルートページIDを更新
+func (pm *PoolManager) SetRootID(rootID disk.PageID) error {
+	if pm.readOnly {
+		return ErrReadOnly
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	meta, err := pm.storage.ReadMeta()
+	if err != nil {
+		return err
+	}
+	meta.RootID = rootID
+	if err := pm.storage.WriteMeta(meta); err != nil {
+		return err
+	}
+
+	// メタページの更新はログに記録しないので、すぐに永続化する
+	return pm.storage.Sync()
+}
+
 // ページテーブル内の変更されたすべてのページをファイルに書き込み
+// すべての更新がファイルに反映されるので、ログを破棄する（チェックポイント）
 func (pm *PoolManager) Sync() error {
-	for pageId, poolIndex := range pm.pageTable {
-		page := pm.pool[poolIndex]
-		if !page.Flag {
+	// 読み取り専用の場合、変更されたページも書き込まない
+	if pm.readOnly {
+		return nil
+	}
+
+	// 実行中のトランザクションが終わるのを待ち、チェックポイントの間は新しいトランザクションを開始させない
+	pm.txnLatch.Lock()
+	defer pm.txnLatch.Unlock()
+
+	if err := pm.freePending(); err != nil {
+		return err
+	}
+
+	for poolIndex, page := range pm.pool {
+		// 書き込み中に追い出されないよう、対象のページを1つずつピンする
+		// ラッチの取得待ちでpm.muを保持し続けないよう、ロックは先に解放する
+		pm.mu.Lock()
+		if index, ok := pm.pageTable[page.PageID]; !ok || index != uint(poolIndex) || !page.Flag.Load() {
+			pm.mu.Unlock()
 			continue
 		}
-		if err := pm.fileManager.WriteData(pageId, page.GetAllData()); err != nil {
+		pm.pin(uint(poolIndex))
+		pm.mu.Unlock()
+
+		err := pm.flushPage(page)
+		pm.UnpinPage(page.PageID, false)
+		if err != nil {
 			return err
 		}
-		page.Flag = false
 	}
 
 	// ファイル内容をディスクと同期
-	return pm.fileManager.Heap.Sync()
+	if err := pm.storage.Sync(); err != nil {
+		return err
+	}
+
+	return pm.truncateLog()
+}
+
+// コミット後に空きページに戻すページを、次のチェックポイントまで預かる
+func (pm *PoolManager) deferFree(pageID disk.PageID) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.pendingFree = append(pm.pendingFree, pageID)
+}
+
+// 預かったページのうち、ピンが解放されたものを空きページに戻す
+// まだピンされているページは、次のチェックポイントまで預かり続ける
+func (pm *PoolManager) freePending() error {
+	pm.mu.Lock()
+	pageIDs := pm.pendingFree
+	pm.pendingFree = nil
+	pm.mu.Unlock()
+
+	for i, pageID := range pageIDs {
+		err := pm.DeletePage(pageID)
+		if errors.Is(err, ErrPagePinned) {
+			pm.deferFree(pageID)
+			continue
+		}
+		if err != nil {
+			pm.mu.Lock()
+			pm.pendingFree = append(pm.pendingFree, pageIDs[i:]...)
+			pm.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// ログを破棄し、破棄したログの最大LSNをメタページに記録
+// すべての更新がファイルに反映された後で呼び出すこと
+func (pm *PoolManager) truncateLog() error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	meta, err := pm.storage.ReadMeta()
+	if err != nil {
+		return err
+	}
+	meta.CheckpointLSN = max(meta.CheckpointLSN, pm.wal.NextLSN()-1)
+	if err := pm.storage.WriteMeta(meta); err != nil {
+		return err
+	}
+	// ログを破棄する前に、記録したLSNを永続化する
+	// （O_SYNCなしやメモリマップの記憶領域で失われると、異常終了後に割り当てるLSNがページLSNより小さくなり、Redoで更新が反映されない）
+	if err := pm.storage.Sync(); err != nil {
+		return err
+	}
+	return pm.wal.Reset(meta.CheckpointLSN + 1)
+}
+
+// ピンされたページが変更されていれば、共有ラッチを取得してファイルに書き込み
+func (pm *PoolManager) flushPage(page *page.Page) error {
+	if !page.Flag.Load() {
+		return nil
+	}
+
+	page.RLatch()
+	defer page.RUnlatch()
+
+	// 更新を記録したログを先にファイルに書き込む（WAL）
+	if err := pm.wal.Flush(page.GetLSN()); err != nil {
+		return err
+	}
+	if err := pm.storage.WritePage(page.PageID, page.GetAllData()); err != nil {
+		return err
+	}
+	page.Flag.Store(false)
+	return nil
 }
 
 // プールマネージャを閉じ、関連リソースを解放
@@ -158,6 +544,16 @@ func (pm *PoolManager) Close() error {
 		return err
 	}
 
-	// ファイルマネージャを閉じる
-	return pm.fileManager.Heap.Close()
+	// 正常に閉じる場合、ログはすべて破棄済みなので削除
+	if err := pm.wal.Close(); err != nil {
+		return err
+	}
+	if pm.walPath != "" && !pm.readOnly {
+		if err := os.Remove(pm.walPath); err != nil {
+			return err
+		}
+	}
+
+	// 記憶領域を閉じる
+	return pm.storage.Close()
 }
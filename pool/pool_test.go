@@ -1,11 +1,17 @@
 package pool
 
 import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/util"
+	"github.com/yuya-isaka/chibidb/wal"
 )
 
 func createSetPage(pm *PoolManager, start uint, data []byte) (disk.PageID, error) {
@@ -21,6 +27,10 @@ func createSetPage(pm *PoolManager, start uint, data []byte) (disk.PageID, error
 
 	page.SetData(uint16(start), uint16(len(data)), data)
 
+	if err := pm.UnpinPage(pageID, true); err != nil {
+		return disk.PageID(-1), err
+	}
+
 	return pageID, nil
 }
 
@@ -55,8 +65,9 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 		assert.Equal(helloBytes, fetchPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(fetchPage.PageID, false))
 	})
 
 	t.Run("Complex Pool 3", func(t *testing.T) {
@@ -78,8 +89,9 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (hello)
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 		assert.Equal(helloBytes, fetchPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(fetchPage.PageID, false))
 
 		// ======================================================================
 
@@ -94,8 +106,9 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (hello)
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 		assert.Equal(helloBytes, fetchPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(fetchPage.PageID, false))
 
 		// ======================================================================
 
@@ -104,8 +117,9 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (world)
-		assert.Equal(disk.PageID(1), worldID)
+		assert.Equal(disk.PageID(2), worldID)
 		assert.Equal(worldBytes, fetchPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(fetchPage.PageID, false))
 	})
 
 	t.Run("Pool 1", func(t *testing.T) {
@@ -127,8 +141,9 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (hello)
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 		assert.Equal(helloBytes, fetchPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(fetchPage.PageID, false))
 
 		// ======================================================================
 
@@ -141,13 +156,14 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (world)
-		assert.Equal(disk.PageID(1), worldID)
+		assert.Equal(disk.PageID(2), worldID)
 		assert.Equal(worldBytes, fetchPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(fetchPage.PageID, false))
 
 		// ======================================================================
 
-		// helloIDはコピーされているので０のままのはず
-		assert.Equal(disk.PageID(0), helloID)
+		// helloIDはコピーされているので1のままのはず
+		assert.Equal(disk.PageID(1), helloID)
 
 		// helloが格納されているpageIDは変わらない
 		fetchPage, err = poolManager.FetchPage(helloID)
@@ -155,6 +171,7 @@ func TestPool(t *testing.T) {
 
 		// テスト (hello)
 		assert.Equal(helloBytes, fetchPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(fetchPage.PageID, false))
 	})
 
 	t.Run("Pool 2", func(t *testing.T) {
@@ -176,8 +193,9 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (hello)
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 		assert.Equal(helloBytes, fetchPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(fetchPage.PageID, false))
 
 		// ======================================================================
 
@@ -190,8 +208,9 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (world)
-		assert.Equal(disk.PageID(1), worldID)
+		assert.Equal(disk.PageID(2), worldID)
 		assert.Equal(worldBytes, fetchPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(fetchPage.PageID, false))
 
 		// ======================================================================
 
@@ -201,6 +220,7 @@ func TestPool(t *testing.T) {
 
 		// テスト (hello)
 		assert.Equal(helloBytes, fetchPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(fetchPage.PageID, false))
 	})
 
 	t.Run("Fetch Nonexistent Page", func(t *testing.T) {
@@ -228,6 +248,14 @@ func TestPool(t *testing.T) {
 
 		assert.Error(err)
 		assert.Equal("指定されたページIDが無効です。ページID: -1", err.Error())
+
+		// ======================================================================
+
+		// メタページに対してFetchを行います。
+		_, err = poolManager.FetchPage(disk.MetaPageID)
+
+		assert.Error(err)
+		assert.Equal("指定されたページIDが無効です。ページID: 0", err.Error())
 	})
 
 }
@@ -265,6 +293,10 @@ func TestCreateAndFetchPage(t *testing.T) {
 	if page.PageID != pageID {
 		t.Errorf("Failed pageID: %v", err)
 	}
+
+	if err := pm.UnpinPage(pageID, false); err != nil {
+		t.Errorf("Failed to unpin page: %v", err)
+	}
 }
 
 func TestSyncAndClose(t *testing.T) {
@@ -279,6 +311,7 @@ func TestSyncAndClose(t *testing.T) {
 	pageID, _ := pm.CreatePage()
 	page, _ := pm.FetchPage(pageID)
 	page.SetData(0, uint16(0+len("some data")), []byte("some data"))
+	pm.UnpinPage(pageID, true)
 
 	// Sync and close
 	if err := pm.Sync(); err != nil {
@@ -288,3 +321,497 @@ func TestSyncAndClose(t *testing.T) {
 		t.Errorf("Failed to close PoolManager: %v", err)
 	}
 }
+
+func TestRootID(t *testing.T) {
+	dir := t.TempDir()
+
+	pm, err := NewPoolManager(dir+"/dbfile", 10)
+	if err != nil {
+		t.Fatalf("Failed to create PoolManager: %v", err)
+	}
+
+	// 新規ファイルではルートページが存在しない
+	rootID, err := pm.RootID()
+	if err != nil {
+		t.Fatalf("Failed to read root ID: %v", err)
+	}
+	if rootID != disk.PageID(-1) {
+		t.Errorf("Expected root ID -1, got %d", rootID)
+	}
+
+	pageID, err := pm.CreatePage()
+	if err != nil {
+		t.Fatalf("Failed to create page: %v", err)
+	}
+	if err := pm.SetRootID(pageID); err != nil {
+		t.Fatalf("Failed to set root ID: %v", err)
+	}
+	if err := pm.Close(); err != nil {
+		t.Fatalf("Failed to close PoolManager: %v", err)
+	}
+
+	// 再オープンしてもルートページIDが保持されている
+	pm, err = NewPoolManager(dir+"/dbfile", 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen PoolManager: %v", err)
+	}
+	defer pm.Close()
+
+	rootID, err = pm.RootID()
+	if err != nil {
+		t.Fatalf("Failed to read root ID: %v", err)
+	}
+	if rootID != pageID {
+		t.Errorf("Expected root ID %d, got %d", pageID, rootID)
+	}
+}
+
+func TestPinUnpin(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	helloBytes := make([]byte, 4096)
+	copy(helloBytes, "Hello")
+	worldBytes := make([]byte, 4096)
+	copy(worldBytes, "World")
+
+	t.Run("Pinned Page Is Not Evicted", func(t *testing.T) {
+		poolManager, err := NewPoolManager(t.TempDir()+"/dbfile", 2)
+		assert.NoError(err)
+		defer poolManager.Close()
+
+		helloID, err := createSetPage(poolManager, 0, helloBytes)
+		assert.NoError(err)
+
+		// helloをピンしたまま保持
+		helloPage, err := poolManager.FetchPage(helloID)
+		assert.NoError(err)
+		assert.Equal(uint(1), helloPage.PinCount)
+
+		// 何度ページを作成・取得しても、ピンされたhelloは追い出されない
+		for range 10 {
+			worldID, err := createSetPage(poolManager, 0, worldBytes)
+			assert.NoError(err)
+			worldPage, err := poolManager.FetchPage(worldID)
+			assert.NoError(err)
+			assert.Equal(worldBytes, worldPage.GetAllData())
+			assert.NoError(poolManager.UnpinPage(worldID, false))
+
+			assert.Equal(helloID, helloPage.PageID)
+			assert.Equal(helloBytes, helloPage.GetAllData())
+		}
+
+		assert.NoError(poolManager.UnpinPage(helloID, false))
+		assert.Equal(uint(0), helloPage.PinCount)
+	})
+
+	t.Run("Multiple Pins", func(t *testing.T) {
+		poolManager, err := NewPoolManager(t.TempDir()+"/dbfile", 2)
+		assert.NoError(err)
+		defer poolManager.Close()
+
+		helloID, err := createSetPage(poolManager, 0, helloBytes)
+		assert.NoError(err)
+
+		page1, err := poolManager.FetchPage(helloID)
+		assert.NoError(err)
+		page2, err := poolManager.FetchPage(helloID)
+		assert.NoError(err)
+		assert.Same(page1, page2)
+		assert.Equal(uint(2), page1.PinCount)
+
+		assert.NoError(poolManager.UnpinPage(helloID, false))
+		assert.Equal(uint(1), page1.PinCount)
+		assert.NoError(poolManager.UnpinPage(helloID, false))
+		assert.Equal(uint(0), page1.PinCount)
+	})
+
+	t.Run("Unpin Marks Dirty", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		poolManager, err := NewPoolManager(testPath, 1)
+		assert.NoError(err)
+
+		helloID, err := createSetPage(poolManager, 0, helloBytes)
+		assert.NoError(err)
+		assert.NoError(poolManager.Sync())
+
+		// ページを更新済みとして解放すると、追い出し時に書き込まれる
+		helloPage, err := poolManager.FetchPage(helloID)
+		assert.NoError(err)
+		assert.False(helloPage.Flag.Load())
+		copy(helloPage.GetAllData(), worldBytes)
+		assert.NoError(poolManager.UnpinPage(helloID, true))
+		assert.True(helloPage.Flag.Load())
+
+		_, err = createSetPage(poolManager, 0, helloBytes)
+		assert.NoError(err)
+
+		helloPage, err = poolManager.FetchPage(helloID)
+		assert.NoError(err)
+		assert.Equal(worldBytes, helloPage.GetAllData())
+		assert.NoError(poolManager.UnpinPage(helloID, false))
+		assert.NoError(poolManager.Close())
+	})
+
+	t.Run("Error Handling: Unpin", func(t *testing.T) {
+		poolManager, err := NewPoolManager(t.TempDir()+"/dbfile", 2)
+		assert.NoError(err)
+		defer poolManager.Close()
+
+		// プールに存在しないページ
+		err = poolManager.UnpinPage(disk.PageID(999), false)
+		assert.Error(err)
+		assert.Equal("ページがプールに存在しません。ページID: 999", err.Error())
+
+		// ピンされていないページ
+		helloID, err := createSetPage(poolManager, 0, helloBytes)
+		assert.NoError(err)
+		err = poolManager.UnpinPage(helloID, false)
+		assert.Error(err)
+		assert.Equal("ページはピンされていません。ページID: 1", err.Error())
+	})
+}
+
+func TestPoolExhausted(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	helloBytes := make([]byte, 4096)
+	copy(helloBytes, "Hello")
+
+	for poolNum := uint(1); poolNum <= 3; poolNum++ {
+		t.Run(fmt.Sprintf("Pool %d", poolNum), func(t *testing.T) {
+			poolManager, err := NewPoolManager(t.TempDir()+"/dbfile", poolNum)
+			assert.NoError(err)
+			defer poolManager.Close()
+
+			// プールより多くのページを作成しておく
+			pageIDs := make([]disk.PageID, 0, poolNum+1)
+			for range poolNum + 1 {
+				pageID, err := createSetPage(poolManager, 0, helloBytes)
+				assert.NoError(err)
+				pageIDs = append(pageIDs, pageID)
+			}
+
+			// プールのページをすべてピンする（同じページを何度もピンしても良い）
+			for _, pageID := range pageIDs[:poolNum] {
+				for range 3 {
+					_, err := poolManager.FetchPage(pageID)
+					assert.NoError(err)
+				}
+			}
+
+			// 使用可能なページがない
+			_, err = poolManager.CreatePage()
+			assert.ErrorIs(err, ErrPoolExhausted)
+			_, err = poolManager.FetchPage(pageIDs[poolNum])
+			assert.ErrorIs(err, ErrPoolExhausted)
+
+			// ピン済みのページは取得できる
+			fetchPage, err := poolManager.FetchPage(pageIDs[0])
+			assert.NoError(err)
+			assert.Equal(helloBytes, fetchPage.GetAllData())
+			assert.NoError(poolManager.UnpinPage(pageIDs[0], false))
+
+			// 1ページだけピンを完全に解放すると、そのページが使われる
+			last := pageIDs[poolNum-1]
+			for range 3 {
+				assert.NoError(poolManager.UnpinPage(last, false))
+			}
+			fetchPage, err = poolManager.FetchPage(pageIDs[poolNum])
+			assert.NoError(err)
+			assert.Equal(helloBytes, fetchPage.GetAllData())
+
+			// 再びすべてピンされた状態
+			_, err = poolManager.FetchPage(last)
+			assert.ErrorIs(err, ErrPoolExhausted)
+
+			// すべてのピンを解放すれば再び使用できる
+			assert.NoError(poolManager.UnpinPage(pageIDs[poolNum], false))
+			for _, pageID := range pageIDs[:poolNum-1] {
+				for range 3 {
+					assert.NoError(poolManager.UnpinPage(pageID, false))
+				}
+			}
+			for _, pageID := range pageIDs {
+				fetchPage, err := poolManager.FetchPage(pageID)
+				assert.NoError(err)
+				assert.Equal(helloBytes, fetchPage.GetAllData())
+				assert.NoError(poolManager.UnpinPage(pageID, false))
+			}
+		})
+	}
+
+	t.Run("Empty Pool", func(t *testing.T) {
+		poolManager, err := NewPoolManager(t.TempDir()+"/dbfile", 0)
+		assert.NoError(err)
+		defer poolManager.Close()
+
+		_, err = poolManager.CreatePage()
+		assert.ErrorIs(err, ErrPoolExhausted)
+	})
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	goroutineNum := 16
+	poolManager, err := NewPoolManager(t.TempDir()+"/dbfile", uint(goroutineNum+4))
+	assert.NoError(err)
+	defer poolManager.Close()
+
+	// プールより多くのページを作成し、先頭8バイトに自身のページIDを書き込む
+	pageNum := 64
+	pageIDs := make([]disk.PageID, 0, pageNum)
+	for range pageNum {
+		pageID, err := poolManager.CreatePage()
+		assert.NoError(err)
+		fetchPage, err := poolManager.FetchPage(pageID)
+		assert.NoError(err)
+		fetchPage.SetData(0, 8, util.PageIDTo8Bytes(pageID))
+		fetchPage.SetData(8, 16, util.Uint64To8Bytes(0))
+		assert.NoError(poolManager.UnpinPage(pageID, true))
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	// 各ゴルーチンがランダムなページを取得し、排他ラッチでカウンタを増やし、共有ラッチで内容を確認する
+	opNum := 200
+	var wg sync.WaitGroup
+	for g := range goroutineNum {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(g)))
+			for range opNum {
+				pageID := pageIDs[rng.Intn(pageNum)]
+				fetchPage, err := poolManager.FetchPage(pageID)
+				if !assert.NoError(err) {
+					return
+				}
+
+				if rng.Intn(2) == 0 {
+					fetchPage.WLatch()
+					counter := binary.LittleEndian.Uint64(fetchPage.GetAllData()[8:16])
+					fetchPage.SetData(8, 16, util.Uint64To8Bytes(counter+1))
+					fetchPage.WUnlatch()
+					assert.NoError(poolManager.UnpinPage(pageID, true))
+				} else {
+					fetchPage.RLatch()
+					assert.Equal(pageID, util.BytesToPageID(fetchPage.GetAllData()[0:8]))
+					fetchPage.RUnlatch()
+					assert.NoError(poolManager.UnpinPage(pageID, false))
+				}
+			}
+		}()
+	}
+
+	// 同時にページの作成と同期も行う
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 10 {
+			_, err := poolManager.CreatePage()
+			assert.NoError(err)
+			assert.NoError(poolManager.Sync())
+		}
+	}()
+	wg.Wait()
+
+	// 書き込みが失われていないことを確認
+	total := uint64(0)
+	for _, pageID := range pageIDs {
+		fetchPage, err := poolManager.FetchPage(pageID)
+		assert.NoError(err)
+		assert.Equal(pageID, util.BytesToPageID(fetchPage.GetAllData()[0:8]))
+		total += binary.LittleEndian.Uint64(fetchPage.GetAllData()[8:16])
+		assert.NoError(poolManager.UnpinPage(pageID, false))
+	}
+
+	writes := uint64(0)
+	for g := range goroutineNum {
+		rng := rand.New(rand.NewSource(int64(g)))
+		for range opNum {
+			rng.Intn(pageNum)
+			if rng.Intn(2) == 0 {
+				writes++
+			}
+		}
+	}
+	assert.Equal(writes, total)
+}
+
+func TestDeletePage(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+	pm, err := NewPoolManager(t.TempDir()+"/dbfile", 10)
+	assert.NoError(err)
+	defer pm.Close()
+
+	pageID, err := pm.CreatePage()
+	assert.NoError(err)
+	page, err := pm.FetchPage(pageID)
+	assert.NoError(err)
+	page.SetNodeType("LEAF    ")
+
+	// ピンされているページは削除できない
+	assert.ErrorIs(pm.DeletePage(pageID), ErrPagePinned)
+
+	assert.NoError(pm.UnpinPage(pageID, true))
+	assert.NoError(pm.DeletePage(pageID))
+
+	// 削除したページはプールから取り除かれている
+	assert.Error(pm.UnpinPage(pageID, false))
+
+	// 削除したページIDは再利用され、内容は初期化されている
+	newPageID, err := pm.CreatePage()
+	assert.NoError(err)
+	assert.Equal(pageID, newPageID)
+	page, err = pm.FetchPage(newPageID)
+	assert.NoError(err)
+	assert.Equal("        ", page.GetNodeType())
+	assert.NoError(pm.UnpinPage(newPageID, false))
+
+	// メタページは削除できない
+	assert.Error(pm.DeletePage(disk.MetaPageID))
+}
+
+func TestChecksum(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+	testPath := t.TempDir() + "/dbfile"
+
+	pm, err := NewPoolManager(testPath, 10)
+	assert.NoError(err)
+	pageID, err := createSetPage(pm, 0, []byte("Hello"))
+	assert.NoError(err)
+	assert.NoError(pm.Close())
+
+	// ファイル上のページを壊す
+	heap, err := os.OpenFile(testPath, os.O_RDWR, 0)
+	assert.NoError(err)
+	_, err = heap.WriteAt([]byte("J"), int64(pageID)*4096)
+	assert.NoError(err)
+	assert.NoError(heap.Close())
+
+	// 壊れたページは取得できない
+	pm, err = NewPoolManager(testPath, 10)
+	assert.NoError(err)
+	_, err = pm.FetchPage(pageID)
+	assert.ErrorIs(err, disk.ErrChecksumMismatch)
+	assert.NoError(pm.Close())
+
+	// チェックサムを検証しなければ、壊れたページの内容を救出できる
+	pm, err = NewPoolManager(testPath, 10, WithIgnoreChecksums())
+	assert.NoError(err)
+	defer pm.Close()
+	page, err := pm.FetchPage(pageID)
+	assert.NoError(err)
+	assert.Equal([]byte("Jello"), page.GetAllData()[:5])
+	assert.NoError(pm.UnpinPage(pageID, false))
+}
+
+func TestNewPoolManagerWithStorage(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Memory Storage", func(t *testing.T) {
+		storage, err := disk.NewMemoryStorage(disk.DefaultPageSize)
+		assert.NoError(err)
+		log, err := wal.OpenMemory()
+		assert.NoError(err)
+
+		// プールより多くのページを作成し、追い出されたページを読み戻す
+		pm, err := NewPoolManagerWithStorage(storage, log, 3)
+		assert.NoError(err)
+		var pageIDs []disk.PageID
+		for i := range 10 {
+			pageID, err := createSetPage(pm, 0, []byte(fmt.Sprintf("page%02d", i)))
+			assert.NoError(err)
+			pageIDs = append(pageIDs, pageID)
+		}
+		for i, pageID := range pageIDs {
+			p, err := pm.FetchPage(pageID)
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("page%02d", i)), p.GetAllData()[:6])
+			assert.NoError(pm.UnpinPage(pageID, false))
+		}
+
+		assert.NoError(pm.SetRootID(pageIDs[0]))
+		rootID, err := pm.RootID()
+		assert.NoError(err)
+		assert.Equal(pageIDs[0], rootID)
+
+		// 閉じるまでにすべての更新が記憶領域に書き込まれる
+		assert.NoError(pm.Sync())
+		buf := make([]byte, disk.DefaultPageSize)
+		assert.NoError(storage.ReadPage(pageIDs[9], buf))
+		assert.Equal([]byte("page09"), buf[:6])
+
+		assert.NoError(pm.Close())
+	})
+
+	t.Run("Recover From Log", func(t *testing.T) {
+		storage, err := disk.NewMemoryStorage(disk.DefaultPageSize)
+		assert.NoError(err)
+		log, err := wal.OpenMemory()
+		assert.NoError(err)
+
+		pm, err := NewPoolManagerWithStorage(storage, log, 3)
+		assert.NoError(err)
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+
+		// コミットした更新はログにだけ書き込まれ、ページは記憶領域に書き込まれていない
+		assert.NoError(writeTxn(pm, pageID, []byte("logged")))
+		buf := make([]byte, disk.DefaultPageSize)
+		assert.NoError(storage.ReadPage(pageID, buf))
+		assert.NotEqual([]byte("logged"), buf[100:106])
+
+		// 閉じずに同じ記憶領域とログから作り直すと、ログから更新が復旧される
+		pm, err = NewPoolManagerWithStorage(storage, log, 3)
+		assert.NoError(err)
+		defer pm.Close()
+
+		p, err := pm.FetchPage(pageID)
+		assert.NoError(err)
+		assert.Equal([]byte("logged"), p.GetAllData()[100:106])
+		assert.NoError(pm.UnpinPage(pageID, false))
+	})
+	t.Run("Alloc Error", func(t *testing.T) {
+		storage, err := disk.NewFaultStorage(disk.DefaultPageSize)
+		assert.NoError(err)
+		log, err := wal.OpenMemory()
+		assert.NoError(err)
+		pm, err := NewPoolManagerWithStorage(storage, log, 3)
+		assert.NoError(err)
+		defer pm.Close()
+
+		// ページの割り当てに失敗しても、フレームはページIDのない更新済みのページにならない
+		var pageIDs []disk.PageID
+		for i := range 3 {
+			pageID, err := createSetPage(pm, 0, []byte(fmt.Sprintf("page%02d", i)))
+			assert.NoError(err)
+			pageIDs = append(pageIDs, pageID)
+		}
+		storage.FailAlloc(1)
+		_, err = pm.CreatePage()
+		assert.ErrorIs(err, disk.ErrInjectedFault)
+		for _, p := range pm.pool {
+			assert.False(p.PageID == disk.PageID(-1) && p.Flag.Load())
+		}
+
+		// その後もすべてのフレームを追い出して使い回せる
+		for i := 3; i < 10; i++ {
+			pageID, err := createSetPage(pm, 0, []byte(fmt.Sprintf("page%02d", i)))
+			assert.NoError(err)
+			pageIDs = append(pageIDs, pageID)
+		}
+		for i, pageID := range pageIDs {
+			p, err := pm.FetchPage(pageID)
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("page%02d", i)), p.GetAllData()[:6])
+			assert.NoError(pm.UnpinPage(pageID, false))
+		}
+	})
+}
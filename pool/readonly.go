@@ -0,0 +1,100 @@
+package pool
+
+import (
+	"sync"
+
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/wal"
+)
+
+// 読み取り専用で開いたPoolManagerに書き込もうとした場合のエラー（disk.ErrReadOnlyと同じ）
+var ErrReadOnly = disk.ErrReadOnly
+
+// ファイルとログを読み取り専用で開くオプション
+// ページの作成・削除とルートページIDの更新はErrReadOnlyを返却し、更新されたページもファイルに書き込まない
+// ログに残っている更新はメモリ上でだけ復旧するので、異常終了したデータベースのコピーも変更せずに読み込める
+func WithReadOnly() Option {
+	return func(pm *PoolManager) {
+		pm.readOnly = true
+		pm.fileOptions = append(pm.fileOptions, disk.WithReadOnly())
+		pm.logOptions = append(pm.logOptions, wal.WithReadOnly())
+	}
+}
+
+// 読み取り専用で開いているかを返却
+func (pm *PoolManager) ReadOnly() bool {
+	return pm.readOnly
+}
+
+// 書き込んだページをメモリ上に保持し、元の記憶領域を変更しない記憶領域
+// 読み取り専用で開いた場合に、ログから復旧したページを保持するために使用する
+type overlayStorage struct {
+	disk.Storage
+	mu       sync.Mutex
+	pages    map[disk.PageID][]byte // 書き込まれたページ
+	numPages disk.PageID            // Extendで増やしたページ数
+}
+
+func newOverlayStorage(storage disk.Storage) *overlayStorage {
+	return &overlayStorage{
+		Storage:  storage,
+		pages:    make(map[disk.PageID][]byte),
+		numPages: storage.NumPages(),
+	}
+}
+
+func (o *overlayStorage) ReadPage(pageID disk.PageID, pageData []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if data, ok := o.pages[pageID]; ok {
+		copy(pageData, data)
+		return nil
+	}
+	// 元の記憶領域の末尾より後ろのページは、まだ書き込まれていない
+	if pageID >= o.Storage.NumPages() && pageID < o.numPages {
+		clear(pageData)
+		return nil
+	}
+	return o.Storage.ReadPage(pageID, pageData)
+}
+
+func (o *overlayStorage) WritePage(pageID disk.PageID, pageData []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if pageID < 0 || pageID >= max(o.numPages, o.Storage.NumPages()) {
+		return o.Storage.WritePage(pageID, pageData)
+	}
+	o.pages[pageID] = append([]byte(nil), pageData...)
+	return nil
+}
+
+func (o *overlayStorage) Extend(pageID disk.PageID) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.numPages = max(o.numPages, pageID+1)
+}
+
+func (o *overlayStorage) NumPages() disk.PageID {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return max(o.numPages, o.Storage.NumPages())
+}
+
+func (o *overlayStorage) AllocPage() (disk.PageID, error) {
+	return disk.PageID(-1), ErrReadOnly
+}
+
+func (o *overlayStorage) FreePage(pageID disk.PageID) error {
+	return ErrReadOnly
+}
+
+func (o *overlayStorage) WriteMeta(meta *disk.Meta) error {
+	return ErrReadOnly
+}
+
+// 元の記憶領域には書き込まないので、何もしない
+func (o *overlayStorage) Sync() error {
+	return nil
+}
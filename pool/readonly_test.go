@@ -0,0 +1,103 @@
+package pool
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+func TestReadOnly(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	// ページを1つ書き込んで正常に閉じたファイルを作成
+	setup := func(t *testing.T) (string, disk.PageID) {
+		testPath := t.TempDir() + "/dbfile"
+		pm, err := NewPoolManager(testPath, 10)
+		assert.NoError(err)
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+		assert.NoError(writeTxn(pm, pageID, []byte("first")))
+		assert.NoError(pm.SetRootID(pageID))
+		assert.NoError(pm.Close())
+		return testPath, pageID
+	}
+
+	t.Run("Reject Writes", func(t *testing.T) {
+		testPath, pageID := setup(t)
+		before, err := os.ReadFile(testPath)
+		assert.NoError(err)
+
+		pm, err := NewPoolManager(testPath, 2, WithReadOnly())
+		assert.NoError(err)
+		assert.True(pm.ReadOnly())
+
+		p, err := pm.FetchPage(pageID)
+		assert.NoError(err)
+		assert.Equal([]byte("first"), p.GetAllData()[100:105])
+		assert.NoError(pm.UnpinPage(pageID, false))
+		rootID, err := pm.RootID()
+		assert.NoError(err)
+		assert.Equal(pageID, rootID)
+
+		_, err = pm.CreatePage()
+		assert.ErrorIs(err, ErrReadOnly)
+		assert.ErrorIs(pm.DeletePage(pageID), ErrReadOnly)
+		assert.ErrorIs(pm.SetRootID(pageID), ErrReadOnly)
+		assert.ErrorIs(writeTxn(pm, pageID, []byte("second")), ErrReadOnly)
+
+		// 更新されたページは、追い出されてもSyncしてもファイルに書き込まれない
+		p, err = pm.FetchPage(pageID)
+		assert.NoError(err)
+		assert.NoError(p.SetData(100, 106, []byte("second")))
+		assert.NoError(pm.UnpinPage(pageID, true))
+		assert.NoError(pm.Sync())
+		assert.NoError(pm.Close())
+
+		after, err := os.ReadFile(testPath)
+		assert.NoError(err)
+		assert.Equal(before, after)
+		_, err = os.Stat(testPath + ".wal")
+		assert.True(os.IsNotExist(err))
+	})
+
+	t.Run("Recover In Memory", func(t *testing.T) {
+		testPath, pageID := setup(t)
+		pm, err := NewPoolManager(testPath, 10)
+		assert.NoError(err)
+		assert.NoError(writeTxn(pm, pageID, []byte("second")))
+		crash(pm)
+
+		heap, err := os.ReadFile(testPath)
+		assert.NoError(err)
+		log, err := os.ReadFile(testPath + ".wal")
+		assert.NoError(err)
+
+		// ログに残っているコミット済みの更新が見えるが、ファイルとログは変更されない
+		pm, err = NewPoolManager(testPath, 10, WithReadOnly())
+		assert.NoError(err)
+		p, err := pm.FetchPage(pageID)
+		assert.NoError(err)
+		assert.Equal([]byte("second"), p.GetAllData()[100:106])
+		assert.NoError(pm.UnpinPage(pageID, false))
+		assert.NoError(pm.Close())
+
+		after, err := os.ReadFile(testPath)
+		assert.NoError(err)
+		assert.Equal(heap, after)
+		after, err = os.ReadFile(testPath + ".wal")
+		assert.NoError(err)
+		assert.Equal(log, after)
+
+		// 書き込み用に開けば、ファイルに復旧される
+		pm, err = NewPoolManager(testPath, 10)
+		assert.NoError(err)
+		defer pm.Close()
+		p, err = pm.FetchPage(pageID)
+		assert.NoError(err)
+		assert.Equal([]byte("second"), p.GetAllData()[100:106])
+		assert.NoError(pm.UnpinPage(pageID, false))
+	})
+}
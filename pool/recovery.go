@@ -0,0 +1,80 @@
+package pool
+
+import (
+	"errors"
+	"io"
+
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/page"
+	"github.com/yuya-isaka/chibidb/wal"
+)
+
+// ログに残っている更新をファイルに反映する
+// 1. Redo: ファイル上のページLSNがレコードのLSNより小さければ、更新後のイメージを書き込む
+// 2. Undo: 終了していない（コミットもアボートもされていない）トランザクションの更新を、新しいものから順に更新前のイメージで戻す
+// アボートしたトランザクションは、更新を戻した補償レコードがRedoで反映されるので対象外
+// 空きページリストにあるページは、ログに残っている更新の後で解放されたものなので対象外
+// プールを使い始める前（NewPoolManager）に呼び出すこと
+func (pm *PoolManager) recover() error {
+	records, err := pm.wal.Records()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	finished := make(map[uint64]bool)
+	for _, record := range records {
+		switch record.Type {
+		case wal.CommitRecord, wal.AbortRecord:
+			finished[record.TxnID] = true
+		case wal.PageRecord:
+			// ファイルに書き込まれる前だったページも復元できるようにする
+			pm.storage.Extend(record.PageID)
+		}
+	}
+
+	freePageIDs, err := pm.storage.FreePages()
+	if err != nil {
+		return err
+	}
+	free := make(map[disk.PageID]bool)
+	for _, pageID := range freePageIDs {
+		free[pageID] = true
+	}
+
+	// Redo
+	current := page.NewPageWithSize(pm.storage.PageSize())
+	for _, record := range records {
+		if record.Type != wal.PageRecord || free[record.PageID] {
+			continue
+		}
+		if err := pm.storage.ReadPage(record.PageID, current.GetAllData()); err != nil {
+			// ファイルの末尾より後ろのページは、まだ書き込まれていない
+			// チェックサムが一致しないページは書き込みの途中で中断されたので、ログのページイメージで置き換える
+			if !errors.Is(err, io.EOF) && !errors.Is(err, disk.ErrChecksumMismatch) {
+				return err
+			}
+			current.ResetPageData()
+		}
+		if current.GetLSN() < record.LSN {
+			if err := pm.storage.WritePage(record.PageID, record.After); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Undo
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		if record.Type != wal.PageRecord || free[record.PageID] || finished[record.TxnID] {
+			continue
+		}
+		if err := pm.storage.WritePage(record.PageID, record.Before); err != nil {
+			return err
+		}
+	}
+
+	return pm.storage.Sync()
+}
@@ -0,0 +1,433 @@
+package pool
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/page"
+	"github.com/yuya-isaka/chibidb/wal"
+)
+
+// Syncせずにファイルを閉じ、プロセスが異常終了した状態を再現
+func crash(pm *PoolManager) {
+	pm.wal.Close()
+	pm.storage.Close()
+}
+
+// トランザクションでページの指定位置にデータを書き込む
+func writeTxn(pm *PoolManager, pageID disk.PageID, data []byte) error {
+	tx := pm.Begin()
+	p, err := fetchTracked(tx, pm, pageID)
+	if err != nil {
+		tx.Abort()
+		return err
+	}
+	p.SetData(100, uint16(100+len(data)), data)
+	return tx.Commit()
+}
+
+func TestRecovery(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Redo Committed Txn", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		pm, err := NewPoolManager(testPath, 10)
+		assert.NoError(err)
+
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+		assert.NoError(writeTxn(pm, pageID, []byte("first")))
+		assert.NoError(writeTxn(pm, pageID, []byte("second")))
+		crash(pm)
+
+		// ページはファイルに書き込まれる前だったが、ログから復旧される
+		pm, err = NewPoolManager(testPath, 10)
+		assert.NoError(err)
+		p, err := pm.FetchPage(pageID)
+		assert.NoError(err)
+		assert.Equal([]byte("second"), p.GetAllData()[100:106])
+		assert.NoError(pm.UnpinPage(pageID, false))
+
+		// 復旧したログは破棄され、正常に閉じるとログファイルは削除される
+		records, err := pm.wal.Records()
+		assert.NoError(err)
+		assert.Empty(records)
+		assert.NoError(pm.Close())
+		_, err = os.Stat(testPath + ".wal")
+		assert.True(os.IsNotExist(err))
+	})
+
+	t.Run("Undo Uncommitted Txn", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		pm, err := NewPoolManager(testPath, 10)
+		assert.NoError(err)
+
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+		assert.NoError(writeTxn(pm, pageID, []byte("committed")))
+		p, err := pm.FetchPage(pageID)
+		assert.NoError(err)
+		committed := append([]byte(nil), p.GetAllData()...)
+		assert.NoError(pm.UnpinPage(pageID, false))
+		assert.NoError(pm.Sync())
+
+		// コミットレコードを書き込む前に中断したトランザクションを再現
+		// 更新後のページはログより後にファイルにも書き込まれている
+		uncommitted := page.NewPage()
+		uncommitted.SetData(0, 4096, committed)
+		uncommitted.SetData(100, 111, []byte("uncommitted"))
+		lsn := pm.wal.Append(&wal.Record{TxnID: 100, Type: wal.PageRecord, PageID: pageID, Before: committed}, func(lsn uint64) []byte {
+			uncommitted.SetLSN(lsn)
+			return append([]byte(nil), uncommitted.GetAllData()...)
+		})
+		assert.NoError(pm.wal.Flush(lsn))
+		assert.NoError(pm.storage.WritePage(pageID, uncommitted.GetAllData()))
+		crash(pm)
+
+		// コミットされていない更新は取り消される
+		pm, err = NewPoolManager(testPath, 10)
+		assert.NoError(err)
+		defer pm.Close()
+		p, err = pm.FetchPage(pageID)
+		assert.NoError(err)
+		assert.Equal(committed, p.GetAllData())
+		assert.NoError(pm.UnpinPage(pageID, false))
+	})
+
+	t.Run("Skip Newer Page", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		pm, err := NewPoolManager(testPath, 10)
+		assert.NoError(err)
+
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+		assert.NoError(writeTxn(pm, pageID, []byte("first")))
+		assert.NoError(writeTxn(pm, pageID, []byte("second")))
+
+		// ファイル上のページがログより新しければ、古いイメージで上書きしない
+		p, err := pm.FetchPage(pageID)
+		assert.NoError(err)
+		p.RLatch()
+		assert.NoError(pm.storage.WritePage(pageID, p.GetAllData()))
+		p.RUnlatch()
+		assert.NoError(pm.UnpinPage(pageID, false))
+		crash(pm)
+
+		pm, err = NewPoolManager(testPath, 10)
+		assert.NoError(err)
+		defer pm.Close()
+		p, err = pm.FetchPage(pageID)
+		assert.NoError(err)
+		assert.Equal([]byte("second"), p.GetAllData()[100:106])
+		assert.NoError(pm.UnpinPage(pageID, false))
+	})
+
+	t.Run("Skip Freed Page", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		pm, err := NewPoolManager(testPath, 10)
+		assert.NoError(err)
+
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+		assert.NoError(writeTxn(pm, pageID, []byte("freed")))
+		assert.NoError(pm.DeletePage(pageID))
+		crash(pm)
+
+		// 解放済みのページにはログの更新を反映せず、空きページリストが壊れない
+		pm, err = NewPoolManager(testPath, 10)
+		assert.NoError(err)
+		defer pm.Close()
+		freed := page.NewPage()
+		assert.NoError(pm.storage.ReadPage(pageID, freed.GetAllData()))
+		assert.Equal(make([]byte, 8), freed.GetAllData()[8:16])
+		newID, err := pm.CreatePage()
+		assert.NoError(err)
+		assert.Equal(pageID, newID)
+	})
+
+	t.Run("Torn Page", func(t *testing.T) {
+		testPath := t.TempDir() + "/dbfile"
+		pm, err := NewPoolManager(testPath, 10)
+		assert.NoError(err)
+
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+		assert.NoError(writeTxn(pm, pageID, []byte("first")))
+		assert.NoError(pm.Sync())
+		assert.NoError(writeTxn(pm, pageID, []byte("second")))
+
+		// ページの書き込みが途中で中断され、一部だけが書き換わった状態を再現
+		_, err = pm.storage.(*disk.FileManager).Heap.WriteAt([]byte("second"), int64(pageID)*4096+100)
+		assert.NoError(err)
+		crash(pm)
+		fm, err := disk.NewFileManager(testPath)
+		assert.NoError(err)
+		assert.ErrorIs(fm.ReadPage(pageID, make([]byte, 4096)), disk.ErrChecksumMismatch)
+		assert.NoError(fm.Heap.Close())
+
+		// チェックサムが一致しないページは、ログのページイメージで復旧される
+		pm, err = NewPoolManager(testPath, 10)
+		assert.NoError(err)
+		defer pm.Close()
+		p, err := pm.FetchPage(pageID)
+		assert.NoError(err)
+		assert.Equal([]byte("second"), p.GetAllData()[100:106])
+		assert.NoError(pm.UnpinPage(pageID, false))
+	})
+}
+
+func TestConcurrentTxnRecovery(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	for _, commit := range []bool{true, false} {
+		name := "Abort"
+		if commit {
+			name = "Commit"
+		}
+		t.Run(name, func(t *testing.T) {
+			testPath := t.TempDir() + "/dbfile"
+			pm, err := NewPoolManager(testPath, 10)
+			assert.NoError(err)
+			pageID, err := pm.CreatePage()
+			assert.NoError(err)
+
+			// T1: 更新をApplyでログに記録したが、まだ終了していない
+			tx := pm.Begin()
+			p, err := fetchTracked(tx, pm, pageID)
+			assert.NoError(err)
+			p.SetData(100, 104, []byte("AAAA"))
+			tx.Apply()
+
+			// T2: 同じページを更新してコミットする
+			done := make(chan error)
+			go func() {
+				done <- writeTxn(pm, pageID, []byte("BBBB"))
+			}()
+
+			// T1が終了するまで、T2はページを更新できない
+			select {
+			case err := <-done:
+				t.Fatalf("txn finished before the other txn ended: %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			if commit {
+				assert.NoError(tx.Commit())
+			} else {
+				assert.NoError(tx.Abort())
+			}
+			assert.NoError(<-done)
+			crash(pm)
+
+			// T2がコミットした更新は、T1の更新前のイメージで消されない
+			pm, err = NewPoolManager(testPath, 10)
+			assert.NoError(err)
+			defer pm.Close()
+			p, err = pm.FetchPage(pageID)
+			assert.NoError(err)
+			assert.Equal([]byte("BBBB"), p.GetAllData()[100:104])
+			assert.NoError(pm.UnpinPage(pageID, false))
+		})
+	}
+}
+
+// 最後にSyncした後のページとメタページの書き込みを、電源断で破棄できる記憶領域
+// メモリマップの書き込みが、msync（Sync）まで永続化されないことを再現する
+type volatileStorage struct {
+	disk.Storage
+	pages map[disk.PageID][]byte // Syncした後に初めて書き込んだページの、書き込む前の内容（nilは読み込めなかったページ）
+	meta  *disk.Meta             // Syncした後に初めて書き込む前のメタページ
+	mu    sync.Mutex
+}
+
+func newVolatileStorage(storage disk.Storage) *volatileStorage {
+	return &volatileStorage{Storage: storage, pages: make(map[disk.PageID][]byte)}
+}
+
+func (s *volatileStorage) WritePage(pageID disk.PageID, pageData []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pages[pageID]; !ok {
+		before := make([]byte, len(pageData))
+		if err := s.Storage.ReadPage(pageID, before); err != nil {
+			before = nil
+		}
+		s.pages[pageID] = before
+	}
+	return s.Storage.WritePage(pageID, pageData)
+}
+
+func (s *volatileStorage) WriteMeta(meta *disk.Meta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.meta == nil {
+		before, err := s.Storage.ReadMeta()
+		if err != nil {
+			return err
+		}
+		s.meta = before
+	}
+	return s.Storage.WriteMeta(meta)
+}
+
+func (s *volatileStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.Storage.Sync(); err != nil {
+		return err
+	}
+	clear(s.pages)
+	s.meta = nil
+	return nil
+}
+
+// Syncしていない書き込みを書き込む前の内容に戻し、記憶領域を閉じる
+func (s *volatileStorage) crash() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for pageID, before := range s.pages {
+		if before != nil {
+			if err := s.Storage.WritePage(pageID, before); err != nil {
+				return err
+			}
+		}
+	}
+	if s.meta != nil {
+		if err := s.Storage.WriteMeta(s.meta); err != nil {
+			return err
+		}
+	}
+	if err := s.Storage.Sync(); err != nil {
+		return err
+	}
+	return s.Storage.Close()
+}
+
+func TestCheckpointCrash(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	// 記憶領域を開く関数と、Syncしていない書き込みを破棄して電源断を起こす関数を返却
+	backends := []struct {
+		name  string
+		setup func(t *testing.T) (open func() disk.Storage, crash func(storage disk.Storage))
+	}{
+		{"FaultStorage", func(t *testing.T) (func() disk.Storage, func(disk.Storage)) {
+			storage, err := disk.NewFaultStorage(disk.DefaultPageSize)
+			assert.NoError(err)
+			return func() disk.Storage { return storage }, func(disk.Storage) { storage.Crash() }
+		}},
+		{"Mmap", func(t *testing.T) (func() disk.Storage, func(disk.Storage)) {
+			if runtime.GOOS != "linux" {
+				t.Skip("メモリマップはLinuxのみ")
+			}
+			path := t.TempDir() + "/dbfile"
+			open := func() disk.Storage {
+				fm, err := disk.NewFileManager(path, disk.WithMmap())
+				assert.NoError(err)
+				return newVolatileStorage(fm)
+			}
+			return open, func(storage disk.Storage) { assert.NoError(storage.(*volatileStorage).crash()) }
+		}},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			open, crashStorage := backend.setup(t)
+			logFile := wal.NewFaultFile()
+			reopen := func() *PoolManager {
+				log, err := wal.OpenFault(logFile)
+				assert.NoError(err)
+				pm, err := NewPoolManagerWithStorage(open(), log, 10)
+				assert.NoError(err)
+				return pm
+			}
+			powerLoss := func(pm *PoolManager) {
+				crashStorage(pm.storage)
+				logFile.Crash()
+			}
+
+			// チェックポイントの直後に電源断
+			pm := reopen()
+			pageID, err := pm.CreatePage()
+			assert.NoError(err)
+			for i := range 20 {
+				assert.NoError(writeTxn(pm, pageID, []byte(fmt.Sprintf("page%02d", i))))
+			}
+			assert.NoError(pm.Sync())
+			powerLoss(pm)
+
+			// チェックポイントで記録したLSNは失われず、その後にコミットした更新も復旧される
+			pm = reopen()
+			meta, err := pm.storage.ReadMeta()
+			assert.NoError(err)
+			assert.GreaterOrEqual(meta.CheckpointLSN, uint64(20))
+			assert.NoError(writeTxn(pm, pageID, []byte("commit")))
+			powerLoss(pm)
+
+			pm = reopen()
+			p, err := pm.FetchPage(pageID)
+			assert.NoError(err)
+			assert.Equal([]byte("commit"), p.GetAllData()[100:106])
+			assert.NoError(pm.UnpinPage(pageID, false))
+			assert.NoError(pm.Close())
+		})
+	}
+}
+
+func TestDurability(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	modes := []struct {
+		durability wal.Durability
+		survives   bool // 異常終了の前にコミットした更新が復旧されるか
+	}{
+		{wal.DurabilityFull, true},
+		{wal.DurabilityGroupCommit, true},
+		{wal.DurabilityOSBuffered, true},
+		{wal.DurabilityNone, false},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.durability.String(), func(t *testing.T) {
+			testPath := t.TempDir() + "/dbfile"
+			pm, err := NewPoolManager(testPath, 10, WithDurability(mode.durability), WithGroupCommitWindow(time.Millisecond, 1<<20))
+			assert.NoError(err)
+
+			// Syncまでの更新はどのモードでも失われない
+			pageID, err := pm.CreatePage()
+			assert.NoError(err)
+			assert.NoError(writeTxn(pm, pageID, []byte("synced")))
+			assert.NoError(pm.Sync())
+
+			// Syncの後にコミットした更新は、モードによっては失われる
+			assert.NoError(writeTxn(pm, pageID, []byte("commit")))
+			crash(pm)
+
+			pm, err = NewPoolManager(testPath, 10, WithDurability(mode.durability))
+			assert.NoError(err)
+			defer pm.Close()
+
+			p, err := pm.FetchPage(pageID)
+			assert.NoError(err)
+			if mode.survives {
+				assert.Equal([]byte("commit"), p.GetAllData()[100:106])
+			} else {
+				assert.Equal([]byte("synced"), p.GetAllData()[100:106])
+			}
+			assert.NoError(pm.UnpinPage(pageID, false))
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package pool
+
+import "math"
+
+// プールから追い出すページを選ぶアルゴリズム
+// フレーム（プール内のページのインデックス）ごとに、参照の履歴と追い出し可能かどうかを管理する
+// 作成時はすべてのフレームが空で、追い出し可能として扱う
+// PoolManagerはpm.muを取得した状態で呼び出すので、実装は複数のゴルーチンから呼び出せなくてよい
+type Replacer interface {
+	// フレームのページが参照されたことを記録
+	RecordAccess(frame uint)
+	// フレームを追い出し対象から外す（ピンされたページ）
+	Pin(frame uint)
+	// フレームを追い出し対象に戻す（ピンがすべて解放されたページ）
+	Unpin(frame uint)
+	// 追い出すフレームを選んで返却し、そのフレームの参照の履歴を破棄する
+	// 返却したフレームは、PinまたはUnpinを呼び出すまで追い出し対象から外れる
+	// 追い出し可能なフレームがない場合はfalseを返却
+	Evict() (uint, bool)
+}
+
+// フレーム数からReplacerを作成する関数
+// NewClockReplacer、NewLRUReplacer、New2QReplacerはそのまま渡せる
+type ReplacerFactory func(frameNum uint) Replacer
+
+// ==============================================================================
+
+// クロックの利用回数の上限（PostgreSQLと同じ）
+// 追い出しはpm.muを取得した状態でカウンタが0になるまで針を回すので、参照の多いフレームでも針の周回数が上限を超えないようにする
+const maxUsageCount = 5
+
+// クロックスイープアルゴリズム
+// 参照されるたびにカウンタを増やし（maxUsageCountまで）、針が通過するたびにカウンタを減らす
+// 針が来た時点でカウンタが0のフレームを追い出す
+type clockReplacer struct {
+	counters  []uint // フレームの利用回数
+	evictable []bool // 追い出し可能かどうか
+	hand      uint   // 次に調べるフレーム
+	count     int    // 追い出し可能なフレーム数
+}
+
+func NewClockReplacer(frameNum uint) Replacer {
+	return &clockReplacer{
+		counters:  make([]uint, frameNum),
+		evictable: newEvictable(frameNum),
+		count:     int(frameNum),
+	}
+}
+
+func (r *clockReplacer) RecordAccess(frame uint) {
+	if r.counters[frame] < maxUsageCount {
+		r.counters[frame]++
+	}
+}
+
+func (r *clockReplacer) Pin(frame uint) {
+	r.count += setEvictable(r.evictable, frame, false)
+}
+
+func (r *clockReplacer) Unpin(frame uint) {
+	r.count += setEvictable(r.evictable, frame, true)
+}
+
+func (r *clockReplacer) Evict() (uint, bool) {
+	if r.count == 0 {
+		return 0, false
+	}
+
+	// 追い出し可能なフレームのカウンタは針が通過するたびに減るので、いずれ0になる
+	for {
+		frame := r.hand
+		r.hand = (r.hand + 1) % uint(len(r.counters))
+		if !r.evictable[frame] {
+			continue
+		}
+		if r.counters[frame] == 0 {
+			r.evictable[frame] = false
+			r.count--
+			return frame, true
+		}
+		r.counters[frame]--
+	}
+}
+
+// ==============================================================================
+
+// LRU（Least Recently Used）
+// 最後に参照された時刻が最も古いフレームを追い出す
+type lruReplacer struct {
+	lastAccess []uint64 // フレームが最後に参照された時刻（0は参照の履歴なし）
+	evictable  []bool
+	now        uint64 // 論理時刻
+}
+
+func NewLRUReplacer(frameNum uint) Replacer {
+	return &lruReplacer{
+		lastAccess: make([]uint64, frameNum),
+		evictable:  newEvictable(frameNum),
+	}
+}
+
+func (r *lruReplacer) RecordAccess(frame uint) {
+	r.now++
+	r.lastAccess[frame] = r.now
+}
+
+func (r *lruReplacer) Pin(frame uint) {
+	setEvictable(r.evictable, frame, false)
+}
+
+func (r *lruReplacer) Unpin(frame uint) {
+	setEvictable(r.evictable, frame, true)
+}
+
+func (r *lruReplacer) Evict() (uint, bool) {
+	victim, ok := uint(0), false
+	for frame, evictable := range r.evictable {
+		if evictable && (!ok || r.lastAccess[frame] < r.lastAccess[victim]) {
+			victim, ok = uint(frame), true
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+	r.evictable[victim] = false
+	r.lastAccess[victim] = 0
+	return victim, true
+}
+
+// ==============================================================================
+
+// LRU-K
+// 直近K回の参照のうち最も古い参照の時刻（後方K距離）が最も古いフレームを追い出す
+// 参照がK回に満たないフレームは後方K距離を無限大として優先して追い出し、その中では最初の参照が古いものを選ぶ
+// 一度だけ参照されるページ（走査など）が、何度も参照されるページを追い出さない
+type lruKReplacer struct {
+	history   [][]uint64 // フレームごとの直近K回の参照時刻（古い順）
+	evictable []bool
+	k         int
+	now       uint64
+}
+
+// kは1以上であること（k=1の場合はLRUと同じ）
+func NewLRUKReplacer(frameNum uint, k int) Replacer {
+	return &lruKReplacer{
+		history:   make([][]uint64, frameNum),
+		evictable: newEvictable(frameNum),
+		k:         max(k, 1),
+	}
+}
+
+func (r *lruKReplacer) RecordAccess(frame uint) {
+	r.now++
+	h := append(r.history[frame], r.now)
+	if len(h) > r.k {
+		h = h[1:]
+	}
+	r.history[frame] = h
+}
+
+func (r *lruKReplacer) Pin(frame uint) {
+	setEvictable(r.evictable, frame, false)
+}
+
+func (r *lruKReplacer) Unpin(frame uint) {
+	setEvictable(r.evictable, frame, true)
+}
+
+func (r *lruKReplacer) Evict() (uint, bool) {
+	victim, ok := uint(0), false
+	victimFull, victimTime := false, uint64(math.MaxUint64)
+	for i, evictable := range r.evictable {
+		if !evictable {
+			continue
+		}
+		h := r.history[i]
+		full := len(h) >= r.k
+		// 参照の履歴がないフレームは時刻0として扱う
+		var time uint64
+		if len(h) > 0 {
+			time = h[0]
+		}
+		// 参照がK回に満たないフレームを優先し、同じ種類の中では時刻が古いものを選ぶ
+		if !ok || (!full && victimFull) || (full == victimFull && time < victimTime) {
+			victim, ok = uint(i), true
+			victimFull, victimTime = full, time
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+	r.evictable[victim] = false
+	r.history[victim] = nil
+	return victim, true
+}
+
+// ==============================================================================
+
+// 2Q（簡易版）
+// 一度だけ参照されたフレームはA1（FIFO）、二度以上参照されたフレームはAm（LRU）で管理する
+// A1がフレーム数の4分の1を超えている間はA1から、そうでなければAmから追い出す
+// 走査で一度だけ参照されたページはA1に留まり、Amの頻繁に参照されるページを追い出さない
+type twoQReplacer struct {
+	firstAccess []uint64 // A1での順序に使う、最初に参照された時刻
+	lastAccess  []uint64 // Amでの順序に使う、最後に参照された時刻
+	accesses    []int    // 参照回数（0または1はA1、2以上はAm）
+	evictable   []bool
+	a1Size      int // A1に属するフレーム数（参照の履歴がないフレームは含まない）
+	kin         int // A1の目標サイズ
+	now         uint64
+}
+
+func New2QReplacer(frameNum uint) Replacer {
+	return &twoQReplacer{
+		firstAccess: make([]uint64, frameNum),
+		lastAccess:  make([]uint64, frameNum),
+		accesses:    make([]int, frameNum),
+		evictable:   newEvictable(frameNum),
+		kin:         max(int(frameNum)/4, 1),
+	}
+}
+
+func (r *twoQReplacer) RecordAccess(frame uint) {
+	r.now++
+	switch r.accesses[frame] {
+	case 0:
+		r.firstAccess[frame] = r.now
+		r.a1Size++
+	case 1:
+		// 二度目の参照でA1からAmに移る
+		r.a1Size--
+	}
+	r.accesses[frame]++
+	r.lastAccess[frame] = r.now
+}
+
+func (r *twoQReplacer) Pin(frame uint) {
+	setEvictable(r.evictable, frame, false)
+}
+
+func (r *twoQReplacer) Unpin(frame uint) {
+	setEvictable(r.evictable, frame, true)
+}
+
+func (r *twoQReplacer) Evict() (uint, bool) {
+	// 参照の履歴がないフレーム（空のフレームなど）を最優先で追い出す
+	// 選んだキューに追い出し可能なフレームがなければ、もう一方のキューから追い出す
+	fromA1 := r.a1Size > r.kin
+	victim, ok := r.oldest(func(frame int) bool { return r.accesses[frame] == 0 })
+	if !ok {
+		victim, ok = r.oldest(func(frame int) bool { return (r.accesses[frame] == 1) == fromA1 })
+	}
+	if !ok {
+		victim, ok = r.oldest(func(frame int) bool { return (r.accesses[frame] == 1) != fromA1 })
+	}
+	if !ok {
+		return 0, false
+	}
+
+	if r.accesses[victim] == 1 {
+		r.a1Size--
+	}
+	r.evictable[victim] = false
+	r.accesses[victim] = 0
+	r.firstAccess[victim] = 0
+	r.lastAccess[victim] = 0
+	return victim, true
+}
+
+// 条件を満たす追い出し可能なフレームのうち、キューの末尾にあるもの（A1は最初の参照、Amは最後の参照が最も古いもの）を返却
+func (r *twoQReplacer) oldest(match func(frame int) bool) (uint, bool) {
+	victim, ok := uint(0), false
+	time := func(frame uint) uint64 {
+		if r.accesses[frame] == 1 {
+			return r.firstAccess[frame]
+		}
+		return r.lastAccess[frame]
+	}
+	for frame, evictable := range r.evictable {
+		if evictable && match(frame) && (!ok || time(uint(frame)) < time(victim)) {
+			victim, ok = uint(frame), true
+		}
+	}
+	return victim, ok
+}
+
+// ==============================================================================
+
+// すべてのフレームが追い出し可能な状態を作成
+func newEvictable(frameNum uint) []bool {
+	evictable := make([]bool, frameNum)
+	for i := range evictable {
+		evictable[i] = true
+	}
+	return evictable
+}
+
+// フレームの追い出し可能かどうかを設定し、追い出し可能なフレーム数の増減を返却
+func setEvictable(evictable []bool, frame uint, value bool) int {
+	if evictable[frame] == value {
+		return 0
+	}
+	evictable[frame] = value
+	if value {
+		return 1
+	}
+	return -1
+}
@@ -0,0 +1,252 @@
+package pool
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+var replacers = []struct {
+	name    string
+	factory ReplacerFactory
+}{
+	{"Clock", NewClockReplacer},
+	{"LRU", NewLRUReplacer},
+	{"LRU-2", func(frameNum uint) Replacer { return NewLRUKReplacer(frameNum, 2) }},
+	{"2Q", New2QReplacer},
+}
+
+// プールと同じように、参照するたびにピンして解放する
+func access(r Replacer, frame uint) {
+	r.RecordAccess(frame)
+	r.Pin(frame)
+	r.Unpin(frame)
+}
+
+// 追い出されるフレームを順に返却
+func evictAll(r Replacer) []uint {
+	var frames []uint
+	for {
+		frame, ok := r.Evict()
+		if !ok {
+			return frames
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestReplacer(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	for _, tc := range replacers {
+		t.Run(tc.name, func(t *testing.T) {
+			r := tc.factory(4)
+
+			// 作成時はすべてのフレームが追い出し可能で、追い出したフレームは対象から外れる
+			assert.ElementsMatch([]uint{0, 1, 2, 3}, evictAll(r))
+			_, ok := r.Evict()
+			assert.False(ok)
+
+			// ピンされたフレームは追い出さない
+			for frame := uint(0); frame < 4; frame++ {
+				access(r, frame)
+			}
+			r.Pin(1)
+			r.Pin(2)
+			assert.ElementsMatch([]uint{0, 3}, evictAll(r))
+			r.Unpin(2)
+			assert.Equal([]uint{2}, evictAll(r))
+		})
+	}
+
+	t.Run("Clock Order", func(t *testing.T) {
+		r := NewClockReplacer(3)
+		// 参照回数が多いフレームは、針が何度か通過するまで追い出さない
+		access(r, 0)
+		access(r, 0)
+		access(r, 1)
+		assert.Equal([]uint{2, 1, 0}, evictAll(r))
+	})
+
+	t.Run("Clock Bounded Count", func(t *testing.T) {
+		r := NewClockReplacer(3)
+		// 何度参照されても利用回数は上限で止まるので、針は上限の回数だけ周回すれば追い出せる
+		for range 100000 {
+			access(r, 0)
+		}
+		access(r, 1)
+		assert.Equal(uint(maxUsageCount), r.(*clockReplacer).counters[0])
+		r.Pin(1)
+		r.Pin(2)
+		frame, ok := r.Evict()
+		assert.True(ok)
+		assert.Equal(uint(0), frame)
+	})
+
+	t.Run("LRU Order", func(t *testing.T) {
+		r := NewLRUReplacer(3)
+		for _, frame := range []uint{0, 1, 2, 0} {
+			access(r, frame)
+		}
+		assert.Equal([]uint{1, 2, 0}, evictAll(r))
+	})
+
+	t.Run("LRU-K Order", func(t *testing.T) {
+		r := NewLRUKReplacer(4, 2)
+		// 参照が2回に満たないフレーム（2、3）を最初の参照が古い順に追い出し、その後は2回前の参照が古い順
+		for _, frame := range []uint{0, 1, 2, 1, 0, 3} {
+			access(r, frame)
+		}
+		assert.Equal([]uint{2, 3, 0, 1}, evictAll(r))
+	})
+
+	t.Run("2Q Order", func(t *testing.T) {
+		r := New2QReplacer(4)
+		// A1（1回だけ参照: 2、3）が目標サイズ（1）を超えている間はA1から最初の参照が古い順
+		// 超えていなければAm（2回以上参照: 0、1）から最後の参照が古い順（Amが空になればA1から）
+		for _, frame := range []uint{0, 1, 0, 2, 3, 1} {
+			access(r, frame)
+		}
+		assert.Equal([]uint{2, 0, 1, 3}, evictAll(r))
+	})
+}
+
+func TestPoolWithReplacer(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	for _, tc := range replacers {
+		t.Run(tc.name, func(t *testing.T) {
+			pm, err := NewPoolManager(t.TempDir()+"/dbfile", 3, WithReplacer(tc.factory))
+			assert.NoError(err)
+			defer pm.Close()
+
+			// プールより多いページを書き込み、追い出されたページも読み込める
+			var pageIDs []disk.PageID
+			for i := range 10 {
+				pageID, err := createSetPage(pm, 0, []byte(fmt.Sprintf("page%d", i)))
+				assert.NoError(err)
+				pageIDs = append(pageIDs, pageID)
+			}
+			for _, i := range rand.New(rand.NewSource(1)).Perm(100) {
+				pageID := pageIDs[i%10]
+				p, err := pm.FetchPage(pageID)
+				assert.NoError(err)
+				want := []byte(fmt.Sprintf("page%d", i%10))
+				assert.Equal(want, p.GetAllData()[:len(want)])
+				assert.NoError(pm.UnpinPage(pageID, false))
+			}
+
+			// すべてのページがピンされていれば、追い出せない
+			for _, pageID := range pageIDs[:3] {
+				_, err := pm.FetchPage(pageID)
+				assert.NoError(err)
+			}
+			_, err = pm.FetchPage(pageIDs[3])
+			assert.ErrorIs(err, ErrPoolExhausted)
+			for _, pageID := range pageIDs[:3] {
+				assert.NoError(pm.UnpinPage(pageID, false))
+			}
+			_, err = pm.FetchPage(pageIDs[3])
+			assert.NoError(err)
+			assert.NoError(pm.UnpinPage(pageIDs[3], false))
+		})
+	}
+}
+
+// ==============================================================================
+
+const (
+	benchFrames = 100   // プールのフレーム数
+	benchPages  = 10000 // ファイルのページ数
+	benchLength = 100000
+)
+
+// 頻繁に参照される少数のページへのランダムな参照の合間に、プールより大きい範囲の走査が入る参照列
+func scanTrace(rng *rand.Rand) []int {
+	trace := make([]int, 0, benchLength)
+	for len(trace) < benchLength {
+		for range 1000 {
+			trace = append(trace, rng.Intn(benchFrames/2))
+		}
+		start := rng.Intn(benchPages - 500)
+		for i := range 500 {
+			trace = append(trace, start+i)
+		}
+	}
+	return trace[:benchLength]
+}
+
+// 参照の頻度がZipf分布に従う参照列
+func zipfTrace(rng *rand.Rand) []int {
+	zipf := rand.NewZipf(rng, 1.1, 1, benchPages-1)
+	trace := make([]int, benchLength)
+	for i := range trace {
+		trace[i] = int(zipf.Uint64())
+	}
+	return trace
+}
+
+// Replacerだけでプールを模擬し、参照列のヒット率を返却
+func hitRatio(r Replacer, frameNum uint, trace []int) float64 {
+	frames := make(map[int]uint)
+	pages := make([]int, frameNum)
+	for i := range pages {
+		pages[i] = -1
+	}
+
+	hits := 0
+	for _, pageID := range trace {
+		frame, ok := frames[pageID]
+		if ok {
+			hits++
+		} else {
+			frame, _ = r.Evict()
+			delete(frames, pages[frame])
+			frames[pageID] = frame
+			pages[frame] = pageID
+		}
+		access(r, frame)
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+func TestReplacerScanResistance(t *testing.T) {
+	trace := scanTrace(rand.New(rand.NewSource(1)))
+	ratios := make(map[string]float64)
+	for _, tc := range replacers {
+		ratios[tc.name] = hitRatio(tc.factory(benchFrames), benchFrames, trace)
+	}
+
+	// 走査で一度だけ参照されたページは、頻繁に参照されるページを追い出さない
+	assert.Greater(t, ratios["LRU-2"], ratios["LRU"])
+	assert.Greater(t, ratios["2Q"], ratios["LRU"])
+}
+
+// 各アルゴリズムのヒット率を比較するベンチマーク
+// go test -bench=Replacer ./pool で、ヒット率をhit/opとして表示する
+func BenchmarkReplacer(b *testing.B) {
+	workloads := []struct {
+		name  string
+		trace []int
+	}{
+		{"Scan", scanTrace(rand.New(rand.NewSource(1)))},
+		{"Zipf", zipfTrace(rand.New(rand.NewSource(1)))},
+	}
+
+	for _, workload := range workloads {
+		for _, tc := range replacers {
+			b.Run(workload.name+"/"+tc.name, func(b *testing.B) {
+				var ratio float64
+				for range b.N {
+					ratio = hitRatio(tc.factory(benchFrames), benchFrames, workload.trace)
+				}
+				b.ReportMetric(ratio, "hit/op")
+			})
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package pool
+
+import "github.com/yuya-isaka/chibidb/page"
+
+// リングの最大フレーム数
+const maxRingSize = 32
+
+// 大きな走査や一括読み込みで使用するバッファアクセス戦略（リングバッファ）
+// プールにないページは、リングに属する少数のフレームを順に使い回して読み込む
+// リングで読み込んだページは参照を記録しないので、他の利用者が使用しているページをプールから追い出さない
+// 1つのStrategyは1つのゴルーチンから使用すること
+type Strategy struct {
+	ring []int // リングに属するフレームのインデックス（-1はまだ割り当てていない）
+	next int   // 次に使うリングの位置
+}
+
+// プールのフレーム数の8分の1（1以上maxRingSize以下）のリングを作成
+func (pm *PoolManager) NewRingStrategy() *Strategy {
+	size := min(max(len(pm.pool)/8, 1), maxRingSize)
+	ring := make([]int, size)
+	for i := range ring {
+		ring[i] = -1
+	}
+	return &Strategy{ring: ring}
+}
+
+// ページを読み込むフレームとそのインデックスを返却
+// strategyがnilの場合はsweepPageと同じ
+// リングの次の位置のフレームがまだリングに属していてピンされていなければ、そのページを追い出して使い回す
+// 使い回せなければReplacerが選んだフレームをリングに加える
+// 返却したページはReplacerの追い出し対象から外れているので、pinまたはunpinFrameで戻すこと
+// pm.muを取得した状態で呼び出すこと
+func (pm *PoolManager) allocFrame(strategy *Strategy) (*page.Page, uint, error) {
+	if strategy == nil {
+		return pm.sweepPage()
+	}
+
+	slot := strategy.next
+	strategy.next = (strategy.next + 1) % len(strategy.ring)
+
+	if frame := strategy.ring[slot]; frame >= 0 {
+		poolIndex := uint(frame)
+		if pm.ringOwner[poolIndex] == strategy && pm.pool[poolIndex].PinCount == 0 {
+			pm.replacer.Pin(poolIndex)
+			if err := pm.evictPage(poolIndex); err != nil {
+				pm.replacer.Unpin(poolIndex)
+				return nil, 0, err
+			}
+			pm.ringOwner[poolIndex] = strategy
+			return pm.pool[poolIndex], poolIndex, nil
+		}
+	}
+
+	// リングのフレームが他の利用者に使われている（またはまだない）場合は、新しいフレームをリングに加える
+	page, poolIndex, err := pm.sweepPage()
+	if err != nil {
+		return nil, 0, err
+	}
+	strategy.ring[slot] = int(poolIndex)
+	pm.ringOwner[poolIndex] = strategy
+	return page, poolIndex, nil
+}
@@ -0,0 +1,146 @@
+package pool
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+func TestRingStrategy(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	// 頻繁に参照されるページ（8ページ）と、プールより大きい走査対象のページ（32ページ）を作成
+	setup := func(t *testing.T, opts ...Option) (*PoolManager, []disk.PageID, []disk.PageID) {
+		pm, err := NewPoolManager(t.TempDir()+"/dbfile", 16, opts...)
+		assert.NoError(err)
+		t.Cleanup(func() { pm.Close() })
+
+		var pageIDs []disk.PageID
+		for i := range 40 {
+			pageID, err := createSetPage(pm, 0, []byte(fmt.Sprintf("page%02d", i)))
+			assert.NoError(err)
+			pageIDs = append(pageIDs, pageID)
+		}
+		hot, scan := pageIDs[:8], pageIDs[8:]
+		for range 3 {
+			for _, pageID := range hot {
+				_, err := pm.FetchPage(pageID)
+				assert.NoError(err)
+				assert.NoError(pm.UnpinPage(pageID, false))
+			}
+		}
+		return pm, hot, scan
+	}
+	resident := func(pm *PoolManager, pageIDs []disk.PageID) int {
+		n := 0
+		for _, pageID := range pageIDs {
+			if _, ok := pm.pageTable[pageID]; ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("Scan", func(t *testing.T) {
+		pm, hot, scan := setup(t)
+		strategy := pm.NewRingStrategy()
+		assert.Equal(2, len(strategy.ring))
+
+		// リングで読み込んだページは、リングのフレームだけを使い回す
+		frames := make(map[uint]bool)
+		for i, pageID := range scan {
+			_, cached := pm.pageTable[pageID]
+			p, err := pm.FetchPageWithStrategy(pageID, strategy)
+			assert.NoError(err)
+			want := []byte(fmt.Sprintf("page%02d", i+8))
+			assert.Equal(want, p.GetAllData()[:len(want)])
+			if !cached {
+				frames[pm.pageTable[pageID]] = true
+			}
+			assert.NoError(pm.UnpinPage(pageID, false))
+		}
+		assert.LessOrEqual(len(frames), len(strategy.ring))
+
+		// 頻繁に参照されるページは追い出されない
+		assert.Equal(len(hot), resident(pm, hot))
+	})
+
+	t.Run("Scan Without Strategy", func(t *testing.T) {
+		pm, hot, scan := setup(t)
+
+		// リングを使わなければ、走査で頻繁に参照されるページも追い出される
+		for _, pageID := range scan {
+			_, err := pm.FetchPage(pageID)
+			assert.NoError(err)
+			assert.NoError(pm.UnpinPage(pageID, false))
+		}
+		assert.Less(resident(pm, hot), len(hot))
+	})
+
+	t.Run("Bulk Load", func(t *testing.T) {
+		pm, hot, _ := setup(t)
+		strategy := pm.NewRingStrategy()
+
+		// リングで作成・更新したページは、追い出されるときにファイルに書き込まれる
+		var pageIDs []disk.PageID
+		for i := range 32 {
+			pageID, err := pm.CreatePageWithStrategy(strategy)
+			assert.NoError(err)
+			p, err := pm.FetchPageWithStrategy(pageID, strategy)
+			assert.NoError(err)
+			assert.NoError(p.SetData(0, 6, []byte(fmt.Sprintf("bulk%02d", i))))
+			assert.NoError(pm.UnpinPage(pageID, true))
+			pageIDs = append(pageIDs, pageID)
+		}
+		assert.Equal(len(hot), resident(pm, hot))
+
+		for i, pageID := range pageIDs {
+			p, err := pm.FetchPage(pageID)
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("bulk%02d", i)), p.GetAllData()[:6])
+			assert.NoError(pm.UnpinPage(pageID, false))
+		}
+	})
+
+	t.Run("Shared Page", func(t *testing.T) {
+		// 参照の履歴がない空のフレームから追い出すLRUで、リングが使い回すフレームを確認する
+		pm, _, scan := setup(t, WithReplacer(NewLRUReplacer))
+		strategy := pm.NewRingStrategy()
+
+		_, err := pm.FetchPageWithStrategy(scan[0], strategy)
+		assert.NoError(err)
+		assert.NoError(pm.UnpinPage(scan[0], false))
+		frame := pm.pageTable[scan[0]]
+		assert.Equal(strategy, pm.ringOwner[frame])
+
+		// 通常の取得で参照されたページは、リングで使い回さない
+		_, err = pm.FetchPage(scan[0])
+		assert.NoError(err)
+		assert.NoError(pm.UnpinPage(scan[0], false))
+		assert.Nil(pm.ringOwner[frame])
+		for _, pageID := range scan[1:5] {
+			_, err := pm.FetchPageWithStrategy(pageID, strategy)
+			assert.NoError(err)
+			assert.NoError(pm.UnpinPage(pageID, false))
+		}
+		assert.Equal(frame, pm.pageTable[scan[0]])
+
+		// ピンされたリングのフレームも使い回さない
+		_, err = pm.FetchPageWithStrategy(scan[5], strategy)
+		assert.NoError(err)
+		for _, pageID := range scan[6:10] {
+			_, err := pm.FetchPageWithStrategy(pageID, strategy)
+			assert.NoError(err)
+			assert.NoError(pm.UnpinPage(pageID, false))
+		}
+		p, err := pm.FetchPage(scan[5])
+		assert.NoError(err)
+		assert.Equal([]byte("page13"), p.GetAllData()[:6])
+		assert.Equal(uint(2), p.PinCount)
+		assert.NoError(pm.UnpinPage(scan[5], false))
+		assert.NoError(pm.UnpinPage(scan[5], false))
+	})
+}
@@ -0,0 +1,332 @@
+package pool
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/page"
+	"github.com/yuya-isaka/chibidb/wal"
+)
+
+// ページの更新をまとめてログに記録し、不可分に反映する単位
+// トランザクションは1つ以上の操作で構成される
+// 操作中に更新するページは排他ラッチを取得した状態でTrackに登録し、ピンとラッチを保持する
+// 更新したページはコミットレコード（またはアボートレコード）をログに記録するまで他の利用者が読み書きできないので、
+// 復旧時に更新前のイメージで戻しても、他のトランザクションがコミットした更新を消さない
+// （BeginExclusiveのトランザクションは、終了まで他のトランザクションを開始させないので、操作の終了（Apply）で解放する）
+type Txn struct {
+	pm        *PoolManager
+	id        uint64
+	exclusive bool
+	pages     []*txnPage // 実行中の操作で登録したページ（登録順）
+	logged    bool       // ログに記録した更新があるか
+
+	// Applyでログに記録したページの、トランザクション開始前のイメージ（ロールバック用）
+	undo    map[disk.PageID][]byte
+	order   []disk.PageID        // 最初に記録した順のページID
+	created map[disk.PageID]bool // トランザクション内で作成したページ
+	freed   []disk.PageID        // コミット後に空きページに戻すページ
+
+	done bool
+}
+
+// トランザクションに登録したページ
+type txnPage struct {
+	page    *page.Page
+	before  []byte // 登録時のページイメージ
+	created bool   // トランザクション内で作成したページか
+	applied bool   // Applyでログに記録した後も、トランザクションの終了までピンとラッチを保持しているページか
+}
+
+// 1つの操作で構成されるトランザクションを開始
+// 他のトランザクションと並行して実行できる
+// 更新したページ（トランザクション内で作成したページを除く）は、Applyの後も終了までピンとラッチを保持するので、
+// 多くのページを更新する場合はBeginExclusiveを使用すること
+// チェックポイント（Sync）はすべてのトランザクションが終わるまで待つので、
+// トランザクションを開始したゴルーチンは、終了前にSyncやCloseを呼び出さないこと
+func (pm *PoolManager) Begin() *Txn {
+	pm.txnLatch.RLock()
+	return pm.newTxn(false)
+}
+
+// 複数の操作で構成されるトランザクションを開始
+// Abortで更新前のイメージに戻しても他の更新を消さないよう、終了まで他のトランザクションを開始させない
+// トランザクションを開始したゴルーチンは、終了前に他のトランザクションを開始しないこと
+func (pm *PoolManager) BeginExclusive() *Txn {
+	pm.txnLatch.Lock()
+	return pm.newTxn(true)
+}
+
+func (pm *PoolManager) newTxn(exclusive bool) *Txn {
+	return &Txn{
+		pm:        pm,
+		id:        pm.nextTxnID.Add(1),
+		exclusive: exclusive,
+		undo:      make(map[disk.PageID][]byte),
+		created:   make(map[disk.PageID]bool),
+	}
+}
+
+// ピンと排他ラッチを取得済みのページを登録し、更新前のイメージを保存
+// 登録したページのピンとラッチは、トランザクションが解放する
+func (tx *Txn) Track(p *page.Page) {
+	tx.track(p, false)
+}
+
+// CreatePageで作成したページを登録
+// 操作を取り消した場合、作成したページは空きページに戻す
+func (tx *Txn) TrackNew(p *page.Page) {
+	tx.track(p, true)
+}
+
+func (tx *Txn) track(p *page.Page, created bool) {
+	if tx.find(p.PageID) >= 0 {
+		return
+	}
+	tx.pages = append(tx.pages, &txnPage{
+		page:    p,
+		before:  append([]byte(nil), p.GetAllData()...),
+		created: created,
+	})
+}
+
+// 登録済みのページを返却（登録されていない場合はnil）
+// 排他ラッチを保持しているページを再び取得しようとしないために使用する
+func (tx *Txn) Page(pageID disk.PageID) *page.Page {
+	if i := tx.find(pageID); i >= 0 {
+		return tx.pages[i].page
+	}
+	return nil
+}
+
+// 登録したページのピンとラッチを解放
+// ページが更新されている場合は、操作の終了まで保持し続ける
+func (tx *Txn) Release(p *page.Page) {
+	i := tx.find(p.PageID)
+	if i < 0 || tx.pages[i].applied || tx.pages[i].modified() {
+		return
+	}
+	tx.pages = append(tx.pages[:i], tx.pages[i+1:]...)
+	p.WUnlatch()
+	tx.pm.UnpinPage(p.PageID, false)
+}
+
+// コミット後にページを空きページに戻すよう登録
+// コミット時にピンされているページは、次のチェックポイント（Sync）で戻す
+// アボートした場合は解放しない
+func (tx *Txn) Free(pageID disk.PageID) {
+	tx.freed = append(tx.freed, pageID)
+}
+
+// 実行中の操作で更新したページをログに記録し、操作を終了
+// BeginExclusiveのトランザクションのページと、トランザクション内で作成したページはピンとラッチを解放する
+// それ以外の更新したページは、コミットされていない更新を他のトランザクションが上書きしないよう、トランザクションの終了まで保持する
+// ログはコミットまでファイルと同期しない
+func (tx *Txn) Apply() {
+	tx.log()
+	var held []*txnPage
+	for _, tp := range tx.pages {
+		if tp.applied && !tx.exclusive && !tp.created {
+			held = append(held, tp)
+			continue
+		}
+		tp.page.WUnlatch()
+		tx.pm.UnpinPage(tp.page.PageID, false)
+	}
+	tx.pages = held
+}
+
+// 登録時から更新したページをログに記録
+// 記録したページは、記録した時点のイメージを次の操作の更新前のイメージとする
+func (tx *Txn) log() {
+	for _, tp := range tx.pages {
+		if !tp.modified() {
+			continue
+		}
+		tx.pm.wal.Append(&wal.Record{
+			TxnID:  tx.id,
+			Type:   wal.PageRecord,
+			PageID: tp.page.PageID,
+			Before: tp.before,
+		}, func(lsn uint64) []byte {
+			tp.page.SetLSN(lsn)
+			return append([]byte(nil), tp.page.GetAllData()...)
+		})
+		tx.logged = true
+
+		if _, ok := tx.undo[tp.page.PageID]; !ok {
+			tx.undo[tp.page.PageID] = tp.before
+			tx.order = append(tx.order, tp.page.PageID)
+		}
+		if tp.created {
+			tx.created[tp.page.PageID] = true
+		}
+		tp.before = append([]byte(nil), tp.page.GetAllData()...)
+		tp.applied = true
+	}
+}
+
+// 登録したページのピンとラッチをすべて解放
+func (tx *Txn) release() {
+	for _, tp := range tx.pages {
+		tp.page.WUnlatch()
+		tx.pm.UnpinPage(tp.page.PageID, false)
+	}
+	tx.pages = nil
+}
+
+// 実行中の操作で更新したページを登録時のイメージに戻し、ピンとラッチを解放
+// 操作中に作成したページは空きページに戻す（戻せなかったページは、どこからも参照されない無効なページとして残る）
+// それまでにApplyした更新は残るので、トランザクションは続けて使用できる（Applyで保持したページは保持し続ける）
+func (tx *Txn) Discard() {
+	var created []disk.PageID
+	var held []*txnPage
+	for _, tp := range tx.pages {
+		if tp.modified() {
+			tp.page.SetData(0, uint16(tp.page.Size()), tp.before)
+		}
+		if tp.applied {
+			held = append(held, tp)
+			continue
+		}
+		if tp.created {
+			created = append(created, tp.page.PageID)
+		}
+		tp.page.WUnlatch()
+		tx.pm.UnpinPage(tp.page.PageID, false)
+	}
+	tx.pages = held
+
+	for _, pageID := range created {
+		tx.pm.DeletePage(pageID)
+	}
+}
+
+// 実行中の操作の更新をログに記録してコミット
+// コミットレコードをwal.Durabilityに従って永続化するまで、更新したページのピンとラッチを保持する
+// （コミット前の更新を他のトランザクションが上書きしてコミットすると、異常終了時にその更新が取り消されてしまうため）
+// その後、Freeで登録したページを空きページに戻す
+func (tx *Txn) Commit() error {
+	if tx.done {
+		return nil
+	}
+	tx.log()
+
+	var err error
+	// 更新がなければ記録しない
+	if tx.logged {
+		lsn := tx.pm.wal.Append(&wal.Record{TxnID: tx.id, Type: wal.CommitRecord}, nil)
+		if len(tx.freed) > 0 {
+			// 木から外したページを空きページに戻す前に、外した更新を必ず同期する
+			// （異常終了後に、木から参照されている空きページが残らないように）
+			err = tx.pm.wal.Flush(lsn)
+		} else {
+			err = tx.pm.wal.Commit(lsn)
+		}
+	}
+	tx.release()
+	tx.finish()
+	if err != nil {
+		return err
+	}
+
+	// 古い位置を覚えているカーソルがピンしている場合は、次のチェックポイント（Sync）で空きページに戻す
+	for _, pageID := range tx.freed {
+		err := tx.pm.DeletePage(pageID)
+		if errors.Is(err, ErrPagePinned) {
+			tx.pm.deferFree(pageID)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 実行中の操作を取り消し、Applyした更新をトランザクション開始前のイメージに戻してアボート
+// 戻した更新は補償レコードとしてログに記録するので、復旧時に再び取り消されることはない
+// 途中で戻せなかった場合はエラーを返却する（戻せなかった更新は、次回の起動時にログから取り消される）
+func (tx *Txn) Abort() error {
+	if tx.done {
+		return nil
+	}
+	defer tx.finish()
+
+	tx.Discard()
+	// Applyで保持したページは、アボートレコードを記録するまで保持する
+	defer tx.release()
+
+	// 新しく記録したものから順に戻す
+	for i := len(tx.order) - 1; i >= 0; i-- {
+		pageID := tx.order[i]
+		if p := tx.Page(pageID); p != nil {
+			tx.restore(p)
+			continue
+		}
+		p, err := tx.pm.FetchPage(pageID)
+		if err != nil {
+			return err
+		}
+		p.WLatch()
+		tx.restore(p)
+		p.WUnlatch()
+		tx.pm.UnpinPage(pageID, false)
+	}
+	if tx.logged {
+		tx.pm.wal.Append(&wal.Record{TxnID: tx.id, Type: wal.AbortRecord}, nil)
+	}
+
+	// 作成したページは、どこからも参照されなくなったので空きページに戻す
+	for pageID := range tx.created {
+		tx.pm.DeletePage(pageID)
+	}
+	return nil
+}
+
+// 排他ラッチを取得したページを、トランザクション開始前のイメージに戻す補償レコードを記録
+func (tx *Txn) restore(p *page.Page) {
+	before := tx.undo[p.PageID]
+	if bytes.Equal(before, p.GetAllData()) {
+		return
+	}
+	tx.pm.wal.Append(&wal.Record{
+		TxnID:  tx.id,
+		Type:   wal.PageRecord,
+		PageID: p.PageID,
+		Before: append([]byte(nil), p.GetAllData()...),
+	}, func(lsn uint64) []byte {
+		p.SetData(0, uint16(p.Size()), before)
+		p.SetLSN(lsn)
+		return append([]byte(nil), p.GetAllData()...)
+	})
+}
+
+// トランザクションを終了
+func (tx *Txn) finish() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	if tx.exclusive {
+		tx.pm.txnLatch.Unlock()
+	} else {
+		tx.pm.txnLatch.RUnlock()
+	}
+}
+
+// 登録したページのインデックスを返却（登録されていない場合は-1）
+func (tx *Txn) find(pageID disk.PageID) int {
+	for i, tp := range tx.pages {
+		if tp.page.PageID == pageID {
+			return i
+		}
+	}
+	return -1
+}
+
+// 登録時からページが更新されているかを判定
+func (tp *txnPage) modified() bool {
+	return !bytes.Equal(tp.before, tp.page.GetAllData())
+}
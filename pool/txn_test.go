@@ -0,0 +1,213 @@
+package pool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/page"
+	"github.com/yuya-isaka/chibidb/wal"
+)
+
+// ページを取得して排他ラッチを取得し、トランザクションに登録
+func fetchTracked(tx *Txn, pm *PoolManager, pageID disk.PageID) (*page.Page, error) {
+	p, err := pm.FetchPage(pageID)
+	if err != nil {
+		return nil, err
+	}
+	p.WLatch()
+	tx.Track(p)
+	return p, nil
+}
+
+func TestTxn(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Commit", func(t *testing.T) {
+		pm, err := NewPoolManager(t.TempDir()+"/dbfile", 10)
+		assert.NoError(err)
+		defer pm.Close()
+
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+		otherID, err := pm.CreatePage()
+		assert.NoError(err)
+
+		tx := pm.Begin()
+		p, err := fetchTracked(tx, pm, pageID)
+		assert.NoError(err)
+		other, err := fetchTracked(tx, pm, otherID)
+		assert.NoError(err)
+		p.SetData(100, 104, []byte("data"))
+
+		// 更新していないページは途中で解放できる
+		tx.Release(other)
+		assert.Nil(tx.Page(otherID))
+		// 更新したページは解放されずに保持される
+		tx.Release(p)
+		assert.Equal(p, tx.Page(pageID))
+		assert.NoError(tx.Commit())
+
+		// 更新したページだけがログに記録され、ページLSNが設定される
+		records, err := pm.wal.Records()
+		assert.NoError(err)
+		assert.Len(records, 2)
+		assert.Equal(wal.PageRecord, records[0].Type)
+		assert.Equal(pageID, records[0].PageID)
+		assert.Equal(records[0].LSN, p.GetLSN())
+		assert.Equal(p.GetAllData(), records[0].After)
+		assert.Equal(wal.CommitRecord, records[1].Type)
+		assert.Equal(records[0].TxnID, records[1].TxnID)
+
+		// コミット後はピンとラッチが解放されている
+		assert.Equal(uint(0), p.PinCount)
+		assert.True(p.TryWLatch())
+		p.WUnlatch()
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		pm, err := NewPoolManager(t.TempDir()+"/dbfile", 10)
+		assert.NoError(err)
+		defer pm.Close()
+
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+
+		tx := pm.Begin()
+		p, err := fetchTracked(tx, pm, pageID)
+		assert.NoError(err)
+		before := append([]byte(nil), p.GetAllData()...)
+		p.SetData(100, 104, []byte("data"))
+
+		// トランザクション内で作成したページ
+		newID, err := pm.CreatePage()
+		assert.NoError(err)
+		newPage, err := pm.FetchPage(newID)
+		assert.NoError(err)
+		newPage.WLatch()
+		tx.TrackNew(newPage)
+		newPage.SetNodeType(page.LeafNodeType)
+		tx.Abort()
+
+		// 更新前のイメージに戻り、ログには何も記録されない
+		assert.Equal(before, p.GetAllData())
+		records, err := pm.wal.Records()
+		assert.NoError(err)
+		assert.Empty(records)
+
+		// 作成したページは空きページに戻され、再利用される
+		reusedID, err := pm.CreatePage()
+		assert.NoError(err)
+		assert.Equal(newID, reusedID)
+	})
+
+	t.Run("Apply And Abort", func(t *testing.T) {
+		pm, err := NewPoolManager(t.TempDir()+"/dbfile", 10)
+		assert.NoError(err)
+		defer pm.Close()
+
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+		p, err := pm.FetchPage(pageID)
+		assert.NoError(err)
+		before := append([]byte(nil), p.GetAllData()...)
+		assert.NoError(pm.UnpinPage(pageID, false))
+
+		// 複数の操作をApplyでログに記録
+		tx := pm.BeginExclusive()
+		for _, data := range []string{"first", "second"} {
+			p, err := fetchTracked(tx, pm, pageID)
+			assert.NoError(err)
+			p.SetData(100, uint16(100+len(data)), []byte(data))
+			tx.Apply()
+		}
+		assert.Equal([]byte("second"), p.GetAllData()[100:106])
+
+		// 実行中の操作だけを取り消す
+		p, err = fetchTracked(tx, pm, pageID)
+		assert.NoError(err)
+		p.SetData(100, 105, []byte("third"))
+		tx.Discard()
+		assert.Equal([]byte("second"), p.GetAllData()[100:106])
+
+		// アボートすると、トランザクション開始前のイメージに戻す補償レコードを記録
+		assert.NoError(tx.Abort())
+		assert.Equal(before[100:106], p.GetAllData()[100:106])
+		assert.NoError(pm.wal.Flush(pm.wal.NextLSN()))
+		records, err := pm.wal.Records()
+		assert.NoError(err)
+		assert.Len(records, 4)
+		assert.Equal(wal.PageRecord, records[2].Type)
+		assert.Equal(p.GetAllData(), records[2].After)
+		assert.Equal(records[2].LSN, p.GetLSN())
+		assert.Equal(wal.AbortRecord, records[3].Type)
+	})
+
+	t.Run("Sync Waits For Txn", func(t *testing.T) {
+		pm, err := NewPoolManager(t.TempDir()+"/dbfile", 10)
+		assert.NoError(err)
+		defer pm.Close()
+
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+
+		tx := pm.Begin()
+		p, err := fetchTracked(tx, pm, pageID)
+		assert.NoError(err)
+		p.SetData(100, 104, []byte("data"))
+
+		// チェックポイントは実行中のトランザクションが終わるまで待つ
+		done := make(chan error)
+		go func() {
+			done <- pm.Sync()
+		}()
+		assert.NoError(tx.Commit())
+		assert.NoError(<-done)
+
+		// チェックポイント後はログが破棄され、LSNは引き続き増加する
+		records, err := pm.wal.Records()
+		assert.NoError(err)
+		assert.Empty(records)
+		assert.Greater(pm.wal.NextLSN(), p.GetLSN())
+	})
+	t.Run("Free Pinned Page", func(t *testing.T) {
+		pm, err := NewPoolManager(t.TempDir()+"/dbfile", 10)
+		assert.NoError(err)
+		defer pm.Close()
+
+		pageID, err := pm.CreatePage()
+		assert.NoError(err)
+		freedID, err := pm.CreatePage()
+		assert.NoError(err)
+
+		// カーソルが古い位置のページをピンしている間にコミット
+		_, err = pm.FetchPage(freedID)
+		assert.NoError(err)
+		tx := pm.Begin()
+		p, err := fetchTracked(tx, pm, pageID)
+		assert.NoError(err)
+		p.SetData(100, 104, []byte("data"))
+		tx.Free(freedID)
+		assert.NoError(tx.Commit())
+		freePageIDs, err := pm.storage.FreePages()
+		assert.NoError(err)
+		assert.Empty(freePageIDs)
+
+		// ピンされている間は、チェックポイントでも空きページに戻さない
+		assert.NoError(pm.Sync())
+		freePageIDs, err = pm.storage.FreePages()
+		assert.NoError(err)
+		assert.Empty(freePageIDs)
+
+		// ピンが解放された後のチェックポイントで空きページに戻し、再利用する
+		assert.NoError(pm.UnpinPage(freedID, false))
+		assert.NoError(pm.Sync())
+		freePageIDs, err = pm.storage.FreePages()
+		assert.NoError(err)
+		assert.Equal([]disk.PageID{freedID}, freePageIDs)
+		reusedID, err := pm.CreatePage()
+		assert.NoError(err)
+		assert.Equal(freedID, reusedID)
+	})
+}
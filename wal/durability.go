@@ -0,0 +1,134 @@
+package wal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+// コミットしたトランザクションを、どこまで永続化してから戻るか
+// どのモードでも、Flush（ページを書き出す前やチェックポイント）では同期する
+type Durability int
+
+const (
+	// コミットごとにログを書き込んで同期する（デフォルト）
+	DurabilityFull Durability = iota
+	// 同時期にコミットしたトランザクションをまとめて同期する
+	// 最初にコミットしたトランザクションが、時間（window）かサイズ（bytes）の上限まで他のコミットを待ってから同期する
+	DurabilityGroupCommit
+	// コミットでログをファイルに書き込むが同期しない
+	// プロセスが異常終了してもコミットは失われないが、OSが停止すると失われる
+	DurabilityOSBuffered
+	// コミットでログを書き込まない
+	// 異常終了すると、最後に同期した後のコミットは失われる（木の一貫性は保たれる）
+	DurabilityNone
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityFull:
+		return "Full"
+	case DurabilityGroupCommit:
+		return "GroupCommit"
+	case DurabilityOSBuffered:
+		return "OSBuffered"
+	case DurabilityNone:
+		return "None"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+const (
+	DefaultGroupCommitWindow = time.Millisecond // グループコミットで他のコミットを待つ時間のデフォルト
+	DefaultGroupCommitBytes  = 1 << 20          // グループコミットで待たずに同期するレコードのサイズのデフォルト
+)
+
+// Openの設定を変更するオプション
+type Option func(l *Log)
+
+// コミットの永続性を指定するオプション（デフォルトはDurabilityFull）
+func WithDurability(durability Durability) Option {
+	return func(l *Log) {
+		l.durability = durability
+	}
+}
+
+// グループコミットで他のコミットを待つ時間と、待たずに同期するレコードのサイズを指定するオプション
+func WithGroupCommitWindow(window time.Duration, bytes int) Option {
+	return func(l *Log) {
+		l.group.window = window
+		l.group.bytes = bytes
+	}
+}
+
+// コミットレコードを追加した後に呼び出し、Durabilityに従ってlsnまでのレコードを永続化
+func (l *Log) Commit(lsn uint64) error {
+	if l.readOnly {
+		return disk.ErrReadOnly
+	}
+	switch l.durability {
+	case DurabilityGroupCommit:
+		return l.groupFlush(lsn)
+	case DurabilityOSBuffered:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.writeLocked()
+	case DurabilityNone:
+		return nil
+	}
+	return l.Flush(lsn)
+}
+
+// グループコミットの状態（Logのmuで保護）
+type groupCommit struct {
+	window  time.Duration
+	bytes   int
+	leading bool          // 同期を担当するゴルーチン（リーダー）が待機中か
+	full    chan struct{} // 溜まったレコードがbytesを超えたら閉じて、リーダーを起こす
+}
+
+// レコードを追加したときに呼び出し、溜まったレコードがbytesを超えていればリーダーを起こす
+func (g *groupCommit) notify(buffered int) {
+	if g.leading && g.full != nil && buffered >= g.bytes {
+		close(g.full)
+		g.full = nil
+	}
+}
+
+// lsnまでのレコードを、他のコミットとまとめて同期
+// 待機中のリーダーがいれば、その同期を待つ（間に合わなければ自分がリーダーになる）
+// いなければリーダーとしてwindowの間だけ他のコミットを待ってから、溜まったレコードをすべて同期する
+func (l *Log) groupFlush(lsn uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.group.leading && lsn > l.flushedLSN {
+		l.flushed.Wait()
+	}
+	if lsn <= l.flushedLSN {
+		return nil
+	}
+
+	// リーダーとして他のコミットを待つ
+	l.group.leading = true
+	full := make(chan struct{})
+	l.group.full = full
+	l.group.notify(len(l.buf))
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.group.window)
+	select {
+	case <-timer.C:
+	case <-full:
+		timer.Stop()
+	}
+
+	l.mu.Lock()
+	l.group.leading = false
+	l.group.full = nil
+	err := l.flushLocked(l.nextLSN - 1)
+	// 失敗した場合も、待っているゴルーチンを起こして自分で同期させる
+	l.flushed.Broadcast()
+	return err
+}
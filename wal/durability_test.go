@@ -0,0 +1,134 @@
+package wal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+// 同期の回数を数えるファイル
+type syncCounter struct {
+	memFile
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncs++
+	return nil
+}
+
+func (s *syncCounter) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncs
+}
+
+func TestDurability(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	commit := func(l *Log, txnID uint64) error {
+		l.Append(&Record{TxnID: txnID, Type: PageRecord, PageID: disk.PageID(txnID), After: []byte("after")}, nil)
+		return l.Commit(l.Append(&Record{TxnID: txnID, Type: CommitRecord}, nil))
+	}
+	// 同期したレコードの最大LSNを返却
+	synced := func(l *Log) uint64 {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.flushedLSN
+	}
+
+	t.Run("Full", func(t *testing.T) {
+		file := &syncCounter{}
+		l, err := newLog(nil).open(file)
+		assert.NoError(err)
+
+		for i := range 3 {
+			assert.NoError(commit(l, uint64(i+1)))
+		}
+		assert.Equal(3, file.count())
+		assert.Equal(uint64(6), synced(l))
+	})
+
+	t.Run("Group Commit", func(t *testing.T) {
+		file := &syncCounter{}
+		l, err := newLog([]Option{WithDurability(DurabilityGroupCommit), WithGroupCommitWindow(20*time.Millisecond, 1<<20)}).open(file)
+		assert.NoError(err)
+
+		// 同時にコミットしたトランザクションは、まとめて同期される
+		var wg sync.WaitGroup
+		for i := range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(commit(l, uint64(i+1)))
+			}()
+		}
+		wg.Wait()
+		assert.Less(file.count(), 20)
+		assert.Equal(uint64(40), synced(l))
+
+		records, err := l.Records()
+		assert.NoError(err)
+		assert.Len(records, 40)
+	})
+
+	t.Run("Group Commit Size", func(t *testing.T) {
+		file := &syncCounter{}
+		l, err := newLog([]Option{WithDurability(DurabilityGroupCommit), WithGroupCommitWindow(time.Hour, 50)}).open(file)
+		assert.NoError(err)
+
+		// 溜まったレコードがサイズの上限を超えていれば、時間まで待たずに同期する
+		done := make(chan error)
+		go func() { done <- commit(l, 1) }()
+		select {
+		case err := <-done:
+			assert.NoError(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("group commit did not flush when the batch was full")
+		}
+		assert.Equal(1, file.count())
+	})
+
+	t.Run("OS Buffered", func(t *testing.T) {
+		file := &syncCounter{}
+		l, err := newLog([]Option{WithDurability(DurabilityOSBuffered)}).open(file)
+		assert.NoError(err)
+
+		// コミットでファイルに書き込まれるが、同期はされない
+		assert.NoError(commit(l, 1))
+		records, err := l.Records()
+		assert.NoError(err)
+		assert.Len(records, 2)
+		assert.Equal(0, file.count())
+		assert.Equal(uint64(0), synced(l))
+
+		// Flushで同期される
+		assert.NoError(l.Flush(2))
+		assert.Equal(1, file.count())
+		assert.Equal(uint64(2), synced(l))
+	})
+
+	t.Run("None", func(t *testing.T) {
+		file := &syncCounter{}
+		l, err := newLog([]Option{WithDurability(DurabilityNone)}).open(file)
+		assert.NoError(err)
+
+		// コミットではファイルに書き込まれない
+		assert.NoError(commit(l, 1))
+		records, err := l.Records()
+		assert.NoError(err)
+		assert.Empty(records)
+
+		assert.NoError(l.Flush(2))
+		records, err = l.Records()
+		assert.NoError(err)
+		assert.Len(records, 2)
+		assert.Equal(1, file.count())
+	})
+}
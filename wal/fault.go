@@ -0,0 +1,206 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+// 障害の種類
+type faultKind int
+
+const (
+	failWrite  faultKind = iota // 書き込みを失敗させる
+	shortWrite                  // 先頭だけを書き込んで失敗させる
+	tearWrite                   // 先頭だけを書き込んだところで電源断を起こす
+)
+
+// Syncしていない書き込みまたは切り詰め
+type pendingOp struct {
+	off      int64
+	data     []byte
+	truncate bool // 切り詰め（offは切り詰めた後のサイズ）
+}
+
+// 予約した障害
+type fault struct {
+	kind faultKind
+	n    int // 何回目の書き込みで起こすか（作成時からの通算）
+	size int // 書き込むバイト数（shortWrite、tearWriteの場合）
+}
+
+// 障害を注入できる、メモリ上のログファイル
+// ログの書き込みが失敗したり途中で中断されたりしたときの振る舞いを、disk.FaultStorageと組み合わせてテストするために使用する
+// Syncまでの書き込みと切り詰めは揮発性のキャッシュにあるものとして扱い、Crashで失われる
+// 障害のエラーはdisk.FaultStorageと同じく、disk.ErrInjectedFaultとdisk.ErrPowerLoss
+type FaultFile struct {
+	mu      sync.Mutex
+	current *memFile    // 現在の内容（Syncしていない書き込みを含む）
+	durable *memFile    // 最後にSyncした時点の内容
+	pending []pendingOp // 最後にSyncした後の書き込みと切り詰め（Syncでdurableに反映する）
+	faults  []fault     // まだ起きていない障害
+	writes  int         // WriteAtの呼び出し回数
+	powered bool        // 電源が入っているか（falseの場合はCrashまですべての操作が失敗する）
+}
+
+// 空のFaultFileを作成
+func NewFaultFile() *FaultFile {
+	return &FaultFile{
+		current: &memFile{},
+		durable: &memFile{},
+		powered: true,
+	}
+}
+
+// FaultFileをファイルとしてログを開く
+// Crashの後に開き直すと、最後にSyncした時点のレコードから復旧できる
+func OpenFault(f *FaultFile, opts ...Option) (*Log, error) {
+	return newLog(opts).open(f)
+}
+
+// n回後（1なら次）の書き込みをdisk.ErrInjectedFaultで失敗させる（何も書き込まれない）
+func (f *FaultFile) FailWrite(n int) {
+	f.inject(fault{kind: failWrite, n: f.Writes() + n})
+}
+
+// n回後（1なら次）の書き込みで、先頭sizeバイトだけを書き込んでio.ErrShortWriteで失敗させる
+func (f *FaultFile) ShortWrite(n int, size int) {
+	f.inject(fault{kind: shortWrite, n: f.Writes() + n, size: size})
+}
+
+// n回後（1なら次）の書き込みで、先頭sizeバイトを書き込んだところで電源断を起こす
+// 書き込んだ部分だけが永続化され、以降の操作はCrashを呼び出すまでdisk.ErrPowerLossで失敗する
+func (f *FaultFile) TearWrite(n int, size int) {
+	f.inject(fault{kind: tearWrite, n: f.Writes() + n, size: size})
+}
+
+func (f *FaultFile) inject(ft fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, ft)
+}
+
+// 電源断を起こし、Syncしていない書き込みをすべて破棄して最後にSyncした時点の内容に戻す
+// 予約した障害も破棄する
+func (f *FaultFile) Crash() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.current = f.durable.clone()
+	f.pending = nil
+	f.faults = nil
+	f.powered = true
+}
+
+// WriteAtの呼び出し回数を返却
+func (f *FaultFile) Writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+// 指定した回数の書き込みで起こす障害を取り出す
+// f.muを取得した状態で呼び出すこと
+func (f *FaultFile) take(n int) (fault, bool) {
+	for i, ft := range f.faults {
+		if ft.n == n {
+			f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			return ft, true
+		}
+	}
+	return fault{}, false
+}
+
+// 電源断の後であればdisk.ErrPowerLossを返却
+// f.muを取得した状態で呼び出すこと
+func (f *FaultFile) check() error {
+	if !f.powered {
+		return disk.ErrPowerLoss
+	}
+	return nil
+}
+
+func (f *FaultFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.current.ReadAt(b, off)
+}
+
+func (f *FaultFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	f.writes++
+	ft, ok := f.take(f.writes)
+	if !ok {
+		f.pending = append(f.pending, pendingOp{off: off, data: append([]byte(nil), b...)})
+		return f.current.WriteAt(b, off)
+	}
+
+	if ft.kind == failWrite {
+		return 0, fmt.Errorf("%w。ログの書き込みに失敗しました。オフセット: %d", disk.ErrInjectedFault, off)
+	}
+
+	// 先頭だけを書き込む
+	size := min(max(ft.size, 0), len(b))
+	if _, err := f.current.WriteAt(b[:size], off); err != nil {
+		return 0, err
+	}
+	f.pending = append(f.pending, pendingOp{off: off, data: append([]byte(nil), b[:size]...)})
+	if ft.kind == shortWrite {
+		return size, fmt.Errorf("%w。%w。オフセット: %d, 書き込んだサイズ: %d バイト", disk.ErrInjectedFault, io.ErrShortWrite, off, size)
+	}
+
+	// 書き込み途中の部分だけが永続化された状態で電源断
+	if _, err := f.durable.WriteAt(b[:size], off); err != nil {
+		return 0, err
+	}
+	f.powered = false
+	return size, disk.ErrPowerLoss
+}
+
+// 現在の内容を永続化する
+func (f *FaultFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	for _, op := range f.pending {
+		if op.truncate {
+			f.durable.Truncate(op.off)
+			continue
+		}
+		f.durable.WriteAt(op.data, op.off)
+	}
+	f.pending = nil
+	return nil
+}
+
+func (f *FaultFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	f.pending = append(f.pending, pendingOp{off: size, truncate: true})
+	return f.current.Truncate(size)
+}
+
+// 内容は破棄しないので、閉じた後も同じFaultFileで開き直せる
+func (f *FaultFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.check()
+}
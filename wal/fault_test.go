@@ -0,0 +1,96 @@
+package wal
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+func TestFaultFile(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	// 1件目のトランザクションをコミットしたログを作成
+	setup := func(t *testing.T) (*FaultFile, *Log) {
+		f := NewFaultFile()
+		l, err := OpenFault(f)
+		assert.NoError(err)
+		l.Append(&Record{TxnID: 1, Type: PageRecord, PageID: disk.PageID(1), Before: []byte("before"), After: []byte("after")}, nil)
+		assert.NoError(l.Flush(l.Append(&Record{TxnID: 1, Type: CommitRecord}, nil)))
+		return f, l
+	}
+	// 2件目のトランザクションのレコードを追加し、コミットレコードのLSNを返却
+	appendTxn := func(l *Log) uint64 {
+		l.Append(&Record{TxnID: 2, Type: PageRecord, PageID: disk.PageID(2), Before: []byte("before"), After: []byte("after")}, nil)
+		return l.Append(&Record{TxnID: 2, Type: CommitRecord}, nil)
+	}
+	// Crashの後に開き直し、レコードのトランザクションIDを返却
+	reopen := func(f *FaultFile) []uint64 {
+		f.Crash()
+		l, err := OpenFault(f)
+		assert.NoError(err)
+		records, err := l.Records()
+		assert.NoError(err)
+		var txnIDs []uint64
+		for _, record := range records {
+			txnIDs = append(txnIDs, record.TxnID)
+		}
+		return txnIDs
+	}
+
+	t.Run("Crash Drops Unsynced Writes", func(t *testing.T) {
+		f, l := setup(t)
+		appendTxn(l)
+		l.mu.Lock()
+		assert.NoError(l.writeLocked())
+		l.mu.Unlock()
+
+		assert.Equal([]uint64{1, 1}, reopen(f))
+	})
+
+	t.Run("Fail Write", func(t *testing.T) {
+		f, l := setup(t)
+		f.FailWrite(1)
+		lsn := appendTxn(l)
+		assert.ErrorIs(l.Flush(lsn), disk.ErrInjectedFault)
+
+		// 書き込めなかったレコードは残っていて、次のFlushで書き込まれる
+		assert.NoError(l.Flush(lsn))
+		assert.Equal([]uint64{1, 1, 2, 2}, reopen(f))
+	})
+
+	t.Run("Short Write", func(t *testing.T) {
+		f, l := setup(t)
+		f.ShortWrite(1, 20)
+		assert.ErrorIs(l.Flush(appendTxn(l)), io.ErrShortWrite)
+
+		// 同期していない途中までのレコードは失われる
+		assert.Equal([]uint64{1, 1}, reopen(f))
+	})
+
+	t.Run("Tear Write", func(t *testing.T) {
+		// 2件目のページレコードは52バイト
+		for _, tc := range []struct {
+			size   int
+			txnIDs []uint64
+		}{
+			{0, []uint64{1, 1}},
+			{20, []uint64{1, 1}},
+			{60, []uint64{1, 1, 2}},
+		} {
+			f, l := setup(t)
+			f.TearWrite(1, tc.size)
+			assert.ErrorIs(l.Flush(appendTxn(l)), disk.ErrPowerLoss)
+
+			// 電源断の後はCrashまですべての操作が失敗する
+			_, err := l.Records()
+			assert.ErrorIs(err, disk.ErrPowerLoss)
+			assert.ErrorIs(l.Reset(0), disk.ErrPowerLoss)
+
+			// 書き込み途中のレコードは、開き直すときに切り捨てられる（書き込み終えたレコードは残る）
+			assert.Equal(tc.txnIDs, reopen(f))
+		}
+	})
+}
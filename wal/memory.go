@@ -0,0 +1,67 @@
+package wal
+
+import (
+	"io"
+	"sync"
+)
+
+// メモリ上のファイル
+type memFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (m *memFile) ReadAt(b []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, m.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memFile) WriteAt(b []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if end := off + int64(len(b)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[off:], b), nil
+}
+
+func (m *memFile) Sync() error {
+	return nil
+}
+
+func (m *memFile) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if size <= int64(len(m.data)) {
+		m.data = m.data[:size]
+	} else {
+		m.data = append(m.data, make([]byte, size-int64(len(m.data)))...)
+	}
+	return nil
+}
+
+func (m *memFile) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data = nil
+	return nil
+}
+
+// 内容を複製したmemFileを返却
+func (m *memFile) clone() *memFile {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &memFile{data: append([]byte(nil), m.data...)}
+}
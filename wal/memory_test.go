@@ -0,0 +1,42 @@
+package wal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+func TestOpenMemory(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Append Flush Reset", func(t *testing.T) {
+		l, err := OpenMemory()
+		assert.NoError(err)
+		defer l.Close()
+
+		l.Append(&Record{TxnID: 1, Type: PageRecord, PageID: disk.PageID(1), Before: []byte("before"), After: []byte("after")}, nil)
+		lsn := l.Append(&Record{TxnID: 1, Type: CommitRecord}, nil)
+
+		// Flushするまでレコードは読み込めない
+		records, err := l.Records()
+		assert.NoError(err)
+		assert.Empty(records)
+
+		assert.NoError(l.Flush(lsn))
+		records, err = l.Records()
+		assert.NoError(err)
+		assert.Equal([]*Record{
+			{LSN: 1, TxnID: 1, Type: PageRecord, PageID: disk.PageID(1), Before: []byte("before"), After: []byte("after")},
+			{LSN: 2, TxnID: 1, Type: CommitRecord},
+		}, records)
+
+		// Resetでレコードが破棄され、LSNは引き継がれる
+		assert.NoError(l.Reset(0))
+		records, err = l.Records()
+		assert.NoError(err)
+		assert.Empty(records)
+		assert.Equal(uint64(3), l.NextLSN())
+	})
+}
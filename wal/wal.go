@@ -0,0 +1,354 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+// ログレコードの種類
+type RecordType uint8
+
+const (
+	PageRecord   RecordType = 1 // ページの更新（更新前と更新後のページイメージ）
+	CommitRecord RecordType = 2 // トランザクションのコミット
+	AbortRecord  RecordType = 3 // トランザクションのアボート（更新はすべて補償レコードで戻し済み）
+)
+
+// ログレコード
+// ファイル上では [ペイロード長 4byte][CRC32 4byte][ペイロード] の形式で格納される
+// ペイロードは [LSN 8byte][トランザクションID 8byte][種類 1byte][ページID 8byte][Before長 4byte][Before][After長 4byte][After]
+type Record struct {
+	LSN    uint64      // ログシーケンス番号（追加時に割り当てられる）
+	TxnID  uint64      // トランザクションID
+	Type   RecordType  // レコードの種類
+	PageID disk.PageID // 更新したページID（PageRecordの場合）
+	Before []byte      // 更新前のページイメージ（PageRecordの場合）
+	After  []byte      // 更新後のページイメージ（PageRecordの場合）
+}
+
+const (
+	recordHeaderSize = 8                       // ログレコードのヘッダサイズ（ペイロード長とCRC32）
+	maxPayloadSize   = 33 + 2*disk.MaxPageSize // ペイロードの最大サイズ（2つのページイメージを含む）
+)
+
+// 先行書き込みログ（Write-Ahead Log）
+// 追加したレコードはメモリ上に溜めておき、Flushでファイルに書き込んで同期する
+// コミットでどこまで書き込むかは、Durabilityで指定する（Commitを参照）
+// 複数のゴルーチンから同時に呼び出せる
+type Log struct {
+	file       file
+	mu         sync.Mutex
+	buf        []byte // ファイルに書き込んでいないレコード
+	size       int64  // ファイルに書き込んだレコードのサイズ
+	nextLSN    uint64 // 次に割り当てるLSN
+	writtenLSN uint64 // ファイルに書き込んだレコードの最大LSN（同期していないものを含む）
+	flushedLSN uint64 // ファイルに書き込んで同期したレコードの最大LSN
+
+	durability Durability  // コミットの永続性
+	group      groupCommit // グループコミットの状態
+	flushed    *sync.Cond  // flushedLSNの更新を待つ条件変数（muで保護）
+	readOnly   bool        // 読み取り専用で開いている
+}
+
+// ログファイルを開く
+// 末尾に書き込み途中のレコードがあれば切り捨てる
+func Open(path string, opts ...Option) (*Log, error) {
+	l := newLog(opts)
+
+	// 読み取り専用の場合、ファイルがなければ空のログとして扱う
+	if l.readOnly {
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return l.open(&memFile{})
+		}
+		if err != nil {
+			return nil, err
+		}
+		return l.open(file)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return l.open(file)
+}
+
+// メモリ上にレコードを保存するログを作成
+// 閉じると内容は失われるので、クラッシュからの回復には使えない
+func OpenMemory(opts ...Option) (*Log, error) {
+	return newLog(opts).open(&memFile{})
+}
+
+// 読み取り専用でログを開くオプション
+// ファイルを作成・変更せず、Flush、Commit、ResetはErrReadOnlyを返却する
+func WithReadOnly() Option {
+	return func(l *Log) {
+		l.readOnly = true
+	}
+}
+
+// ログを保存するファイル
+type file interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// オプションを適用したログを作成
+func newLog(opts []Option) *Log {
+	l := &Log{
+		nextLSN: 1,
+		group: groupCommit{
+			window: DefaultGroupCommitWindow,
+			bytes:  DefaultGroupCommitBytes,
+		},
+	}
+	l.flushed = sync.NewCond(&l.mu)
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// ファイルからレコードを読み込み、ログを使えるようにする
+func (l *Log) open(file file) (*Log, error) {
+	l.file = file
+
+	// 有効なレコードの末尾とLSNを調べる
+	records, size, err := l.read()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(records) > 0 {
+		l.nextLSN = records[len(records)-1].LSN + 1
+	}
+	l.writtenLSN = l.nextLSN - 1
+	l.flushedLSN = l.nextLSN - 1
+
+	// 書き込み途中のレコードを切り捨てる（読み取り専用の場合は、読み込むときに無視するだけ）
+	if l.readOnly {
+		l.size = size
+		return l, nil
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	l.size = size
+
+	return l, nil
+}
+
+// ファイルに書き込まれたすべてのレコードを返却
+func (l *Log) Records() ([]*Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records, _, err := l.read()
+	return records, err
+}
+
+// ファイルの先頭からレコードを読み込み、有効なレコードとその末尾の位置を返却
+// 長さやCRC32が不正なレコード以降は、書き込み途中で中断されたものとして扱う
+func (l *Log) read() ([]*Record, int64, error) {
+	var records []*Record
+	offset := int64(0)
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := l.file.ReadAt(header, offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return records, offset, nil
+			}
+			return nil, 0, fmt.Errorf("ログの読み込みに失敗しました。エラー詳細: %w", err)
+		}
+
+		payloadSize := binary.LittleEndian.Uint32(header[0:4])
+		if payloadSize > maxPayloadSize {
+			return records, offset, nil
+		}
+		payload := make([]byte, payloadSize)
+		if _, err := l.file.ReadAt(payload, offset+recordHeaderSize); err != nil {
+			if errors.Is(err, io.EOF) {
+				return records, offset, nil
+			}
+			return nil, 0, fmt.Errorf("ログの読み込みに失敗しました。エラー詳細: %w", err)
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			return records, offset, nil
+		}
+
+		record, ok := decode(payload)
+		if !ok {
+			return records, offset, nil
+		}
+		records = append(records, record)
+		offset += recordHeaderSize + int64(len(payload))
+	}
+}
+
+// レコードを追加し、割り当てたLSNを返却
+// afterが指定されている場合、LSNを割り当てた後に呼び出し、その戻り値を更新後のページイメージとする
+// （ページLSNを設定したイメージを記録するため）
+// 追加したレコードは、Flushを呼び出すまでファイルに書き込まれない
+func (l *Log) Append(record *Record, after func(lsn uint64) []byte) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record.LSN = l.nextLSN
+	l.nextLSN++
+	if after != nil {
+		record.After = after(record.LSN)
+	}
+
+	payload := encode(record)
+	header := make([]byte, recordHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	l.buf = append(l.buf, header...)
+	l.buf = append(l.buf, payload...)
+	l.group.notify(len(l.buf))
+
+	return record.LSN
+}
+
+// 指定したLSNまでのレコードをファイルに書き込んで同期
+// Durabilityに関わらず、戻ったときには指定したLSNまでのレコードが永続化されている
+func (l *Log) Flush(lsn uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.flushLocked(lsn)
+}
+
+// l.muを取得した状態で呼び出すFlush
+func (l *Log) flushLocked(lsn uint64) error {
+	if lsn <= l.flushedLSN || (len(l.buf) == 0 && l.writtenLSN == l.flushedLSN) {
+		return nil
+	}
+	if l.readOnly {
+		return disk.ErrReadOnly
+	}
+	if err := l.writeLocked(); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("ログの同期に失敗しました。エラー詳細: %w", err)
+	}
+	l.flushedLSN = l.writtenLSN
+	l.flushed.Broadcast()
+	return nil
+}
+
+// 溜めておいたレコードをファイルに書き込む（同期はしない）
+// l.muを取得した状態で呼び出すこと
+func (l *Log) writeLocked() error {
+	if len(l.buf) == 0 {
+		return nil
+	}
+	if _, err := l.file.WriteAt(l.buf, l.size); err != nil {
+		return fmt.Errorf("ログの書き込みに失敗しました。エラー詳細: %w", err)
+	}
+	l.size += int64(len(l.buf))
+	l.buf = l.buf[:0]
+	l.writtenLSN = l.nextLSN - 1
+	return nil
+}
+
+// すべてのレコードを破棄する
+// 以降に割り当てるLSNは、nextLSNとこれまでのLSNのうち大きい方から始まる
+// すべての更新がデータファイルに反映された後（チェックポイント）に呼び出すこと
+func (l *Log) Reset(nextLSN uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.readOnly {
+		return disk.ErrReadOnly
+	}
+
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("ログの切り詰めに失敗しました。エラー詳細: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("ログの同期に失敗しました。エラー詳細: %w", err)
+	}
+	l.buf = l.buf[:0]
+	l.size = 0
+	l.nextLSN = max(l.nextLSN, nextLSN)
+	l.writtenLSN = l.nextLSN - 1
+	l.flushedLSN = l.nextLSN - 1
+	l.flushed.Broadcast()
+	return nil
+}
+
+// 次に割り当てるLSNを返却
+func (l *Log) NextLSN() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nextLSN
+}
+
+// ログファイルを閉じる
+// ファイルに書き込んでいないレコードは破棄される
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// ======================================================================
+
+func encode(record *Record) []byte {
+	payload := make([]byte, 0, 33+len(record.Before)+len(record.After))
+	payload = binary.LittleEndian.AppendUint64(payload, record.LSN)
+	payload = binary.LittleEndian.AppendUint64(payload, record.TxnID)
+	payload = append(payload, byte(record.Type))
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(record.PageID))
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(record.Before)))
+	payload = append(payload, record.Before...)
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(record.After)))
+	payload = append(payload, record.After...)
+	return payload
+}
+
+func decode(payload []byte) (*Record, bool) {
+	if len(payload) < 33 {
+		return nil, false
+	}
+	record := &Record{
+		LSN:    binary.LittleEndian.Uint64(payload[0:8]),
+		TxnID:  binary.LittleEndian.Uint64(payload[8:16]),
+		Type:   RecordType(payload[16]),
+		PageID: disk.PageID(binary.LittleEndian.Uint64(payload[17:25])),
+	}
+
+	rest := payload[25:]
+	beforeLen := int(binary.LittleEndian.Uint32(rest[0:4]))
+	if len(rest) < 4+beforeLen+4 {
+		return nil, false
+	}
+	record.Before = rest[4 : 4+beforeLen]
+	rest = rest[4+beforeLen:]
+
+	afterLen := int(binary.LittleEndian.Uint32(rest[0:4]))
+	if len(rest) != 4+afterLen {
+		return nil, false
+	}
+	record.After = rest[4:]
+
+	// 空のイメージはnilとして扱う
+	if beforeLen == 0 {
+		record.Before = nil
+	}
+	if afterLen == 0 {
+		record.After = nil
+	}
+	return record, true
+}
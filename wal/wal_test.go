@@ -0,0 +1,180 @@
+package wal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+func TestLog(t *testing.T) {
+	// 準備
+	assert := assert.New(t)
+
+	t.Run("Append Flush Reopen", func(t *testing.T) {
+		testPath := t.TempDir() + "/wal"
+		l, err := Open(testPath)
+		assert.NoError(err)
+
+		// LSNは1から順に割り当てられる
+		lsn := l.Append(&Record{TxnID: 1, Type: PageRecord, PageID: disk.PageID(3), Before: []byte("before")}, func(lsn uint64) []byte {
+			assert.Equal(uint64(1), lsn)
+			return []byte("after")
+		})
+		assert.Equal(uint64(1), lsn)
+		lsn = l.Append(&Record{TxnID: 1, Type: CommitRecord}, nil)
+		assert.Equal(uint64(2), lsn)
+
+		// Flushするまでファイルには書き込まれない
+		records, err := l.Records()
+		assert.NoError(err)
+		assert.Empty(records)
+
+		assert.NoError(l.Flush(lsn))
+		records, err = l.Records()
+		assert.NoError(err)
+		assert.Len(records, 2)
+
+		// Flushしていないレコードは閉じると失われる
+		l.Append(&Record{TxnID: 2, Type: CommitRecord}, nil)
+		assert.NoError(l.Close())
+
+		l, err = Open(testPath)
+		assert.NoError(err)
+		defer l.Close()
+
+		records, err = l.Records()
+		assert.NoError(err)
+		assert.Equal([]*Record{
+			{LSN: 1, TxnID: 1, Type: PageRecord, PageID: disk.PageID(3), Before: []byte("before"), After: []byte("after")},
+			{LSN: 2, TxnID: 1, Type: CommitRecord},
+		}, records)
+		assert.Equal(uint64(3), l.NextLSN())
+	})
+
+	t.Run("Torn Tail", func(t *testing.T) {
+		testPath := t.TempDir() + "/wal"
+		l, err := Open(testPath)
+		assert.NoError(err)
+		l.Append(&Record{TxnID: 1, Type: PageRecord, PageID: disk.PageID(1), After: make([]byte, 4096)}, nil)
+		lsn := l.Append(&Record{TxnID: 1, Type: PageRecord, PageID: disk.PageID(2), After: make([]byte, 4096)}, nil)
+		assert.NoError(l.Flush(lsn))
+		assert.NoError(l.Close())
+
+		// 2つ目のレコードの書き込み途中で中断された状態を再現
+		info, err := os.Stat(testPath)
+		assert.NoError(err)
+		assert.NoError(os.Truncate(testPath, info.Size()-100))
+
+		l, err = Open(testPath)
+		assert.NoError(err)
+		defer l.Close()
+
+		records, err := l.Records()
+		assert.NoError(err)
+		assert.Len(records, 1)
+		assert.Equal(disk.PageID(1), records[0].PageID)
+
+		// 切り捨てたレコードのLSNから再び割り当てられ、続けて追加できる
+		lsn = l.Append(&Record{TxnID: 2, Type: CommitRecord}, nil)
+		assert.Equal(uint64(2), lsn)
+		assert.NoError(l.Flush(lsn))
+		records, err = l.Records()
+		assert.NoError(err)
+		assert.Len(records, 2)
+	})
+
+	t.Run("Corrupted Record", func(t *testing.T) {
+		testPath := t.TempDir() + "/wal"
+		l, err := Open(testPath)
+		assert.NoError(err)
+		l.Append(&Record{TxnID: 1, Type: CommitRecord}, nil)
+		lsn := l.Append(&Record{TxnID: 2, Type: CommitRecord}, nil)
+		assert.NoError(l.Flush(lsn))
+		assert.NoError(l.Close())
+
+		// 2つ目のレコードのペイロードを壊すと、CRC32の検証でそれ以降が切り捨てられる
+		info, err := os.Stat(testPath)
+		assert.NoError(err)
+		file, err := os.OpenFile(testPath, os.O_RDWR, 0755)
+		assert.NoError(err)
+		_, err = file.WriteAt([]byte{0xff}, info.Size()-1)
+		assert.NoError(err)
+		assert.NoError(file.Close())
+
+		l, err = Open(testPath)
+		assert.NoError(err)
+		defer l.Close()
+
+		records, err := l.Records()
+		assert.NoError(err)
+		assert.Len(records, 1)
+		assert.Equal(uint64(1), records[0].TxnID)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		l, err := Open(t.TempDir() + "/wal")
+		assert.NoError(err)
+		defer l.Close()
+
+		lsn := l.Append(&Record{TxnID: 1, Type: CommitRecord}, nil)
+		assert.NoError(l.Flush(lsn))
+
+		// レコードは破棄されるが、LSNは単調に増加し続ける
+		assert.NoError(l.Reset(1))
+		records, err := l.Records()
+		assert.NoError(err)
+		assert.Empty(records)
+		assert.Equal(uint64(2), l.NextLSN())
+
+		// 指定したLSNの方が大きければ、そこから割り当てる
+		assert.NoError(l.Reset(10))
+		assert.Equal(uint64(10), l.Append(&Record{TxnID: 2, Type: CommitRecord}, nil))
+	})
+
+	t.Run("Read Only", func(t *testing.T) {
+		testPath := t.TempDir() + "/wal"
+
+		// ファイルがなければ空のログとして開き、ファイルは作成しない
+		l, err := Open(testPath, WithReadOnly())
+		assert.NoError(err)
+		records, err := l.Records()
+		assert.NoError(err)
+		assert.Empty(records)
+		assert.NoError(l.Close())
+		_, err = os.Stat(testPath)
+		assert.True(os.IsNotExist(err))
+
+		// 書き込み途中のレコードがあっても切り捨てない
+		l, err = Open(testPath)
+		assert.NoError(err)
+		lsn := l.Append(&Record{TxnID: 1, Type: CommitRecord}, nil)
+		assert.NoError(l.Flush(lsn))
+		assert.NoError(l.Close())
+		f, err := os.OpenFile(testPath, os.O_WRONLY|os.O_APPEND, 0755)
+		assert.NoError(err)
+		_, err = f.Write([]byte{1, 2, 3})
+		assert.NoError(err)
+		assert.NoError(f.Close())
+		before, err := os.ReadFile(testPath)
+		assert.NoError(err)
+
+		l, err = Open(testPath, WithReadOnly())
+		assert.NoError(err)
+		records, err = l.Records()
+		assert.NoError(err)
+		assert.Len(records, 1)
+
+		// 書き込みはErrReadOnly
+		lsn = l.Append(&Record{TxnID: 2, Type: CommitRecord}, nil)
+		assert.ErrorIs(l.Flush(lsn), disk.ErrReadOnly)
+		assert.ErrorIs(l.Commit(lsn), disk.ErrReadOnly)
+		assert.ErrorIs(l.Reset(0), disk.ErrReadOnly)
+		assert.NoError(l.Close())
+
+		after, err := os.ReadFile(testPath)
+		assert.NoError(err)
+		assert.Equal(before, after)
+	})
+}